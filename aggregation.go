@@ -0,0 +1,194 @@
+package mhist
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Aggregation combines all measurements of a time bucket into a single measurement.
+//Numerical series support mean, min, max, sum, count, first, last, median and percentiles like p95 or p99.9,
+//categorical series support mode, distinct (the amount of distinct values), count, first and last.
+//Queries with functions that only make sense for numerical series are rejected if they match a categorical series,
+//subscriptions skip the categorical series instead
+type Aggregation struct {
+	Function   string
+	Percentile float64
+}
+
+//numericalOnly is true for the functions that can't aggregate categorical series
+func (a *Aggregation) numericalOnly() bool {
+	switch a.Function {
+	case "mean", "min", "max", "sum", "percentile":
+		return true
+	}
+	return false
+}
+
+//ParseAggregation from its string representation
+func ParseAggregation(function string) (*Aggregation, error) {
+	switch function {
+	case "mean", "min", "max", "sum", "count", "first", "last", "mode", "distinct":
+		return &Aggregation{Function: function}, nil
+	case "median":
+		return &Aggregation{Function: "percentile", Percentile: 50}, nil
+	}
+	if strings.HasPrefix(function, "p") {
+		percentile, err := strconv.ParseFloat(function[1:], 64)
+		if err == nil && percentile >= 0 && percentile <= 100 {
+			return &Aggregation{Function: "percentile", Percentile: percentile}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown aggregation '%v'", function)
+}
+
+//Aggregate the measurements of the bucket starting at bucketStart
+func (a *Aggregation) Aggregate(bucketStart int64, measurements []Measurement) Measurement {
+	switch a.Function {
+	case "count":
+		return &Numerical{Ts: bucketStart, Value: float64(len(measurements))}
+	case "distinct":
+		distinct := map[interface{}]struct{}{}
+		for _, m := range measurements {
+			distinct[m.ValueInterface()] = struct{}{}
+		}
+		return &Numerical{Ts: bucketStart, Value: float64(len(distinct))}
+	case "first":
+		return withTimestamp(measurements[0], bucketStart)
+	case "last":
+		return withTimestamp(measurements[len(measurements)-1], bucketStart)
+	}
+
+	if measurements[0].Type() != MeasurementNumerical || a.Function == "mode" {
+		return aggregateMode(bucketStart, measurements)
+	}
+
+	values := make([]float64, 0, len(measurements))
+	for _, m := range measurements {
+		if numerical, ok := m.(*Numerical); ok {
+			values = append(values, numerical.Value)
+		}
+	}
+	value := 0.0
+	switch a.Function {
+	case "mean", "sum":
+		for _, v := range values {
+			value += v
+		}
+		if a.Function == "mean" {
+			value /= float64(len(values))
+		}
+	case "min":
+		value = math.Inf(1)
+		for _, v := range values {
+			value = math.Min(value, v)
+		}
+	case "max":
+		value = math.Inf(-1)
+		for _, v := range values {
+			value = math.Max(value, v)
+		}
+	case "percentile":
+		value = percentile(values, a.Percentile)
+	}
+	return &Numerical{Ts: bucketStart, Value: value}
+}
+
+//percentile with linear interpolation between the closest ranks
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+//aggregateMode returns the most frequent value, on ties the value that reached the count first wins
+func aggregateMode(bucketStart int64, measurements []Measurement) Measurement {
+	counts := map[interface{}]int{}
+	var mode Measurement
+	for _, m := range measurements {
+		value := m.ValueInterface()
+		counts[value]++
+		if mode == nil || counts[value] > counts[mode.ValueInterface()] {
+			mode = m
+		}
+	}
+	return withTimestamp(mode, bucketStart)
+}
+
+func withTimestamp(m Measurement, ts int64) Measurement {
+	switch value := m.(type) {
+	case *Numerical:
+		return &Numerical{Ts: ts, Value: value.Value}
+	case *Categorical:
+		return &Categorical{Ts: ts, Value: value.Value}
+	}
+	return m.Copy()
+}
+
+//BucketAggregator aggregates a stream of measurements of one series into fixed time buckets, aligned to multiples of the granularity
+type BucketAggregator struct {
+	Granularity  time.Duration
+	Aggregation  *Aggregation
+	bucketStart  int64
+	measurements []Measurement
+}
+
+//Add a copy of the measurement, since measurements of the store are recycled while a bucket may still be open.
+//Returns the aggregated measurement of the previous bucket once the measurement belongs to a later bucket.
+//Measurements older than the current bucket are dropped
+func (b *BucketAggregator) Add(m Measurement) (aggregated Measurement, ok bool) {
+	return b.add(m.Copy())
+}
+
+//add the measurement without copying it, it must not be recycled until the bucket is flushed
+func (b *BucketAggregator) add(m Measurement) (aggregated Measurement, ok bool) {
+	bucketStart := alignToBucket(m.Timestamp(), b.Granularity)
+	if len(b.measurements) > 0 && bucketStart > b.bucketStart {
+		aggregated, ok = b.Flush()
+	}
+	if len(b.measurements) > 0 && bucketStart < b.bucketStart {
+		return
+	}
+	b.bucketStart = bucketStart
+	b.measurements = append(b.measurements, m)
+	return
+}
+
+//Flush returns the aggregated measurement of the current bucket, if it contains any measurements
+func (b *BucketAggregator) Flush() (aggregated Measurement, ok bool) {
+	if len(b.measurements) == 0 {
+		return nil, false
+	}
+	aggregated = b.Aggregation.Aggregate(b.bucketStart, b.measurements)
+	b.measurements = nil
+	return aggregated, true
+}
+
+func alignToBucket(ts int64, granularity time.Duration) int64 {
+	bucketSize := granularity.Nanoseconds()
+	offset := ts % bucketSize
+	if offset < 0 {
+		offset += bucketSize
+	}
+	return ts - offset
+}
+
+func aggregateMeasurements(measurements []Measurement, granularity time.Duration, aggregation *Aggregation) []Measurement {
+	aggregator := &BucketAggregator{Granularity: granularity, Aggregation: aggregation}
+	aggregated := []Measurement{}
+	for _, m := range measurements {
+		if bucket, ok := aggregator.add(m); ok {
+			aggregated = append(aggregated, bucket)
+		}
+	}
+	if bucket, ok := aggregator.Flush(); ok {
+		aggregated = append(aggregated, bucket)
+	}
+	return aggregated
+}
@@ -0,0 +1,108 @@
+package mhist
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_aggregateMeasurements(t *testing.T) {
+	numericals := []Measurement{
+		&Numerical{Ts: 1000, Value: 4},
+		&Numerical{Ts: 1500, Value: 1},
+		&Numerical{Ts: 1900, Value: 7},
+		&Numerical{Ts: 2100, Value: 10},
+		&Numerical{Ts: 4000, Value: 2},
+	}
+	aggregate := func(function string, measurements []Measurement) []Measurement {
+		aggregation, err := ParseAggregation(function)
+		So(err, ShouldBeNil)
+		return aggregateMeasurements(measurements, 1000*time.Nanosecond, aggregation)
+	}
+
+	Convey("aggregates numerical measurements in aligned buckets", t, func() {
+		So(aggregate("mean", numericals), ShouldResemble, []Measurement{
+			&Numerical{Ts: 1000, Value: 4},
+			&Numerical{Ts: 2000, Value: 10},
+			&Numerical{Ts: 4000, Value: 2},
+		})
+		So(aggregate("min", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 1})
+		So(aggregate("max", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 7})
+		So(aggregate("sum", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 12})
+		So(aggregate("count", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 3})
+		So(aggregate("first", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 4})
+		So(aggregate("last", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 7})
+		So(aggregate("median", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 4})
+		So(aggregate("p75", numericals)[0], ShouldResemble, &Numerical{Ts: 1000, Value: 5.5})
+	})
+
+	Convey("aggregates categorical measurements", t, func() {
+		categoricals := []Measurement{
+			&Categorical{Ts: 1000, Value: "on"},
+			&Categorical{Ts: 1200, Value: "off"},
+			&Categorical{Ts: 1400, Value: "off"},
+			&Categorical{Ts: 1600, Value: "on"},
+			&Categorical{Ts: 1800, Value: "error"},
+		}
+		So(aggregate("mode", categoricals), ShouldResemble, []Measurement{&Categorical{Ts: 1000, Value: "off"}})
+		So(aggregate("distinct", categoricals), ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 3}})
+		So(aggregate("mean", categoricals), ShouldResemble, []Measurement{&Categorical{Ts: 1000, Value: "off"}})
+	})
+
+	Convey("rejects unknown aggregations", t, func() {
+		_, err := ParseAggregation("p101")
+		So(err, ShouldNotBeNil)
+		_, err = ParseAggregation("average")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_FilterCollection_Process(t *testing.T) {
+	Convey("forwards a bucket once the next bucket starts", t, func() {
+		filter := NewFilterCollection(FilterDefinition{Granularity: 1000 * time.Nanosecond, Aggregate: "max"})
+		_, ok := filter.Process("bla", &Numerical{Ts: 1000, Value: 1})
+		So(ok, ShouldBeFalse)
+		_, ok = filter.Process("bla", &Numerical{Ts: 1500, Value: 3})
+		So(ok, ShouldBeFalse)
+		forwarded, ok := filter.Process("bla", &Numerical{Ts: 2000, Value: 2})
+		So(ok, ShouldBeTrue)
+		So(forwarded, ShouldResemble, &Numerical{Ts: 1000, Value: 3})
+	})
+
+	Convey("isn't affected by measurements that are recycled while their bucket is open", t, func() {
+		filter := NewFilterCollection(FilterDefinition{Granularity: 1000 * time.Nanosecond, Aggregate: "max"})
+		m := &Numerical{Ts: 1000, Value: 1}
+		filter.Process("bla", m)
+		m.Reset()
+		m.Value = 100
+		forwarded, ok := filter.Process("bla", &Numerical{Ts: 2000, Value: 2})
+		So(ok, ShouldBeTrue)
+		So(forwarded, ShouldResemble, &Numerical{Ts: 1000, Value: 1})
+	})
+
+	Convey("skips categorical measurements for numerical-only functions", t, func() {
+		filter := NewFilterCollection(FilterDefinition{Granularity: 1000 * time.Nanosecond, Aggregate: "mean"})
+		filter.Process("status", &Categorical{Ts: 1000, Value: "on"})
+		_, ok := filter.Process("status", &Categorical{Ts: 2000, Value: "off"})
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("rejects an aggregation without a granularity", t, func() {
+		So(FilterDefinition{Aggregate: "max"}.Validate(), ShouldNotBeNil)
+		So(FilterDefinition{Aggregate: "max", Granularity: time.Second}.Validate(), ShouldBeNil)
+	})
+}
+
+func Test_Store_validateAggregation(t *testing.T) {
+	Convey("rejects numerical-only functions for categorical series", t, func() {
+		store := NewStore(1024 * 1024)
+		store.Add("temperature", &Numerical{Ts: 1000, Value: 1}, false)
+		store.Add("status", &Categorical{Ts: 1000, Value: "on"}, false)
+
+		So(store.validateAggregation(FilterDefinition{Names: []string{"temperature"}, Granularity: time.Second, Aggregate: "mean"}), ShouldBeNil)
+		So(store.validateAggregation(FilterDefinition{Granularity: time.Second, Aggregate: "mean"}), ShouldNotBeNil)
+		So(store.validateAggregation(FilterDefinition{Granularity: time.Second, Aggregate: "p95"}), ShouldNotBeNil)
+		So(store.validateAggregation(FilterDefinition{Granularity: time.Second, Aggregate: "count"}), ShouldBeNil)
+	})
+}
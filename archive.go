@@ -0,0 +1,442 @@
+package mhist
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//archiveManifestName is the last entry of every archive
+const archiveManifestName = "manifest.json"
+
+//restoreDirectory is where archives are extracted and validated before they are installed
+var restoreDirectory = ".restore"
+
+//archiveModTimeMargin widens the range of files an incremental archive includes, because file modification times come from a coarse clock
+const archiveModTimeMargin = time.Second
+
+//ArchiveManifest describes the data directory at the time the archive was created.
+//Files lists every file of the data directory, but only the ones with a checksum are contained in the archive.
+//An archive is incremental if Since is set, it then only contains the files that changed since the archive created at Since
+type ArchiveManifest struct {
+	CreatedAt int64         `json:"created_at"`
+	Since     int64         `json:"since,omitempty"`
+	Files     []ArchiveFile `json:"files"`
+}
+
+//ArchiveFile in the data directory
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+//diskArchive holds the open files of a consistent state of the data directory, that is written as a gzipped tar archive
+type diskArchive struct {
+	store    *DiskStore
+	manifest ArchiveManifest
+	meta     []byte
+	files    []*archivedFile
+	pinned   FileInfoSlice
+}
+
+type archivedFile struct {
+	name    string
+	size    int64
+	modTime int64
+	file    *os.File
+}
+
+//archive the data directory. If previous is the manifest of an earlier archive, only the files that changed since then are included.
+//The block is committed first and the data files are pinned, so they aren't appended to until the archive is released.
+//Files that are replaced in the meantime are still read through their open handles
+func (s *DiskStore) archive(previous *ArchiveManifest) (a *diskArchive, err error) {
+	a = &diskArchive{store: s}
+	if previous != nil {
+		a.manifest.Since = previous.CreatedAt
+	}
+	s.inListenRoutine(func() {
+		a.manifest.CreatedAt = time.Now().UnixNano()
+		s.commit()
+		if s.block.Len() > 0 {
+			err = errors.New("couldn't commit the buffered measurements")
+			return
+		}
+		var files, rollupFiles FileInfoSlice
+		files, err = GetSortedFileList()
+		if err != nil {
+			return
+		}
+		rollupFiles, err = getSortedRollupFileList()
+		if err != nil {
+			return
+		}
+		s.pin(files)
+		a.pinned = files
+		a.meta, err = s.meta.Marshal()
+		if err != nil {
+			return
+		}
+
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.name)
+			if _, statErr := os.Stat(indexPath(file.name)); statErr == nil {
+				names = append(names, file.name+indexFileExtension)
+			}
+		}
+		for _, file := range rollupFiles {
+			names = append(names, file.name)
+		}
+		err = a.open(names)
+	})
+	//the unchanged files are found off the DiskStore goroutine, since their content may have to be compared
+	if err == nil && previous != nil {
+		err = a.skipUnchanged(previous)
+	}
+	if err != nil {
+		a.release()
+		return nil, err
+	}
+	return a, nil
+}
+
+//open the files, they are read through their handles from then on
+func (a *diskArchive) open(names []string) error {
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(dataPath, name))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		a.files = append(a.files, &archivedFile{name: filepath.ToSlash(name), size: info.Size(), modTime: info.ModTime().UnixNano(), file: file})
+	}
+	return nil
+}
+
+//skipUnchanged files of the previous archive, they are only listed in the manifest
+func (a *diskArchive) skipUnchanged(previous *ArchiveManifest) error {
+	previousFiles := map[string]ArchiveFile{}
+	for _, file := range previous.Files {
+		previousFiles[file.Name] = file
+	}
+	changed := []*archivedFile{}
+	unchanged := []*archivedFile{}
+	for _, file := range a.files {
+		isUnchanged, err := file.isUnchanged(previousFiles[file.name], previous.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if isUnchanged {
+			unchanged = append(unchanged, file)
+		} else {
+			changed = append(changed, file)
+		}
+	}
+	for _, file := range unchanged {
+		file.file.Close()
+		a.manifest.Files = append(a.manifest.Files, ArchiveFile{Name: file.name, Size: file.size})
+	}
+	a.files = changed
+	return nil
+}
+
+//isUnchanged if the previous archive listed the file with the same name and size, and the same checksum if it contained the file.
+//Files it only listed must not have been modified since it was created, as the archive they are contained in is unknown
+func (f *archivedFile) isUnchanged(previous ArchiveFile, previousCreatedAt int64) (bool, error) {
+	if previous.Name != f.name || previous.Size != f.size {
+		return false, nil
+	}
+	if previous.SHA256 == "" {
+		return f.modTime < previousCreatedAt-archiveModTimeMargin.Nanoseconds(), nil
+	}
+	hash := sha256.New()
+	_, err := io.Copy(hash, io.NewSectionReader(f.file, 0, f.size))
+	if err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == previous.SHA256, nil
+}
+
+//write the archive as gzipped tar to w, meta first and the manifest last
+func (a *diskArchive) write(w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	modTime := time.Unix(0, a.manifest.CreatedAt)
+
+	writeEntry := func(name string, size int64, r io.Reader) (string, error) {
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.New()
+		//only the size at the time of the archive is read, in case the file was appended to
+		written, err := io.Copy(io.MultiWriter(tarWriter, hash), io.LimitReader(r, size))
+		if err != nil {
+			return "", err
+		}
+		if written != size {
+			return "", fmt.Errorf("%v shrank while it was archived", name)
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	checksum, err := writeEntry(metaFilePath, int64(len(a.meta)), bytes.NewReader(a.meta))
+	if err != nil {
+		return err
+	}
+	a.manifest.Files = append(a.manifest.Files, ArchiveFile{Name: metaFilePath, Size: int64(len(a.meta)), SHA256: checksum})
+	for _, file := range a.files {
+		checksum, err := writeEntry(file.name, file.size, file.file)
+		if err != nil {
+			return err
+		}
+		a.manifest.Files = append(a.manifest.Files, ArchiveFile{Name: file.name, Size: file.size, SHA256: checksum})
+	}
+
+	manifest, err := json.Marshal(&a.manifest)
+	if err != nil {
+		return err
+	}
+	_, err = writeEntry(archiveManifestName, int64(len(manifest)), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+//release the open and pinned files of the archive
+func (a *diskArchive) release() {
+	for _, file := range a.files {
+		file.file.Close()
+	}
+	a.files = nil
+	if a.pinned != nil {
+		a.store.unpin(a.pinned)
+		a.pinned = nil
+	}
+}
+
+//WriteArchive of a consistent state of the data directory to w, see archive
+func (s *DiskStore) WriteArchive(w io.Writer, previous *ArchiveManifest) error {
+	a, err := s.archive(previous)
+	if err != nil {
+		return err
+	}
+	defer a.release()
+	return a.write(w)
+}
+
+//ReadArchiveManifest of the archive at path
+func ReadArchiveManifest(path string) (*ArchiveManifest, error) {
+	var manifest *ArchiveManifest
+	err := readArchive(path, func(name string, r io.Reader) error {
+		if name != archiveManifestName {
+			return nil
+		}
+		manifest = &ArchiveManifest{}
+		return json.NewDecoder(r).Decode(manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%v has no manifest", path)
+	}
+	return manifest, nil
+}
+
+//readArchive calls f for every entry of the gzipped tar archive at path
+func readArchive(path string, f func(name string, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%v: %v is not a regular file", path, header.Name)
+		}
+		err = f(header.Name, tarReader)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+}
+
+//RestoreArchives installs the state of the last archive into the data directory, mhist must not be running meanwhile.
+//The first archive has to be a full one, every following one incremental to the one before it.
+//All archives are extracted and validated before anything in the data directory is replaced
+func RestoreArchives(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no archive given")
+	}
+	staging := filepath.Join(dataPath, restoreDirectory)
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	var previous *ArchiveManifest
+	for i, path := range paths {
+		manifest, err := extractArchive(path, staging)
+		if err != nil {
+			return err
+		}
+		if i == 0 && manifest.Since != 0 {
+			return fmt.Errorf("%v is incremental, restore the full archive it is based on first", path)
+		}
+		if i > 0 && (manifest.Since == 0 || manifest.Since > previous.CreatedAt) {
+			return fmt.Errorf("%v is not incremental to %v", path, paths[i-1])
+		}
+		previous = manifest
+	}
+
+	listed := map[string]bool{}
+	for _, file := range previous.Files {
+		listed[file.Name] = true
+		info, err := os.Stat(filepath.Join(staging, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return fmt.Errorf("%v is missing", file.Name)
+		}
+		if info.Size() != file.Size {
+			return fmt.Errorf("%v has %v bytes instead of %v", file.Name, info.Size(), file.Size)
+		}
+	}
+	byteSlice, err := ioutil.ReadFile(filepath.Join(staging, metaFilePath))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(byteSlice, NewDiskMeta())
+	if err != nil {
+		return fmt.Errorf("%v is invalid: %v", metaFilePath, err)
+	}
+
+	err = clearDataDirectory()
+	if err != nil {
+		return err
+	}
+	for _, file := range previous.Files {
+		path := filepath.Join(dataPath, filepath.FromSlash(file.Name))
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(staging, filepath.FromSlash(file.Name)), path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//extractArchive into directory, replacing files of earlier archives, and validate it against its manifest
+func extractArchive(path, directory string) (*ArchiveManifest, error) {
+	checksums := map[string]string{}
+	var manifest *ArchiveManifest
+	err := readArchive(path, func(name string, r io.Reader) error {
+		if name == archiveManifestName {
+			manifest = &ArchiveManifest{}
+			return json.NewDecoder(r).Decode(manifest)
+		}
+		cleanName := filepath.Clean(filepath.FromSlash(name))
+		if filepath.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%v is outside of the data directory", name)
+		}
+		filePath := filepath.Join(directory, cleanName)
+		err := os.MkdirAll(filepath.Dir(filePath), 0700)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(file, hash), r)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%v has no manifest", path)
+	}
+	contained := 0
+	for _, file := range manifest.Files {
+		if file.SHA256 == "" {
+			continue
+		}
+		contained++
+		if checksums[file.Name] != file.SHA256 {
+			return nil, fmt.Errorf("%v: %v is missing or corrupt", path, file.Name)
+		}
+	}
+	if contained != len(checksums) {
+		return nil, fmt.Errorf("%v contains files that are not in its manifest", path)
+	}
+	return manifest, nil
+}
+
+//clearDataDirectory removes everything the DiskStore restores from an archive, as well as the write-ahead log and an unfinished compaction
+func clearDataDirectory() error {
+	err := os.RemoveAll(filepath.Join(dataPath, rollupDirectory))
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() {
+			continue
+		}
+		if isDataFileName(name) || ext == indexFileExtension || ext == compactingFileExtension || name == metaFilePath || name == walFilePath || name == compactionJournalPath {
+			err := os.Remove(filepath.Join(dataPath, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
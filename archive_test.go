@@ -0,0 +1,170 @@
+package mhist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_DiskStore_archive(t *testing.T) {
+	Convey("DiskStore archives", t, func() {
+		dir := withTempDataPath(t)
+
+		diskStore, err := NewDiskStore(NewPools(nil), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+		So(err, ShouldBeNil)
+		defer diskStore.Shutdown()
+
+		for ts := int64(1000); ts < 1100; ts += 10 {
+			diskStore.Add("temperature", &Numerical{Ts: ts, Value: float64(ts)})
+			diskStore.Add("state", &Categorical{Ts: ts, Value: "on"})
+			if ts == 1040 {
+				diskStore.inListenRoutine(diskStore.commit)
+			}
+		}
+		expected := diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{})
+
+		writeArchive := func(name string, previous *ArchiveManifest) string {
+			path := filepath.Join(dir, name)
+			buffer := &bytes.Buffer{}
+			So(diskStore.WriteArchive(buffer, previous), ShouldBeNil)
+			So(ioutil.WriteFile(path, buffer.Bytes(), 0600), ShouldBeNil)
+			return path
+		}
+		restoreInto := func(paths ...string) (map[string][]Measurement, error) {
+			restoreDir, err := ioutil.TempDir("", "mhist")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(restoreDir)
+			dataPath = restoreDir
+			defer func() { dataPath = dir }()
+
+			err = RestoreArchives(paths)
+			if err != nil {
+				return nil, err
+			}
+			restored, err := NewDiskStore(NewPools(nil), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+			So(err, ShouldBeNil)
+			defer restored.Shutdown()
+			return restored.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{}), nil
+		}
+
+		Convey("include the meta, every data file and the buffered measurements", func() {
+			path := writeArchive("full.tar.gz", nil)
+			manifest, err := ReadArchiveManifest(path)
+			So(err, ShouldBeNil)
+			So(manifest.Since, ShouldEqual, 0)
+			So(manifest.Files[0].Name, ShouldEqual, metaFilePath)
+			for _, file := range manifest.Files {
+				So(file.SHA256, ShouldNotBeEmpty)
+			}
+
+			restored, err := restoreInto(path)
+			So(err, ShouldBeNil)
+			So(restored, ShouldResemble, expected)
+		})
+
+		Convey("don't change once they are taken", func() {
+			archive, err := diskStore.archive(nil)
+			So(err, ShouldBeNil)
+			diskStore.Add("temperature", &Numerical{Ts: 2000, Value: 1})
+			diskStore.inListenRoutine(diskStore.commit)
+			diskStore.inListenRoutine(diskStore.compact)
+
+			path := filepath.Join(dir, "taken.tar.gz")
+			buffer := &bytes.Buffer{}
+			So(archive.write(buffer), ShouldBeNil)
+			archive.release()
+			So(ioutil.WriteFile(path, buffer.Bytes(), 0600), ShouldBeNil)
+
+			restored, err := restoreInto(path)
+			So(err, ShouldBeNil)
+			So(restored, ShouldResemble, expected)
+		})
+
+		Convey("only include changed files if they are incremental", func() {
+			diskStore.inListenRoutine(diskStore.commit)
+			old := time.Now().Add(-time.Hour)
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			for _, file := range files {
+				So(os.Chtimes(filepath.Join(dir, file.name), old, old), ShouldBeNil)
+			}
+			base := writeArchive("base.tar.gz", nil)
+			baseManifest, err := ReadArchiveManifest(base)
+			So(err, ShouldBeNil)
+
+			//the new measurement is written to a new file, the old one stays as it is
+			diskStore.maxFileSize = 1
+			diskStore.Add("temperature", &Numerical{Ts: 2000, Value: 1})
+			incremental := writeArchive("incremental.tar.gz", baseManifest)
+			manifest, err := ReadArchiveManifest(incremental)
+			So(err, ShouldBeNil)
+			So(manifest.Since, ShouldEqual, baseManifest.CreatedAt)
+			contained := 0
+			for _, file := range manifest.Files {
+				if file.SHA256 != "" {
+					contained++
+				}
+			}
+			So(contained, ShouldBeLessThan, len(manifest.Files))
+
+			restored, err := restoreInto(base, incremental)
+			So(err, ShouldBeNil)
+			So(restored["temperature"][len(restored["temperature"])-1].Timestamp(), ShouldEqual, 2000)
+			So(len(restored["temperature"]), ShouldEqual, len(expected["temperature"])+1)
+
+			_, err = restoreInto(incremental)
+			So(err, ShouldNotBeNil)
+			_, err = restoreInto(incremental, base)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("include renamed and rewritten files if they are incremental, even if their modification time is older", func() {
+			diskStore.maxFileSize = 1
+			diskStore.Add("temperature", &Numerical{Ts: 2000, Value: 1})
+			diskStore.inListenRoutine(diskStore.commit)
+			base := writeArchive("base.tar.gz", nil)
+			baseManifest, err := ReadArchiveManifest(base)
+			So(err, ShouldBeNil)
+
+			old := time.Now().Add(-time.Hour)
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			//like fsck renames a misnamed file, which keeps its modification time
+			renamed := fileNameFromTs(files[0].oldestTs-1, files[0].latestTs)
+			So(os.Rename(filepath.Join(dir, files[0].name), filepath.Join(dir, renamed)), ShouldBeNil)
+			So(os.Rename(indexPath(files[0].name), indexPath(renamed)), ShouldBeNil)
+			data, err := ioutil.ReadFile(filepath.Join(dir, files[1].name))
+			So(err, ShouldBeNil)
+			data[len(data)-1]++
+			So(ioutil.WriteFile(filepath.Join(dir, files[1].name), data, 0600), ShouldBeNil)
+			for _, name := range []string{renamed, files[1].name} {
+				So(os.Chtimes(filepath.Join(dir, name), old, old), ShouldBeNil)
+			}
+
+			manifest, err := ReadArchiveManifest(writeArchive("incremental.tar.gz", baseManifest))
+			So(err, ShouldBeNil)
+			checksums := map[string]string{}
+			for _, file := range manifest.Files {
+				checksums[file.Name] = file.SHA256
+			}
+			So(checksums[renamed], ShouldNotBeEmpty)
+			So(checksums[renamed+indexFileExtension], ShouldNotBeEmpty)
+			So(checksums[files[1].name], ShouldNotBeEmpty)
+		})
+
+		Convey("are validated before anything is replaced", func() {
+			path := writeArchive("full.tar.gz", nil)
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(path, data[:len(data)/2], 0600), ShouldBeNil)
+
+			So(RestoreArchives([]string{path}), ShouldNotBeNil)
+			So(diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{}), ShouldResemble, expected)
+		})
+	})
+}
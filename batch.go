@@ -0,0 +1,102 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+//batchResponse reports how many messages of a batch were accepted and why the others were rejected
+type batchResponse struct {
+	Accepted int         `json:"accepted"`
+	Errors   []itemError `json:"errors"`
+}
+
+//itemError describes why the message at Index of a batch was rejected
+type itemError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+//isBatch is true for json arrays of messages and for multiple newline delimited messages. A single message may span several lines
+func isBatch(byteSlice []byte) bool {
+	trimmed := bytes.TrimSpace(byteSlice)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		return true
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	first := json.RawMessage{}
+	err := decoder.Decode(&first)
+	if err != nil {
+		//a broken message among newline delimited ones is reported on its own
+		return bytes.IndexByte(trimmed, '\n') >= 0
+	}
+	return decoder.More()
+}
+
+//handleNewMessages handles a json array of messages or newline delimited messages. Every accepted message is added to the store as usual,
+//an error is only returned if the batch itself can't be parsed
+func (s *Server) handleNewMessages(byteSlice []byte, isReplication bool) (*batchResponse, error) {
+	items, err := splitBatch(byteSlice)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &batchResponse{Errors: []itemError{}}
+	data := s.pools.GetMessage()
+	defer s.pools.PutMessage(data)
+	for index, item := range items {
+		var itemErr error
+		data.Reset()
+		err := json.Unmarshal(item, data)
+		if err != nil {
+			itemErr = err
+		} else {
+			s.handleMessage(data, isReplication, func(err error, _ int) {
+				itemErr = err
+			})
+		}
+
+		if itemErr != nil {
+			response.Errors = append(response.Errors, itemError{Index: index, Error: itemErr.Error()})
+		} else {
+			response.Accepted++
+		}
+	}
+	return response, nil
+}
+
+func splitBatch(byteSlice []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(byteSlice)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		items := []json.RawMessage{}
+		err := json.Unmarshal(trimmed, &items)
+		return items, err
+	}
+
+	items := []json.RawMessage{}
+	rest := trimmed
+	for len(rest) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(rest))
+		for {
+			item := json.RawMessage{}
+			err := decoder.Decode(&item)
+			if err == io.EOF {
+				return items, nil
+			}
+			if err != nil {
+				break
+			}
+			items = append(items, item)
+		}
+		//the broken message up to the end of its line is kept as an item of its own, so it is reported. The next message starts on the next line
+		rest = bytes.TrimSpace(rest[decoder.InputOffset():])
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			end = len(rest)
+		}
+		items = append(items, json.RawMessage(bytes.TrimSpace(rest[:end])))
+		rest = bytes.TrimSpace(rest[end:])
+	}
+	return items, nil
+}
@@ -0,0 +1,90 @@
+package mhist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_handleNewMessages(t *testing.T) {
+	Convey("handleNewMessages", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		server := &Server{store: store, pools: NewPools(store)}
+		defer store.Shutdown()
+
+		Convey("accepts a json array and reports rejected items with their index", func() {
+			response, err := server.handleNewMessages([]byte(`[
+				{"name":"temperature","value":20,"timestamp":1000},
+				{"name":"","value":21,"timestamp":1010},
+				{"name":"temperature","value":true,"timestamp":1020},
+				{"name":"temperature","value":22,"timestamp":1030}
+			]`), false)
+			So(err, ShouldBeNil)
+			So(response.Accepted, ShouldEqual, 2)
+			So(len(response.Errors), ShouldEqual, 2)
+			So(response.Errors[0].Index, ShouldEqual, 1)
+			So(response.Errors[1].Index, ShouldEqual, 2)
+
+			measurements, _ := store.GetSeries("temperature", MeasurementNumerical).GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			So(len(measurements), ShouldEqual, 2)
+		})
+
+		Convey("accepts newline delimited json", func() {
+			response, err := server.handleNewMessages([]byte("{\"name\":\"state\",\"value\":\"on\",\"timestamp\":1000}\n\n{\"name\":\"state\",\"value\":\"off\",\"timestamp\":1010}\n{broken\n"), false)
+			So(err, ShouldBeNil)
+			So(response.Accepted, ShouldEqual, 2)
+			So(len(response.Errors), ShouldEqual, 1)
+			So(response.Errors[0].Index, ShouldEqual, 2)
+		})
+
+		Convey("rejects measurements that are later than maxLateness, unless they are replicated", func() {
+			server.maxLateness = time.Minute
+			now := time.Now().UnixNano()
+			byteSlice := []byte(fmt.Sprintf(`[
+				{"name":"temperature","value":20,"timestamp":%v},
+				{"name":"temperature","value":21,"timestamp":%v},
+				{"name":"temperature","value":22}
+			]`, now-int64(2*time.Minute), now-int64(time.Second)))
+			response, err := server.handleNewMessages(byteSlice, false)
+			So(err, ShouldBeNil)
+			So(response.Accepted, ShouldEqual, 2)
+			So(len(response.Errors), ShouldEqual, 1)
+			So(response.Errors[0].Index, ShouldEqual, 0)
+			So(response.Errors[0].Error, ShouldStartWith, "measurement is 2m0")
+
+			response, err = server.handleNewMessages(byteSlice, true)
+			So(err, ShouldBeNil)
+			So(response.Accepted, ShouldEqual, 3)
+		})
+
+		Convey("returns an error for an invalid array", func() {
+			_, err := server.handleNewMessages([]byte(`[{"name":"temperature"`), false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_isBatch(t *testing.T) {
+	Convey("isBatch", t, func() {
+		So(isBatch([]byte(`{"name":"a","value":1}`)), ShouldBeFalse)
+		So(isBatch([]byte("{\"name\":\"a\",\"value\":1}\n")), ShouldBeFalse)
+		So(isBatch([]byte(` [{"name":"a","value":1}]`)), ShouldBeTrue)
+		So(isBatch([]byte("{\"name\":\"a\",\"value\":1}\n{\"name\":\"a\",\"value\":2}")), ShouldBeTrue)
+		So(isBatch([]byte("{\n  \"name\": \"a\",\n  \"value\": 1\n}\n")), ShouldBeFalse)
+		So(isBatch([]byte("{broken\n{\"name\":\"a\",\"value\":2}")), ShouldBeTrue)
+	})
+}
+
+func Test_splitBatch(t *testing.T) {
+	Convey("splits newline delimited messages that may span several lines and keeps broken ones up to the end of their line", t, func() {
+		items, err := splitBatch([]byte("{\"name\":\"a\",\n \"value\":1}\n{\"name\":\"b\"} {broken,\n{\"name\":\"c\"}\n\n{\"name\":\n"))
+		So(err, ShouldBeNil)
+		split := []string{}
+		for _, item := range items {
+			split = append(split, string(item))
+		}
+		So(split, ShouldResemble, []string{"{\"name\":\"a\",\n \"value\":1}", `{"name":"b"}`, "{broken,", `{"name":"c"}`, `{"name":`})
+	})
+}
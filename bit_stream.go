@@ -0,0 +1,63 @@
+package mhist
+
+import (
+	"errors"
+)
+
+var errBitStreamEnd = errors.New("unexpected end of bit stream")
+
+//bitWriter writes single bits or groups of bits, most significant first
+type bitWriter struct {
+	bytes    []byte
+	freeBits uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.freeBits == 0 {
+		w.bytes = append(w.bytes, 0)
+		w.freeBits = 8
+	}
+	w.freeBits--
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 1 << w.freeBits
+	}
+}
+
+//writeBits writes the lowest n bits of value
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for n > 0 {
+		n--
+		w.writeBit(value&(1<<n) != 0)
+	}
+}
+
+//bitReader reads what the bitWriter wrote
+type bitReader struct {
+	bytes    []byte
+	position uint
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	byteIndex := r.position / 8
+	if byteIndex >= uint(len(r.bytes)) {
+		return false, errBitStreamEnd
+	}
+	bit := r.bytes[byteIndex]&(1<<(7-r.position%8)) != 0
+	r.position++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	value := uint64(0)
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
@@ -1,29 +1,82 @@
 package mhist
 
-import (
-	"bytes"
-)
-
-//Block keeps the timestamp range
+//Block keeps the buffered measurements per series id and the timestamp range
 type Block struct {
-	Buffer          bytes.Buffer
+	series          map[int64]*blockSeries
+	ids             []int64
+	size            int
 	oldestTimestamp int64
 	latestTimestamp int64
 }
 
-//AddBytes to block
-func (b *Block) AddBytes(ts int64, byteSlice []byte) {
-	_, err := b.Buffer.Write(byteSlice)
-	if err != nil {
-		return
+type blockSeries struct {
+	measurementType MeasurementType
+	timestamps      []int64
+	numericals      []float64
+	categoricals    []string
+}
+
+//NewBlock with values initialized
+func NewBlock() *Block {
+	return &Block{series: map[int64]*blockSeries{}}
+}
+
+//Add measurement of series id to block
+func (b *Block) Add(id int64, m Measurement) {
+	series := b.series[id]
+	if series == nil {
+		series = &blockSeries{measurementType: m.Type()}
+		b.series[id] = series
+		b.ids = append(b.ids, id)
 	}
 
-	if b.oldestTimestamp == 0 {
+	ts := m.Timestamp()
+	series.timestamps = append(series.timestamps, ts)
+	switch value := m.(type) {
+	case *Numerical:
+		series.numericals = append(series.numericals, value.Value)
+	case *Categorical:
+		series.categoricals = append(series.categoricals, value.Value)
+	}
+	b.size += m.Size()
+
+	if b.oldestTimestamp == 0 || ts < b.oldestTimestamp {
 		b.oldestTimestamp = ts
 	}
+	if ts > b.latestTimestamp {
+		b.latestTimestamp = ts
+	}
+}
 
-	b.latestTimestamp = ts
+//Remove the measurements of series id from start to end
+func (b *Block) Remove(id int64, start, end int64) {
+	if b.series[id] == nil {
+		return
+	}
+	series := b.series
+	ids := b.ids
+	b.Reset()
+	for _, currentID := range ids {
+		series[currentID].forEach(func(m Measurement) {
+			if currentID != id || m.Timestamp() < start || m.Timestamp() > end {
+				b.Add(currentID, m)
+			}
+		})
+	}
+}
+
+//ForEach measurement in the block, in the order they were added per series
+func (b *Block) ForEach(f func(id int64, m Measurement)) {
+	for _, id := range b.ids {
+		b.series[id].forEach(func(m Measurement) {
+			f(id, m)
+		})
+	}
+}
 
+//Len is the approximate amount of bytes buffered
+func (b *Block) Len() int {
+	return b.size
 }
 
 //OldestTs ...
@@ -38,7 +91,32 @@ func (b *Block) LatestTs() int64 {
 
 //Reset Block, i.e. after writing
 func (b *Block) Reset() {
-	b.Buffer.Reset()
+	b.series = map[int64]*blockSeries{}
+	b.ids = nil
+	b.size = 0
 	b.oldestTimestamp = 0
 	b.latestTimestamp = 0
 }
+
+func (s *blockSeries) forEach(f func(m Measurement)) {
+	for index, ts := range s.timestamps {
+		switch s.measurementType {
+		case MeasurementNumerical:
+			f(&Numerical{Ts: ts, Value: s.numericals[index]})
+		case MeasurementCategorical:
+			f(&Categorical{Ts: ts, Value: s.categoricals[index]})
+		}
+	}
+}
+
+func (s *blockSeries) timestampRange() (oldestTs, latestTs int64) {
+	for index, ts := range s.timestamps {
+		if index == 0 || ts < oldestTs {
+			oldestTs = ts
+		}
+		if index == 0 || ts > latestTs {
+			latestTs = ts
+		}
+	}
+	return
+}
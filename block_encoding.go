@@ -0,0 +1,476 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+)
+
+//Binary data files start with blockFileMagic followed by the format version and then contain a sequence of frames.
+//Every frame is <uvarint payload length><payload><crc32 of payload>, so frames can be appended to a file.
+//Since version 2 every payload starts with its kind: a dataFrame holds a block, a schemaFrame the series keys and types of the ids in the blocks that follow it.
+//A walCommitFrame holds the generation of the write-ahead log whose measurements are written right after it, readers skip it.
+//In version 1 files every frame holds a block.
+//The payload of a block holds the timestamp range of the block and the encoded series:
+//<varint oldest ts><varint latest ts><uvarint series count> and per series
+//<varint id><uvarint type><uvarint count><varint oldest ts><varint latest ts><uvarint data length><data>
+//
+//The data of a series starts with delta-of-delta encoded timestamps as varints.
+//Numerical values follow xor compressed (as described in facebooks gorilla paper),
+//categorical values as a dictionary of distinct strings followed by the dictionary index of every value
+const blockFileMagic = "MHST"
+
+const blockFormatVersion = 2
+
+//frameKindsVersion is the first format version of data and rollup files with frame kinds
+const frameKindsVersion = 2
+
+const (
+	dataFrame byte = iota
+	schemaFrame
+	walCommitFrame
+)
+
+const maxBlockPayloadSize = 1 << 30
+
+var blockFileHeader = append([]byte(blockFileMagic), blockFormatVersion)
+
+var errCorruptBlock = errors.New("block is corrupt")
+
+//encode the block into its framed binary representation
+func (b *Block) encode() []byte {
+	payload := appendVarint([]byte{dataFrame}, b.oldestTimestamp)
+	payload = appendVarint(payload, b.latestTimestamp)
+	payload = appendUvarint(payload, uint64(len(b.ids)))
+	for _, id := range b.ids {
+		series := b.series[id]
+		oldestTs, latestTs := series.timestampRange()
+		data := series.encode()
+
+		payload = appendVarint(payload, id)
+		payload = appendUvarint(payload, uint64(series.measurementType))
+		payload = appendUvarint(payload, uint64(len(series.timestamps)))
+		payload = appendVarint(payload, oldestTs)
+		payload = appendVarint(payload, latestTs)
+		payload = appendUvarint(payload, uint64(len(data)))
+		payload = append(payload, data...)
+	}
+
+	return appendFrame(nil, payload)
+}
+
+//appendFrame appends <uvarint payload length><payload><crc32 of payload>
+func appendFrame(byteSlice []byte, payload []byte) []byte {
+	byteSlice = appendUvarint(byteSlice, uint64(len(payload)))
+	byteSlice = append(byteSlice, payload...)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(payload))
+	return append(byteSlice, checksum...)
+}
+
+//readFrame reads what appendFrame wrote, returns io.EOF if there is no frame left
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	payloadLength, err := binary.ReadUvarint(reader)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil || payloadLength > maxBlockPayloadSize {
+		return nil, errCorruptBlock
+	}
+	payload := make([]byte, payloadLength)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, errCorruptBlock
+	}
+	checksum := make([]byte, 4)
+	_, err = io.ReadFull(reader, checksum)
+	if err != nil || binary.BigEndian.Uint32(checksum) != crc32.ChecksumIEEE(payload) {
+		return nil, errCorruptBlock
+	}
+	return payload, nil
+}
+
+func (s *blockSeries) encode() []byte {
+	data := appendTimestamps(nil, s.timestamps)
+	switch s.measurementType {
+	case MeasurementNumerical:
+		data = append(data, encodeFloats(s.numericals)...)
+	case MeasurementCategorical:
+		data = appendDictionary(data, s.categoricals)
+	}
+	return data
+}
+
+//seriesHeader describes an encoded series inside of a block
+type seriesHeader struct {
+	id              int64
+	measurementType MeasurementType
+	count           int
+	oldestTs        int64
+	latestTs        int64
+}
+
+//decodeBlock calls f for every measurement of every series in the payload that passes include.
+//If include is nil, all series are decoded
+func decodeBlock(payload []byte, include func(header seriesHeader) bool, f func(id int64, m Measurement)) error {
+	reader := bytes.NewReader(payload)
+	_, err := binary.ReadVarint(reader)
+	if err != nil {
+		return errCorruptBlock
+	}
+	_, err = binary.ReadVarint(reader)
+	if err != nil {
+		return errCorruptBlock
+	}
+	seriesCount, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return errCorruptBlock
+	}
+	for i := uint64(0); i < seriesCount; i++ {
+		header, data, err := readSeries(reader)
+		if err != nil {
+			return err
+		}
+		if include != nil && !include(header) {
+			continue
+		}
+		err = decodeSeries(header, data, func(m Measurement) {
+			f(header.id, m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSeries(reader *bytes.Reader) (header seriesHeader, data []byte, err error) {
+	header.id, err = binary.ReadVarint(reader)
+	if err != nil {
+		return header, nil, errCorruptBlock
+	}
+	measurementType, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return header, nil, errCorruptBlock
+	}
+	header.measurementType = MeasurementType(measurementType)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count > uint64(reader.Len()) {
+		return header, nil, errCorruptBlock
+	}
+	header.count = int(count)
+	header.oldestTs, err = binary.ReadVarint(reader)
+	if err != nil {
+		return header, nil, errCorruptBlock
+	}
+	header.latestTs, err = binary.ReadVarint(reader)
+	if err != nil {
+		return header, nil, errCorruptBlock
+	}
+	dataLength, err := binary.ReadUvarint(reader)
+	if err != nil || dataLength > uint64(reader.Len()) {
+		return header, nil, errCorruptBlock
+	}
+	data = make([]byte, dataLength)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return header, nil, errCorruptBlock
+	}
+	return header, data, nil
+}
+
+func decodeSeries(header seriesHeader, data []byte, f func(m Measurement)) error {
+	reader := bytes.NewReader(data)
+	timestamps, err := readTimestamps(reader, header.count)
+	if err != nil {
+		return err
+	}
+	rest := data[len(data)-reader.Len():]
+
+	switch header.measurementType {
+	case MeasurementNumerical:
+		values, err := decodeFloats(rest, header.count)
+		if err != nil {
+			return err
+		}
+		for index, ts := range timestamps {
+			f(&Numerical{Ts: ts, Value: values[index]})
+		}
+	case MeasurementCategorical:
+		values, err := readDictionary(bytes.NewReader(rest), header.count)
+		if err != nil {
+			return err
+		}
+		for index, ts := range timestamps {
+			f(&Categorical{Ts: ts, Value: values[index]})
+		}
+	default:
+		return fmt.Errorf("unknown measurement type %v", header.measurementType)
+	}
+	return nil
+}
+
+//readBlockFile calls f for every block payload in the binary data file, it stops at the first corrupt block
+func readBlockFile(r io.Reader, f func(payload []byte) error) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(blockFileHeader))
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(blockFileMagic)]) != blockFileMagic {
+		return errors.New("not a binary data file")
+	}
+	if header[len(blockFileMagic)] > blockFormatVersion {
+		return fmt.Errorf("unsupported block format version %v", header[len(blockFileMagic)])
+	}
+	return readFrames(reader, header[len(blockFileMagic)], func(kind byte, payload []byte) error {
+		if kind != dataFrame {
+			return nil
+		}
+		return f(payload)
+	})
+}
+
+//readFrames calls f for every frame with its kind and the payload without it, frames of files older than frameKindsVersion are all dataFrames
+func readFrames(reader *bufio.Reader, version byte, f func(kind byte, payload []byte) error) error {
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kind := dataFrame
+		if version >= frameKindsVersion {
+			if len(payload) == 0 {
+				return errCorruptBlock
+			}
+			kind, payload = payload[0], payload[1:]
+		}
+		err = f(kind, payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func appendTimestamps(byteSlice []byte, timestamps []int64) []byte {
+	var previousTs, previousDelta int64
+	for index, ts := range timestamps {
+		switch index {
+		case 0:
+			byteSlice = appendVarint(byteSlice, ts)
+		case 1:
+			previousDelta = ts - previousTs
+			byteSlice = appendVarint(byteSlice, previousDelta)
+		default:
+			delta := ts - previousTs
+			byteSlice = appendVarint(byteSlice, delta-previousDelta)
+			previousDelta = delta
+		}
+		previousTs = ts
+	}
+	return byteSlice
+}
+
+func readTimestamps(reader *bytes.Reader, count int) ([]int64, error) {
+	if count > reader.Len() {
+		return nil, errCorruptBlock
+	}
+	timestamps := make([]int64, count)
+	var previousTs, previousDelta int64
+	for index := range timestamps {
+		value, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		switch index {
+		case 0:
+			timestamps[index] = value
+		case 1:
+			previousDelta = value
+			timestamps[index] = previousTs + value
+		default:
+			previousDelta += value
+			timestamps[index] = previousTs + previousDelta
+		}
+		previousTs = timestamps[index]
+	}
+	return timestamps, nil
+}
+
+func encodeFloats(values []float64) []byte {
+	writer := &bitWriter{}
+	var previous uint64
+	previousLeading, previousTrailing := uint(0), uint(0)
+	hasWindow := false
+	for index, value := range values {
+		current := math.Float64bits(value)
+		if index == 0 {
+			writer.writeBits(current, 64)
+			previous = current
+			continue
+		}
+
+		xor := current ^ previous
+		previous = current
+		if xor == 0 {
+			writer.writeBit(false)
+			continue
+		}
+		writer.writeBit(true)
+
+		leading := uint(bits.LeadingZeros64(xor))
+		trailing := uint(bits.TrailingZeros64(xor))
+		if leading > 31 {
+			leading = 31
+		}
+		if hasWindow && leading >= previousLeading && trailing >= previousTrailing {
+			writer.writeBit(false)
+			writer.writeBits(xor>>previousTrailing, 64-previousLeading-previousTrailing)
+			continue
+		}
+
+		writer.writeBit(true)
+		significantBits := 64 - leading - trailing
+		writer.writeBits(uint64(leading), 5)
+		//64 significant bits don't fit in 6 bits, but 0 significant bits are impossible here
+		writer.writeBits(uint64(significantBits&63), 6)
+		writer.writeBits(xor>>trailing, significantBits)
+		previousLeading, previousTrailing = leading, trailing
+		hasWindow = true
+	}
+	return writer.bytes
+}
+
+func decodeFloats(byteSlice []byte, count int) ([]float64, error) {
+	reader := &bitReader{bytes: byteSlice}
+	values := make([]float64, 0, count)
+	var previous uint64
+	previousLeading, previousTrailing := uint(0), uint(0)
+	for index := 0; index < count; index++ {
+		if index == 0 {
+			current, err := reader.readBits(64)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+			previous = current
+			values = append(values, math.Float64frombits(current))
+			continue
+		}
+
+		changed, err := reader.readBit()
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		if !changed {
+			values = append(values, math.Float64frombits(previous))
+			continue
+		}
+
+		newWindow, err := reader.readBit()
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		if newWindow {
+			leading, err := reader.readBits(5)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+			significantBits, err := reader.readBits(6)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+			if significantBits == 0 {
+				significantBits = 64
+			}
+			if leading+significantBits > 64 {
+				return nil, errCorruptBlock
+			}
+			previousLeading = uint(leading)
+			previousTrailing = 64 - uint(leading) - uint(significantBits)
+		}
+
+		significant, err := reader.readBits(64 - previousLeading - previousTrailing)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		previous ^= significant << previousTrailing
+		values = append(values, math.Float64frombits(previous))
+	}
+	return values, nil
+}
+
+func appendDictionary(byteSlice []byte, values []string) []byte {
+	indexes := map[string]uint64{}
+	dictionary := []string{}
+	for _, value := range values {
+		if _, ok := indexes[value]; !ok {
+			indexes[value] = uint64(len(dictionary))
+			dictionary = append(dictionary, value)
+		}
+	}
+
+	byteSlice = appendUvarint(byteSlice, uint64(len(dictionary)))
+	for _, value := range dictionary {
+		byteSlice = appendUvarint(byteSlice, uint64(len(value)))
+		byteSlice = append(byteSlice, value...)
+	}
+	for _, value := range values {
+		byteSlice = appendUvarint(byteSlice, indexes[value])
+	}
+	return byteSlice
+}
+
+func readDictionary(reader *bytes.Reader, count int) ([]string, error) {
+	dictionarySize, err := binary.ReadUvarint(reader)
+	if err != nil || dictionarySize > uint64(reader.Len()) {
+		return nil, errCorruptBlock
+	}
+	dictionary := make([]string, dictionarySize)
+	for index := range dictionary {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return nil, errCorruptBlock
+		}
+		value := make([]byte, length)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		dictionary[index] = string(value)
+	}
+
+	if count > reader.Len() {
+		return nil, errCorruptBlock
+	}
+	values := make([]string, count)
+	for index := range values {
+		dictionaryIndex, err := binary.ReadUvarint(reader)
+		if err != nil || dictionaryIndex >= dictionarySize {
+			return nil, errCorruptBlock
+		}
+		values[index] = dictionary[dictionaryIndex]
+	}
+	return values, nil
+}
+
+func appendVarint(byteSlice []byte, value int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, value)
+	return append(byteSlice, buf[:n]...)
+}
+
+func appendUvarint(byteSlice []byte, value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, value)
+	return append(byteSlice, buf[:n]...)
+}
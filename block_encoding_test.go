@@ -0,0 +1,97 @@
+package mhist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_blockEncoding(t *testing.T) {
+	Convey("block encoding", t, func() {
+		Convey("round trips timestamps with irregular intervals", func() {
+			timestamps := []int64{1000, 1010, 1020, 1021, 5000, 4999, 1 << 62}
+			byteSlice := appendTimestamps(nil, timestamps)
+			decoded, err := readTimestamps(bytes.NewReader(byteSlice), len(timestamps))
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, timestamps)
+		})
+
+		Convey("round trips floats", func() {
+			values := []float64{42, 42, 42.5, -1, 0, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(-1), 12.25, 12.5}
+			decoded, err := decodeFloats(encodeFloats(values), len(values))
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, values)
+		})
+
+		Convey("compresses regular numerical series", func() {
+			block := NewBlock()
+			for i := int64(0); i < 1000; i++ {
+				block.Add(1, &Numerical{Ts: 1000 + i*10, Value: 20})
+			}
+			So(len(block.encode()), ShouldBeLessThan, 2*1000)
+		})
+
+		Convey("round trips a block with multiple series", func() {
+			block := NewBlock()
+			block.Add(1, &Numerical{Ts: 1000, Value: 1.5})
+			block.Add(2, &Categorical{Ts: 1001, Value: "on"})
+			block.Add(1, &Numerical{Ts: 1010, Value: 2.5})
+			block.Add(2, &Categorical{Ts: 1011, Value: "off"})
+			block.Add(2, &Categorical{Ts: 1021, Value: "on"})
+
+			decoded := map[int64][]Measurement{}
+			err := readBlockFile(bytes.NewReader(append(append([]byte{}, blockFileHeader...), block.encode()...)), func(payload []byte) error {
+				return decodeBlock(payload, nil, func(id int64, m Measurement) {
+					decoded[id] = append(decoded[id], m)
+				})
+			})
+			So(err, ShouldBeNil)
+			So(decoded[1], ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1.5}, &Numerical{Ts: 1010, Value: 2.5}})
+			So(decoded[2], ShouldResemble, []Measurement{&Categorical{Ts: 1001, Value: "on"}, &Categorical{Ts: 1011, Value: "off"}, &Categorical{Ts: 1021, Value: "on"}})
+		})
+
+		Convey("detects corrupt blocks", func() {
+			block := NewBlock()
+			block.Add(1, &Numerical{Ts: 1000, Value: 1.5})
+			byteSlice := append(append([]byte{}, blockFileHeader...), block.encode()...)
+			byteSlice[len(byteSlice)-5] ^= 0xFF
+			err := readBlockFile(bytes.NewReader(byteSlice), func(payload []byte) error { return nil })
+			So(err, ShouldEqual, errCorruptBlock)
+		})
+	})
+}
+
+func Test_DiskStore_readsCsvAndBinaryFiles(t *testing.T) {
+	Convey("reads old csv files side by side with binary files", t, func() {
+		dir := withTempDataPath(t)
+
+		err := ioutil.WriteFile(filepath.Join(dir, "1000-1010.csv"), []byte("1,1000,1.5\n2,1005,on\n1,1010,2.5\n"), os.ModePerm)
+		So(err, ShouldBeNil)
+
+		store, err := NewDiskStore(NewPools(NewStore(100*1024*1024)), DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.meta.GetOrCreateID("temperature", MeasurementNumerical)
+		store.meta.GetOrCreateID("status", MeasurementCategorical)
+
+		store.Add("temperature", &Numerical{Ts: 2000, Value: 3.5})
+		store.Add("status", &Categorical{Ts: 2005, Value: "off"})
+		store.Shutdown()
+
+		files, err := GetSortedFileList()
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 2)
+		So(files[1].name, ShouldEqual, "2000-2005.mhist")
+
+		store, err = NewDiskStore(NewPools(NewStore(100*1024*1024)), DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		result := store.GetMeasurementsInTimeRange(0, 3000, FilterDefinition{})
+		store.Shutdown()
+		So(result["temperature"], ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1.5}, &Numerical{Ts: 1010, Value: 2.5}, &Numerical{Ts: 2000, Value: 3.5}})
+		So(result["status"], ShouldResemble, []Measurement{&Categorical{Ts: 1005, Value: "on"}, &Categorical{Ts: 2005, Value: "off"}})
+	})
+}
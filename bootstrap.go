@@ -0,0 +1,211 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/codeuniversity/ppp-mhist/tcp"
+)
+
+//historySentMessage is sent on bootstrap connections once the history was sent, realtime updates follow it
+const historySentMessage = `{"history_sent":true}`
+
+//resumePoint of a series during bootstrapping: the latest timestamp received and the values received with it
+type resumePoint struct {
+	ts     int64
+	values map[string]bool
+}
+
+//bootstrapProgress holds the resume point per series key, so a broken connection resumes every series where it left off
+type bootstrapProgress map[string]*resumePoint
+
+//received returns false if the measurement was received already, i.e. because it has the timestamp a series was resumed from
+func (p bootstrapProgress) received(key string, message *Message) bool {
+	value := fmt.Sprint(message.Value)
+	point := p[key]
+	switch {
+	case point == nil || message.Timestamp > point.ts:
+		p[key] = &resumePoint{ts: message.Timestamp, values: map[string]bool{value: true}}
+	case message.Timestamp == point.ts:
+		if point.values[value] {
+			return false
+		}
+		point.values[value] = true
+	}
+	return true
+}
+
+func (p *resumePoint) copy() *resumePoint {
+	values := make(map[string]bool, len(p.values))
+	for value := range p.values {
+		values[value] = true
+	}
+	return &resumePoint{ts: p.ts, values: values}
+}
+
+//update the resume points to the ones of other
+func (p bootstrapProgress) update(other bootstrapProgress) {
+	for key, point := range other {
+		p[key] = point.copy()
+	}
+}
+
+//starts to resume every known series from
+func (p bootstrapProgress) starts() map[string]int64 {
+	starts := make(map[string]int64, len(p))
+	for key, point := range p {
+		starts[key] = point.ts
+	}
+	return starts
+}
+
+//bootstrapFrom pulls the meta and all stored measurements from the mhist instance at address
+//and keeps receiving its measurements from that point on, until the server is shut down.
+//If the connection breaks, every series resumes from the latest measurement received for it. Measurements the peer only receives afterwards,
+//with a timestamp older than that, are missed
+func (s *Server) bootstrapFrom(address string) {
+	progress := bootstrapProgress{}
+	for {
+		err := s.pullFrom(address, progress, s.stopChan)
+		if err != nil {
+			fmt.Println(err)
+		}
+		select {
+		case <-s.stopChan:
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+//pullFrom the mhist instance at address, until the connection breaks or stopChan is closed.
+//The history is imported into data files in batches, like an import, without passing the memory store or the subscribers.
+//A series is resumed from the latest measurement of the last batch that was written. Series that have another type here are skipped
+func (s *Server) pullFrom(address string, progress bootstrapProgress, stopChan chan struct{}) error {
+	if s.store.diskStore == nil {
+		return errors.New("bootstrapping requires a disk store")
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+	go func() {
+		select {
+		case <-stopChan:
+		case <-doneChan:
+		}
+		conn.Close()
+	}()
+
+	//series that weren't received yet are pulled completely
+	start := int64(math.MinInt64)
+	subscriptionMessage, err := json.Marshal(&SubscriptionMessage{Start: &start, Starts: progress.starts(), Bootstrap: true})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(subscriptionMessage, '\n'))
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	byteSlice, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	peerMeta := NewDiskMeta()
+	err = json.Unmarshal(byteSlice, peerMeta)
+	if err != nil {
+		return fmt.Errorf("couldn't read meta of %v: %v", address, err)
+	}
+	skipped := map[string]bool{}
+	for key, err := range s.store.diskStore.meta.Adopt(peerMeta) {
+		fmt.Printf("skipping %v of %v: %v\n", key, address, err)
+		skipped[key] = true
+	}
+
+	//pulled are the resume points including the measurements of the batch that wasn't written yet
+	pulled := bootstrapProgress{}
+	pulled.update(progress)
+	batch := make([]importedMeasurement, 0, importBatchSize)
+	flush := func() error {
+		err := s.store.Import(batch, false)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		progress.update(pulled)
+		return nil
+	}
+	historySent := false
+	message := &Message{}
+	for {
+		byteSlice, err := tcp.ReadMessage(reader)
+		if err == tcp.ErrMessageTooLarge {
+			fmt.Println(err)
+			continue
+		}
+		if err != nil {
+			if !historySent {
+				if flushErr := flush(); flushErr != nil {
+					fmt.Println(flushErr)
+				}
+			}
+			select {
+			case <-stopChan:
+				return nil
+			default:
+				return err
+			}
+		}
+		if !historySent && string(bytes.TrimSpace(byteSlice)) == historySentMessage {
+			err = flush()
+			if err != nil {
+				return err
+			}
+			historySent = true
+			continue
+		}
+		message.Reset()
+		err = json.Unmarshal(byteSlice, message)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		key := message.SeriesKey()
+		if skipped[key] {
+			continue
+		}
+		if historySent {
+			if progress.received(key, message) {
+				s.handleMessage(message, true, func(err error, _ int) {
+					fmt.Println(err)
+				})
+			}
+			continue
+		}
+		if !pulled.received(key, message) {
+			continue
+		}
+		imported, err := s.importedMeasurementFromMessage(message)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		batch = append(batch, imported)
+		if len(batch) >= importBatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
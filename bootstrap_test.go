@@ -0,0 +1,101 @@
+package mhist
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_pullFrom(t *testing.T) {
+	Convey("pullFrom a peer", t, func() {
+		peer := NewStore(100 * 1024 * 1024)
+		peerPools := NewPools(peer)
+		handler := NewTCPHandler(&Server{store: peer, pools: peerPools}, 0, peerPools)
+		peer.AddSubscriber(handler)
+		defer peer.Shutdown()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go handler.handleNewConnection(conn)
+			}
+		}()
+
+		withTempDataPath(t)
+		local := NewStore(100 * 1024 * 1024)
+		localPools := NewPools(local)
+		diskStore, err := NewDiskStore(localPools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+		So(err, ShouldBeNil)
+		local.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		defer local.Shutdown()
+		server := &Server{store: local, pools: localPools}
+
+		peer.Add("a", &Numerical{Ts: 1000, Value: 1}, false)
+		peer.Add("a", &Numerical{Ts: 2000, Value: 2}, false)
+		peer.Add("b", &Numerical{Ts: 1500, Value: 1}, false)
+		peer.Add("c", &Categorical{Ts: 1500, Value: "on"}, false)
+		_, err = diskStore.meta.GetOrCreateID("c", MeasurementNumerical)
+		So(err, ShouldBeNil)
+
+		values := func(name string) []float64 {
+			values := []float64{}
+			for _, m := range local.GetMeasurementsInTimeRange(0, 10000, FilterDefinition{})[name] {
+				values = append(values, m.(*Numerical).Value)
+			}
+			return values
+		}
+		//measurements are sent in order, so once the marker arrived, everything before it arrived as well
+		waitFor := func(name string, count int) bool {
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				if len(values(name)) >= count {
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			return false
+		}
+		progress := bootstrapProgress{}
+		pull := func(marker int64) {
+			stopChan := make(chan struct{})
+			errChan := make(chan error)
+			go func() {
+				errChan <- server.pullFrom(listener.Addr().String(), progress, stopChan)
+			}()
+			peer.Add("marker", &Numerical{Ts: marker, Value: float64(marker)}, false)
+			So(waitFor("marker", int(marker)), ShouldBeTrue)
+			close(stopChan)
+			So(<-errChan, ShouldBeNil)
+		}
+
+		pull(1)
+		So(values("a"), ShouldResemble, []float64{1, 2})
+		So(values("b"), ShouldResemble, []float64{1})
+
+		Convey("imports the history into data files without passing the memory store", func() {
+			So(local.loadSeries("a"), ShouldBeNil)
+			So(local.loadSeries("b"), ShouldBeNil)
+		})
+
+		Convey("skips series that have another type", func() {
+			So(local.GetMeasurementsInTimeRange(0, 10000, FilterDefinition{})["c"], ShouldBeEmpty)
+		})
+
+		Convey("resumes every series from its own latest measurement", func() {
+			peer.Add("b", &Numerical{Ts: 1800, Value: 2}, false)
+			peer.Add("a", &Numerical{Ts: 2000, Value: 3}, false)
+
+			pull(2)
+			So(values("a"), ShouldResemble, []float64{1, 2, 3})
+			So(values("b"), ShouldResemble, []float64{1, 2})
+		})
+	})
+}
@@ -0,0 +1,216 @@
+package mhist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var compactionJournalPath = "compaction.journal"
+
+const compactingFileExtension = ".compacting"
+
+//compactionJournal describes a running compaction: Inputs are replaced by Output, which is completely written to Output+compactingFileExtension before the journal is.
+//If the process crashes, the compaction is finished on the next start if the journal exists and dropped otherwise, so points are never lost or duplicated
+type compactionJournal struct {
+	Output string   `json:"output"`
+	Inputs []string `json:"inputs"`
+}
+
+//compact merges adjacent small data files into time-sorted files of about maxFileSize and purges deleted measurements.
+//The latest file is left alone, because commits are still appended to it
+func (s *DiskStore) compact() {
+	files, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, group := range s.compactionGroups(files) {
+		if s.isAnyPinned(group) {
+			continue
+		}
+		err := s.compactFiles(group)
+		if err != nil {
+			fmt.Println("compaction failed:", err)
+		}
+	}
+	s.purgeTombstones()
+}
+
+func (s *DiskStore) isAnyPinned(files FileInfoSlice) bool {
+	for _, file := range files {
+		if s.isPinned(file.name) {
+			return true
+		}
+	}
+	return false
+}
+
+//compactionGroups returns runs of at least two adjacent files that are smaller than half of maxFileSize or overlap their predecessor,
+//every run is at most maxFileSize big
+func (s *DiskStore) compactionGroups(files FileInfoSlice) []FileInfoSlice {
+	groups := []FileInfoSlice{}
+	if len(files) < 2 {
+		return groups
+	}
+	group := FileInfoSlice{}
+	var groupSize int64
+	finishGroup := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = FileInfoSlice{}
+		groupSize = 0
+	}
+	for index, file := range files[:len(files)-1] {
+		overlaps := index > 0 && file.oldestTs <= files[index-1].latestTs
+		small := file.size < s.maxFileSize/2
+		if !small && !overlaps {
+			finishGroup()
+			continue
+		}
+		if len(group) > 0 && groupSize+file.size > s.maxFileSize && !overlaps {
+			finishGroup()
+		}
+		group = append(group, file)
+		groupSize += file.size
+	}
+	finishGroup()
+	return groups
+}
+
+type idMeasurement struct {
+	id          int64
+	measurement Measurement
+}
+
+//compactFiles into a single time-sorted file and replace them with it
+func (s *DiskStore) compactFiles(files FileInfoSlice) error {
+	measurements := []idMeasurement{}
+	deleted := s.meta.getTombstones()
+	for _, file := range files {
+		err := s.readDataFile(file, func(id int64, m Measurement) {
+			if !deleted.covers(id, m.Timestamp()) {
+				//merged series are written with the id of the series they were merged into
+				measurements = append(measurements, idMeasurement{id: s.meta.canonicalID(id), measurement: m})
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %v", file.name, err)
+		}
+	}
+	if len(measurements) == 0 {
+		return nil
+	}
+	sort.SliceStable(measurements, func(i, j int) bool {
+		return measurements[i].measurement.Timestamp() < measurements[j].measurement.Timestamp()
+	})
+	data := encodeDataFile(measurements, s.meta)
+
+	journal := &compactionJournal{Output: fileNameFromTs(measurements[0].measurement.Timestamp(), measurements[len(measurements)-1].measurement.Timestamp())}
+	outputIsInput := false
+	for _, file := range files {
+		journal.Inputs = append(journal.Inputs, file.name)
+		outputIsInput = outputIsInput || file.name == journal.Output
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, journal.Output)); err == nil && !outputIsInput {
+		return fmt.Errorf("%v already exists", journal.Output)
+	}
+
+	outputPath := filepath.Join(dataPath, journal.Output)
+	err := writeSyncedFile(outputPath+compactingFileExtension, data)
+	if err != nil {
+		return err
+	}
+	byteSlice, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(dataPath, compactionJournalPath), byteSlice)
+	if err != nil {
+		os.Remove(outputPath + compactingFileExtension)
+		return err
+	}
+	return finishCompaction(journal)
+}
+
+//encodeDataFile of time sorted measurements, with the schema of all contained series first.
+//They are written in blocks of the usual size, so the index can point to small parts of the file
+func encodeDataFile(measurements []idMeasurement, meta *DiskMeta) []byte {
+	ids := []int64{}
+	isIncluded := map[int64]bool{}
+	for _, m := range measurements {
+		if !isIncluded[m.id] {
+			isIncluded[m.id] = true
+			ids = append(ids, m.id)
+		}
+	}
+	data := append(append([]byte{}, blockFileHeader...), meta.encodeSchema(ids)...)
+	block := NewBlock()
+	for _, m := range measurements {
+		block.Add(m.id, m.measurement)
+		if block.Len() > maxBuffer {
+			data = append(data, block.encode()...)
+			block.Reset()
+		}
+	}
+	if block.Len() > 0 {
+		data = append(data, block.encode()...)
+	}
+	return data
+}
+
+//finishCompaction moves the output in place, removes the inputs and finally the journal. It can be repeated until it succeeds
+func finishCompaction(journal *compactionJournal) error {
+	outputPath := filepath.Join(dataPath, journal.Output)
+	err := os.Rename(outputPath+compactingFileExtension, outputPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, input := range journal.Inputs {
+		if input == journal.Output {
+			continue
+		}
+		err := removeDataFile(input)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = sealDataFile(journal.Output)
+	if err != nil {
+		fmt.Println(journal.Output, err)
+	}
+	return os.Remove(filepath.Join(dataPath, compactionJournalPath))
+}
+
+//recoverCompaction finishes a compaction that was interrupted by a crash and removes the output of compactions that didn't get to write their journal
+func recoverCompaction() error {
+	byteSlice, err := ioutil.ReadFile(filepath.Join(dataPath, compactionJournalPath))
+	if err == nil {
+		journal := &compactionJournal{}
+		err = json.Unmarshal(byteSlice, journal)
+		if err != nil {
+			return err
+		}
+		err = finishCompaction(journal)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == compactingFileExtension {
+			os.Remove(filepath.Join(dataPath, f.Name()))
+		}
+	}
+	return nil
+}
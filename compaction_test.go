@@ -0,0 +1,93 @@
+package mhist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_compaction(t *testing.T) {
+	Convey("compaction", t, func() {
+		withTempDataPath(t)
+
+		meta := NewDiskMeta()
+		temperatureID, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+		statusID, _ := meta.GetOrCreateID("status", MeasurementCategorical)
+		writeFile := func(id int64, timestamps ...int64) *FileInfo {
+			block := NewBlock()
+			for _, ts := range timestamps {
+				if id == statusID {
+					block.Add(id, &Categorical{Ts: ts, Value: "on"})
+				} else {
+					block.Add(id, &Numerical{Ts: ts, Value: float64(ts)})
+				}
+			}
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+			return &FileInfo{name: fileNameFromTs(block.OldestTs(), block.LatestTs())}
+		}
+		fileNames := func() (names []string) {
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			for _, file := range files {
+				names = append(names, file.name)
+			}
+			return
+		}
+
+		Convey("merges small and overlapping files into time-sorted files, except the latest one", func() {
+			writeFile(temperatureID, 1000, 1010)
+			writeFile(temperatureID, 1020, 1030)
+			writeFile(statusID, 1025, 1040)
+			writeFile(temperatureID, 2000, 2010)
+
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			diskStore.Shutdown()
+			diskStore.compact()
+
+			So(fileNames(), ShouldResemble, []string{fileNameFromTs(1000, 1040), fileNameFromTs(2000, 2010)})
+			result := diskStore.takeSnapshot(0, 3000).read(FilterDefinition{})
+			timestamps := []int64{}
+			for _, m := range result["temperature"] {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			So(timestamps, ShouldResemble, []int64{1000, 1010, 1020, 1030, 2000, 2010})
+			So(len(result["status"]), ShouldEqual, 2)
+		})
+
+		Convey("finishes a compaction that was interrupted after writing its journal", func() {
+			first := writeFile(temperatureID, 1000, 1010)
+			second := writeFile(temperatureID, 1020, 1030)
+			block := NewBlock()
+			for _, ts := range []int64{1000, 1010, 1020, 1030} {
+				block.Add(temperatureID, &Numerical{Ts: ts, Value: float64(ts)})
+			}
+			output := fileNameFromTs(1000, 1030)
+			So(writeSyncedFile(filepath.Join(dataPath, output+compactingFileExtension), append(append([]byte{}, blockFileHeader...), block.encode()...)), ShouldBeNil)
+			byteSlice, err := json.Marshal(&compactionJournal{Output: output, Inputs: []string{first.name, second.name}})
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dataPath, compactionJournalPath), byteSlice, 0600), ShouldBeNil)
+
+			So(recoverCompaction(), ShouldBeNil)
+			So(fileNames(), ShouldResemble, []string{output})
+			_, err = os.Stat(filepath.Join(dataPath, compactionJournalPath))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("drops the output of a compaction that was interrupted before writing its journal", func() {
+			first := writeFile(temperatureID, 1000, 1010)
+			second := writeFile(temperatureID, 1020, 1030)
+			So(writeSyncedFile(filepath.Join(dataPath, fileNameFromTs(1000, 1030)+compactingFileExtension), []byte("partial")), ShouldBeNil)
+
+			So(recoverCompaction(), ShouldBeNil)
+			So(fileNames(), ShouldResemble, []string{first.name, second.name})
+			entries, err := ioutil.ReadDir(dataPath)
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 3)
+		})
+	})
+}
@@ -1,46 +1,49 @@
 package mhist
 
 import (
+	"bytes"
 	"encoding/csv"
-	"fmt"
 	"io"
-	"strconv"
-	"strings"
 )
 
 const fieldSeperatorRune = ','
-const fieldSeperator = string(fieldSeperatorRune)
-
-const fieldSeperatorSize = len(fieldSeperator)
 
 const newLineSize = len("\n")
 
-//constructCsvLine constructs a byteSlice, that if converted to a string is a csv line with `<id>,<timestamp>,<value>\n`
-//it avoids unnecessary string allocations by making a slice of len = 0 and a capacity (=length of underlying array) equal to what it needs for the whole line
-func constructCsvLine(id int64, m Measurement) ([]byte, error) {
-	value := m.ValueString()
-	tsString := strconv.FormatInt(m.Timestamp(), 10)
-	idString := strconv.FormatInt(id, 10)
-
-	if strings.ContainsRune(value, ',') || strings.ContainsRune(value, '\n') {
-		return nil, fmt.Errorf("'%v' contains an invalid char", value)
-	}
-
-	byteSize := len(idString) + fieldSeperatorSize + len(tsString) + fieldSeperatorSize + len(value) + newLineSize
-	byteSlice := make([]byte, 0, byteSize)
-
-	byteSlice = append(byteSlice, []byte(idString)...)
-	byteSlice = append(byteSlice, []byte(fieldSeperator)...)
-	byteSlice = append(byteSlice, []byte(tsString)...)
-	byteSlice = append(byteSlice, []byte(fieldSeperator)...)
-	byteSlice = append(byteSlice, []byte(value)...)
-	byteSlice = append(byteSlice, []byte("\n")...)
-
-	return byteSlice, nil
-}
-
 func newCsvReader(r io.Reader) *csv.Reader {
 	reader := csv.NewReader(r)
 	reader.Comma = fieldSeperatorRune
+	reader.FieldsPerRecord = -1
 	return reader
 }
+
+//readCsvRecords calls f for every record in data together with the bytes it was read from.
+//If a record can't be parsed, f is called with the error and the rest of its line, and reading continues on the next line,
+//so a single broken record doesn't make the records after it unreadable
+func readCsvRecords(data []byte, f func(fields []string, raw []byte, err error)) {
+	offset := 0
+	for offset < len(data) {
+		reader := newCsvReader(bytes.NewReader(data[offset:]))
+		for {
+			start := offset + int(reader.InputOffset())
+			fields, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				//the blank lines the reader skipped before the record don't belong to it
+				for data[start] == '\n' || data[start] == '\r' {
+					start++
+				}
+				end := len(data)
+				if lineEnd := bytes.IndexByte(data[start:], '\n'); lineEnd >= 0 {
+					end = start + lineEnd + newLineSize
+				}
+				f(nil, data[start:end], err)
+				offset = end
+				break
+			}
+			f(fields, data[start:offset+int(reader.InputOffset())], nil)
+		}
+	}
+}
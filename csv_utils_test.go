@@ -1,22 +1,36 @@
 package mhist
 
 import (
+	"bytes"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
-func Test_constructCsvLine(t *testing.T) {
-	Convey("fills the buffer correctly", t, func() {
-		m := &Numerical{
-			Ts:    1000,
-			Value: 42,
-		}
-
-		byteSlice, err := constructCsvLine(1, m)
-		So(err, ShouldBeNil)
+func Test_readCsvRecords(t *testing.T) {
+	Convey("passes every record with the bytes it was read from", t, func() {
+		data := []byte("1,1000,1\n\n1,1001,\"a\nb\"\n1,1002,3")
+		raw := [][]byte{}
+		readCsvRecords(data, func(fields []string, line []byte, err error) {
+			So(err, ShouldBeNil)
+			raw = append(raw, line)
+		})
+		So(raw, ShouldResemble, [][]byte{[]byte("1,1000,1\n"), []byte("\n1,1001,\"a\nb\"\n"), []byte("1,1002,3")})
+		So(bytes.Join(raw, nil), ShouldResemble, data)
+	})
 
-		str := string(byteSlice)
-		So(str, ShouldEqual, "1,1000,42\n")
+	Convey("continues on the next line after a broken record", t, func() {
+		data := []byte("1,1000,1\n\n1,1001,\"broken\n1,1002,3\n1,1003,bare\"quote\n1,1004,5\n")
+		values := []string{}
+		broken := [][]byte{}
+		readCsvRecords(data, func(fields []string, raw []byte, err error) {
+			if err != nil {
+				broken = append(broken, raw)
+				return
+			}
+			values = append(values, fields[2])
+		})
+		So(values, ShouldResemble, []string{"1", "3", "5"})
+		So(broken, ShouldResemble, [][]byte{[]byte("1,1001,\"broken\n"), []byte("1,1003,bare\"quote\n")})
 	})
 }
@@ -0,0 +1,346 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//Deletion removes the measurements of the series with Name and Tags from Start to End (both inclusive).
+//If WholeSeries is set, the series is removed completely instead, so its name can be used again, even with another type
+type Deletion struct {
+	Name        string            `json:"name"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Start       int64             `json:"start,omitempty"`
+	End         int64             `json:"end,omitempty"`
+	WholeSeries bool              `json:"whole_series,omitempty"`
+}
+
+//SeriesKey of the series the deletion belongs to
+func (d Deletion) SeriesKey() string {
+	return SeriesKey(d.Name, d.Tags)
+}
+
+//Validate the deletion
+func (d Deletion) Validate() error {
+	if d.Name == "" {
+		return errors.New("name can't be empty")
+	}
+	if !d.WholeSeries && d.Start > d.End {
+		return errors.New("start can't be bigger than end")
+	}
+	return nil
+}
+
+//Tombstone marks the measurements of the series with ID from Start to End as deleted, until they are purged from the data files
+type Tombstone struct {
+	ID    int64 `json:"id"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type tombstones []Tombstone
+
+//covers is true if the measurement of series id at ts is deleted
+func (t tombstones) covers(id int64, ts int64) bool {
+	for _, tombstone := range t {
+		if tombstone.ID == id && ts >= tombstone.Start && ts <= tombstone.End {
+			return true
+		}
+	}
+	return false
+}
+
+func (t tombstones) overlaps(start, end int64) bool {
+	for _, tombstone := range t {
+		if tombstone.Start <= end && tombstone.End >= start {
+			return true
+		}
+	}
+	return false
+}
+
+//DeletionSubscriber is a Subscriber that also has to know about deletions, i.e. to replicate them
+type DeletionSubscriber interface {
+	NotifyDeletion(deletion Deletion)
+}
+
+//deletionMessage is how deletions are replicated: {"delete": {...}}
+type deletionMessage struct {
+	Delete *Deletion `json:"delete"`
+}
+
+var deletionMessagePrefix = []byte(`{"delete":`)
+
+func isDeletionMessage(byteSlice []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(byteSlice), deletionMessagePrefix)
+}
+
+//Delete the measurements of the deletion from memory and disk, and replicate it if it didn't come from a replication itself
+func (s *Store) Delete(deletion Deletion, isReplication bool) {
+	key := deletion.SeriesKey()
+	if deletion.WholeSeries {
+		s.removeSeries(key)
+	} else if series, ok := s.seriesMap.Load(key); ok && series != nil {
+		series.(*Series).DeleteTimeRange(deletion.Start, deletion.End)
+	}
+	if s.diskStore != nil {
+		s.diskStore.Delete(deletion)
+	}
+
+	if isReplication {
+		return
+	}
+	for _, replication := range s.replications {
+		if subscriber, ok := replication.(DeletionSubscriber); ok {
+			subscriber.NotifyDeletion(deletion)
+		}
+	}
+}
+
+func (s *Store) removeSeries(key string) {
+	s.Lock()
+	series, ok := s.seriesMap.Load(key)
+	s.seriesMap.Delete(key)
+	s.Unlock()
+
+	if ok && series != nil {
+		series.(*Series).Shutdown()
+	}
+}
+
+//matchingSeriesKeys of the series in memory and on disk that match names and tags of the filterDefinition, sorted
+func (s *Store) matchingSeriesKeys(filterDefinition FilterDefinition) []string {
+	filter := NewFilterCollection(FilterDefinition{Names: filterDefinition.Names, Tags: filterDefinition.Tags})
+	keys := []string{}
+	isIncluded := map[string]bool{}
+	include := func(key string) {
+		if !isIncluded[key] && filter.Matches(key) {
+			isIncluded[key] = true
+			keys = append(keys, key)
+		}
+	}
+	s.forEachSeries(func(key string, _ *Series) {
+		include(key)
+	})
+	if s.diskStore != nil {
+		for _, key := range s.diskStore.GetAllSeriesKeys() {
+			include(key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Delete the measurements of the deletion. They are hidden from reads right away and purged from the data files by the next compaction
+func (s *DiskStore) Delete(deletion Deletion) {
+	s.inListenRoutine(func() {
+		s.handleDelete(deletion)
+	})
+}
+
+func (s *DiskStore) handleDelete(deletion Deletion) {
+	var deleted []Tombstone
+	if deletion.WholeSeries {
+		deleted = s.meta.deleteSeries(deletion.SeriesKey())
+	} else {
+		deleted = s.meta.deleteTimeRange(deletion.SeriesKey(), deletion.Start, deletion.End)
+	}
+	for _, tombstone := range deleted {
+		s.block.Remove(tombstone.ID, tombstone.Start, tombstone.End)
+	}
+}
+
+//purgeTombstones removes the deleted measurements from the data and rollup files, the tombstones are dropped once no file contains their measurements anymore
+func (s *DiskStore) purgeTombstones() {
+	deleted := s.meta.getTombstones()
+	if len(deleted) == 0 {
+		return
+	}
+	//the write-ahead log has to be empty, otherwise a crash would bring back deleted measurements after their tombstones are gone
+	s.commit()
+	if s.block.Len() > 0 {
+		return
+	}
+
+	files, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rollupFiles, err := getSortedRollupFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	purged := true
+	for _, file := range files {
+		if !deleted.overlaps(file.oldestTs, file.latestTs) {
+			continue
+		}
+		if s.isPinned(file.name) {
+			purged = false
+			continue
+		}
+		err := s.rewriteDataFile(file, func(id int64, m Measurement) bool {
+			return !deleted.covers(id, m.Timestamp())
+		})
+		if err != nil {
+			fmt.Println(file.name, err)
+			purged = false
+		}
+	}
+	for _, file := range rollupFiles {
+		if !deleted.overlaps(file.oldestTs, file.latestTs) {
+			continue
+		}
+		err := rewriteRollupFile(file, deleted, s.meta)
+		if err != nil {
+			fmt.Println(file.name, err)
+			purged = false
+		}
+	}
+	if purged {
+		s.meta.removeTombstones(deleted)
+	}
+}
+
+//rewriteRollupFile without the buckets that start in a deleted time range. The file is removed if nothing is kept
+func rewriteRollupFile(file *FileInfo, deleted tombstones, meta *DiskMeta) error {
+	osFile, err := os.Open(filepath.Join(dataPath, file.name))
+	if err != nil {
+		return err
+	}
+	r := newRollup()
+	removed := 0
+	err = readRollupFile(osFile, func(id int64, series *rollupSeries) {
+		kept := &rollupSeries{measurementType: series.measurementType}
+		for _, bucket := range series.buckets {
+			if deleted.covers(id, bucket.start) {
+				removed++
+			} else {
+				kept.buckets = append(kept.buckets, bucket)
+			}
+		}
+		if len(kept.buckets) > 0 {
+			r.series[id] = kept
+			r.ids = append(r.ids, id)
+		}
+	})
+	osFile.Close()
+	if err != nil || removed == 0 {
+		return err
+	}
+	if len(r.ids) == 0 {
+		return os.Remove(filepath.Join(dataPath, file.name))
+	}
+	return writeFileAtomically(filepath.Join(dataPath, file.name), r.encode(meta.encodeSchema(r.ids)))
+}
+
+//deleteSeries removes the series from the meta and returns the tombstones for all of its measurements, including the ones of series that were merged into it
+func (m *DiskMeta) deleteSeries(key string) []Tombstone {
+	ids := m.idsOfName(key)
+	if len(ids) == 0 {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	deleted := []Tombstone{}
+	for _, id := range ids {
+		delete(m.IDToName, id)
+		delete(m.IDToType, id)
+		deleted = append(deleted, Tombstone{ID: id, Start: math.MinInt64, End: math.MaxInt64})
+	}
+	delete(m.NameToID, key)
+	delete(m.TypeHistory, key)
+	delete(m.Rejections, key)
+	m.Tombstones = append(m.Tombstones, deleted...)
+	m.sync()
+	return deleted
+}
+
+//deleteTimeRange of the series and return the tombstones
+func (m *DiskMeta) deleteTimeRange(key string, start, end int64) []Tombstone {
+	ids := m.idsOfName(key)
+	if len(ids) == 0 {
+		return nil
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	deleted := []Tombstone{}
+	for _, id := range ids {
+		deleted = append(deleted, Tombstone{ID: id, Start: start, End: end})
+	}
+	m.Tombstones = append(m.Tombstones, deleted...)
+	m.sync()
+	return deleted
+}
+
+func (m *DiskMeta) getTombstones() tombstones {
+	m.RLock()
+	defer m.RUnlock()
+	return append(tombstones{}, m.Tombstones...)
+}
+
+//removeTombstones that were purged
+func (m *DiskMeta) removeTombstones(purged tombstones) {
+	m.Lock()
+	defer m.Unlock()
+
+	isPurged := map[Tombstone]bool{}
+	for _, tombstone := range purged {
+		isPurged[tombstone] = true
+	}
+	remaining := []Tombstone{}
+	for _, tombstone := range m.Tombstones {
+		if !isPurged[tombstone] {
+			remaining = append(remaining, tombstone)
+		}
+	}
+	m.Tombstones = remaining
+	m.sync()
+}
+
+//NotifyDeletion queues the deletion for the replication target, if the series is replicated
+func (r *Replication) NotifyDeletion(deletion Deletion) {
+	r.filterMutex.Lock()
+	matches := r.filter.Matches(deletion.SeriesKey())
+	r.filterMutex.Unlock()
+	if !matches {
+		return
+	}
+
+	byteSlice, err := json.Marshal(&deletionMessage{Delete: &deletion})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = r.outbox.enqueue(byteSlice)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (s *Server) handleDeletionMessage(byteSlice []byte, isReplication bool) error {
+	message := &deletionMessage{}
+	err := json.Unmarshal(byteSlice, message)
+	if err != nil {
+		return err
+	}
+	if message.Delete == nil {
+		return errors.New("deletion is missing")
+	}
+	err = message.Delete.Validate()
+	if err != nil {
+		return err
+	}
+	s.store.Delete(*message.Delete, isReplication)
+	return nil
+}
@@ -0,0 +1,122 @@
+package mhist
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Series_DeleteTimeRange(t *testing.T) {
+	Convey("DeleteTimeRange removes the measurements in the timerange", t, func() {
+		series := NewSeries(MeasurementNumerical)
+		defer series.Shutdown()
+		for ts := int64(1000); ts <= 1040; ts += 10 {
+			series.Add(&Numerical{Ts: ts, Value: 1})
+		}
+		series.DeleteTimeRange(1010, 1025)
+
+		measurements, _ := series.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+		timestamps := []int64{}
+		for _, m := range measurements {
+			timestamps = append(timestamps, m.Timestamp())
+		}
+		So(timestamps, ShouldResemble, []int64{1000, 1030, 1040})
+		So(series.Size(), ShouldEqual, 3*(&Numerical{}).Size())
+	})
+}
+
+func Test_Store_Delete(t *testing.T) {
+	Convey("Store.Delete", t, func() {
+		withTempDataPath(t)
+
+		store := NewStore(100 * 1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		defer store.Shutdown()
+
+		for ts := int64(1000); ts <= 1040; ts += 10 {
+			store.Add("temperature", &Numerical{Ts: ts, Value: float64(ts)}, false)
+			store.Add("pressure", &Numerical{Ts: ts, Value: float64(ts)}, false)
+			if ts == 1020 {
+				diskStore.inListenRoutine(diskStore.commit)
+			}
+		}
+		timestamps := func(measurements []Measurement) []int64 {
+			timestamps := []int64{}
+			for _, m := range measurements {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			return timestamps
+		}
+		onDisk := func() map[string][]int64 {
+			result := map[string][]int64{}
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			for _, file := range files {
+				So(diskStore.readDataFile(file, func(id int64, m Measurement) {
+					result[diskStore.meta.GetNameForID(id)] = append(result[diskStore.meta.GetNameForID(id)], m.Timestamp())
+				}), ShouldBeNil)
+			}
+			return result
+		}
+
+		Convey("hides a deleted time range in memory and on disk until it is purged", func() {
+			store.Delete(Deletion{Name: "temperature", Start: 1010, End: 1030}, false)
+
+			So(timestamps(store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{1000, 1040})
+			So(timestamps(diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{1000, 1040})
+			So(timestamps(diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["pressure"]), ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040})
+			So(len(diskStore.meta.getTombstones()), ShouldEqual, 1)
+			So(onDisk()["temperature"], ShouldResemble, []int64{1000, 1010, 1020})
+
+			diskStore.inListenRoutine(diskStore.compact)
+			So(len(diskStore.meta.getTombstones()), ShouldEqual, 0)
+			So(onDisk()["temperature"], ShouldResemble, []int64{1000, 1040})
+			So(onDisk()["pressure"], ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040})
+			So(timestamps(diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{1000, 1040})
+		})
+
+		Convey("removes whole series, so they can be recreated with another type", func() {
+			store.Delete(Deletion{Name: "temperature", WholeSeries: true}, false)
+
+			So(store.matchingSeriesKeys(FilterDefinition{}), ShouldResemble, []string{"pressure"})
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			_, ok := result["temperature"]
+			So(ok, ShouldBeFalse)
+
+			store.Add("temperature", &Categorical{Ts: 2000, Value: "hot"}, false)
+			So(timestamps(store.GetMeasurementsInTimeRange(0, 3000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{2000})
+			So(diskStore.meta.GetTypeForID(diskStore.meta.NameToID["temperature"]), ShouldEqual, MeasurementCategorical)
+
+			diskStore.inListenRoutine(diskStore.compact)
+			So(len(diskStore.meta.getTombstones()), ShouldEqual, 0)
+			So(onDisk()["temperature"], ShouldResemble, []int64{2000})
+			So(onDisk()[""], ShouldBeNil)
+		})
+
+		Convey("replicates deletions", func() {
+			replication, err := NewReplication("127.0.0.1:1", FilterDefinition{}, NewPools(store), 1024*1024)
+			So(err, ShouldBeNil)
+			defer replication.Shutdown()
+			store.AddReplication(replication)
+
+			store.Delete(Deletion{Name: "pressure", Start: 1000, End: 1020}, false)
+			store.Delete(Deletion{Name: "temperature", Start: 1000, End: 1020}, true)
+			pending := replication.outbox.pendingAfter(0)
+			So(len(pending), ShouldEqual, 1)
+			So(isDeletionMessage(pending[0].message), ShouldBeTrue)
+
+			replica := NewStore(100 * 1024 * 1024)
+			defer replica.Shutdown()
+			pools := NewPools(replica)
+			handler := NewTCPHandler(&Server{store: replica, pools: pools}, 0, pools)
+			for ts := int64(1000); ts <= 1040; ts += 10 {
+				replica.Add("pressure", &Numerical{Ts: ts, Value: float64(ts)}, true)
+			}
+			handler.onNewMessage(pending[0].message, true)
+			So(timestamps(replica.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["pressure"]), ShouldResemble, []int64{1030, 1040})
+		})
+	})
+}
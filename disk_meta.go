@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 )
 
@@ -14,36 +15,67 @@ var metaFilePath = "meta.json"
 //DiskMeta holds the meta info for (Un)Marshalization
 type DiskMeta struct {
 	//sync maps would be better here, but are not easy to marshalize
+	//names are series keys, so series with tags have their own id
 	NameToID map[string]int64          `json:"name_to_id"`
 	IDToName map[int64]string          `json:"id_to_name"`
 	IDToType map[int64]MeasurementType `json:"id_to_type"`
 
 	HighestID int64 `json:"highest_id"`
 
+	RetentionRules []RetentionRule `json:"retention_rules,omitempty"`
+	Tombstones     []Tombstone     `json:"tombstones,omitempty"`
+
+	SchemaRules []SchemaRule `json:"schema_rules,omitempty"`
+	//TypeHistory of the series keys whose type changed in versioned mode
+	TypeHistory map[string][]TypeVersion `json:"type_history,omitempty"`
+
+	//AppliedSeqs are the sequence numbers of the replicated messages stored per origin instance
+	AppliedSeqs map[string]uint64 `json:"applied_seqs,omitempty"`
+
+	//Rejections of measurements per series key because of their type
+	Rejections map[string]*TypeRejection `json:"rejections,omitempty"`
+
+	//dirty is set for changes that are written with the next syncIfDirty
+	dirty bool
+
 	sync.RWMutex
 }
 
-//MeasurementTypeInfo ...
+//MeasurementTypeInfo describes all series with the same name, with the values of their tags per tag key.
+//TypeHistory and Rejections are per series key, for the series whose type changed or that rejected measurements because of their type
 type MeasurementTypeInfo struct {
-	Name string          `json:"name"`
-	Type MeasurementType `json:"type"`
+	Name        string                    `json:"name"`
+	Type        MeasurementType           `json:"type"`
+	Tags        map[string][]string       `json:"tags,omitempty"`
+	TypeHistory map[string][]TypeVersion  `json:"type_history,omitempty"`
+	Rejections  map[string]*TypeRejection `json:"rejections,omitempty"`
 }
 
 //InitMetaFromDisk ...
+//If meta.json is missing or corrupt, the meta is rebuilt from the schemas of the data files. A corrupt file is kept next to it for inspection
 func InitMetaFromDisk() *DiskMeta {
-	byteSlice, err := ioutil.ReadFile(filepath.Join(dataPath, metaFilePath))
-	if err != nil {
-		//assume no file exists
-		return NewDiskMeta()
+	path := filepath.Join(dataPath, metaFilePath)
+	byteSlice, err := ioutil.ReadFile(path)
+	if err == nil {
+		meta := &DiskMeta{}
+		err = json.Unmarshal(byteSlice, meta)
+		if err == nil {
+			return meta
+		}
+		fmt.Println(metaFilePath, "is corrupt, rebuilding it from the data files:", err)
+		os.Rename(path, path+".corrupt")
+	} else if !os.IsNotExist(err) {
+		fmt.Println(err)
 	}
-	meta := &DiskMeta{}
-	err = json.Unmarshal(byteSlice, meta)
+
+	meta, err := rebuildMeta()
 	if err != nil {
-		//assume file invalid/corrupted
-		meta = NewDiskMeta()
-		meta.sync() //Overwrite bad file
-		return meta
+		fmt.Println("couldn't rebuild", metaFilePath, ":", err)
+	}
+	if meta == nil {
+		return NewDiskMeta()
 	}
+	meta.sync()
 	return meta
 }
 
@@ -56,14 +88,20 @@ func NewDiskMeta() *DiskMeta {
 	}
 }
 
-//GetOrCreateID for name, checks if MeasurementType is correct
+//GetOrCreateID for name, checks if MeasurementType is correct.
+//If the series had the type in an earlier version, the id of that version is returned
 func (m *DiskMeta) GetOrCreateID(name string, t MeasurementType) (int64, error) {
 	m.RLock()
 	id := m.NameToID[name]
+	savedType := m.IDToType[id]
+	versionID := m.versionID(name, t)
 	m.RUnlock()
 
 	if id != 0 {
-		if savedType := m.IDToType[id]; savedType != t {
+		if savedType != t {
+			if versionID != 0 {
+				return versionID, nil
+			}
 			return 0, fmt.Errorf("had type %v but was provided %v", savedType, t)
 		}
 		return id, nil
@@ -93,6 +131,19 @@ func (m *DiskMeta) GetNameForID(id int64) string {
 	return m.IDToName[id]
 }
 
+//namesOfIDs maps the ids of all series whose key passes include to the name they are read with, see readName
+func (m *DiskMeta) namesOfIDs(include func(key string) bool) map[int64]string {
+	m.RLock()
+	defer m.RUnlock()
+	names := map[int64]string{}
+	for id, key := range m.IDToName {
+		if include(key) {
+			names[id] = m.readName(id)
+		}
+	}
+	return names
+}
+
 //GetTypeForID to translate back form csv to record
 func (m *DiskMeta) GetTypeForID(id int64) MeasurementType {
 	m.RLock()
@@ -100,26 +151,155 @@ func (m *DiskMeta) GetTypeForID(id int64) MeasurementType {
 	return m.IDToType[id]
 }
 
-//GetAllStoredInfos from meta
+//GetAllStoredInfos from meta, one per name
 func (m *DiskMeta) GetAllStoredInfos() (infos []MeasurementTypeInfo) {
 	m.RLock()
 	defer m.RUnlock()
-	for name, id := range m.NameToID {
-		info := MeasurementTypeInfo{
-			Name: name,
-			Type: m.IDToType[id],
+	indexPerName := map[string]int{}
+	for key, id := range m.NameToID {
+		name, tags := ParseSeriesKey(key)
+		index, ok := indexPerName[name]
+		if !ok {
+			index = len(infos)
+			indexPerName[name] = index
+			infos = append(infos, MeasurementTypeInfo{
+				Name: name,
+				Type: m.IDToType[id],
+			})
+		}
+		info := &infos[index]
+		if history := m.TypeHistory[key]; len(history) > 0 {
+			if info.TypeHistory == nil {
+				info.TypeHistory = map[string][]TypeVersion{}
+			}
+			info.TypeHistory[key] = append([]TypeVersion{}, history...)
+		}
+		if rejection := m.Rejections[key]; rejection != nil {
+			if info.Rejections == nil {
+				info.Rejections = map[string]*TypeRejection{}
+			}
+			copied := *rejection
+			info.Rejections[key] = &copied
+		}
+		for tagKey, tagValue := range tags {
+			if info.Tags == nil {
+				info.Tags = map[string][]string{}
+			}
+			if !containsString(info.Tags[tagKey], tagValue) {
+				info.Tags[tagKey] = append(info.Tags[tagKey], tagValue)
+			}
+		}
+	}
+	for _, info := range infos {
+		for _, values := range info.Tags {
+			sort.Strings(values)
 		}
-		infos = append(infos, info)
 	}
 	return
 }
 
+//GetAllSeriesKeys from meta
+func (m *DiskMeta) GetAllSeriesKeys() []string {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]string, 0, len(m.NameToID))
+	for key := range m.NameToID {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func containsString(slice []string, s string) bool {
+	for _, element := range slice {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+//Adopt the names and types of another DiskMeta, i.e. of a peer this instance is bootstrapped from.
+//If this meta is still empty, the ids are taken over as well. Series whose type differs from the one here are skipped and returned with the reason
+func (m *DiskMeta) Adopt(other *DiskMeta) (conflicts map[string]error) {
+	other.RLock()
+	defer other.RUnlock()
+
+	m.Lock()
+	if len(m.NameToID) == 0 {
+		for name, id := range other.NameToID {
+			m.NameToID[name] = id
+		}
+		for id, name := range other.IDToName {
+			m.IDToName[id] = name
+		}
+		for id, t := range other.IDToType {
+			m.IDToType[id] = t
+		}
+		m.HighestID = other.HighestID
+		m.sync()
+		m.Unlock()
+		return nil
+	}
+	m.Unlock()
+
+	conflicts = map[string]error{}
+	for name, id := range other.NameToID {
+		_, err := m.GetOrCreateID(name, other.IDToType[id])
+		if err != nil {
+			conflicts[name] = err
+		}
+	}
+	return conflicts
+}
+
+//Marshal the meta thread safely
+func (m *DiskMeta) Marshal() ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return json.Marshal(m)
+}
+
+//appliedSeqs per origin instance
+func (m *DiskMeta) appliedSeqs() map[string]uint64 {
+	m.RLock()
+	defer m.RUnlock()
+
+	seqs := map[string]uint64{}
+	for origin, seq := range m.AppliedSeqs {
+		seqs[origin] = seq
+	}
+	return seqs
+}
+
+//setAppliedSeq of origin, it is written with the next syncIfDirty
+func (m *DiskMeta) setAppliedSeq(origin string, seq uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.AppliedSeqs == nil {
+		m.AppliedSeqs = map[string]uint64{}
+	}
+	m.AppliedSeqs[origin] = seq
+	m.dirty = true
+}
+
+//syncIfDirty writes the meta if it has changes that weren't written yet
+func (m *DiskMeta) syncIfDirty() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.dirty {
+		m.sync()
+	}
+}
+
 func (m *DiskMeta) sync() {
+	m.dirty = false
 	byteSlice, err := json.Marshal(m)
 	if err != nil {
 		panic(fmt.Errorf("%v ,couldn't marshal diskMeta %v, this shouldn't happen ", err, m))
 	}
-	err = ioutil.WriteFile(filepath.Join(dataPath, metaFilePath), byteSlice, os.ModePerm)
+	err = writeFileAtomically(filepath.Join(dataPath, metaFilePath), byteSlice)
 	if err != nil {
 		panic(fmt.Errorf("%v, couldn't write diskMeta %v, this shouldn't happen ", err, m))
 	}
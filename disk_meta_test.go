@@ -0,0 +1,42 @@
+package mhist
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_DiskMeta_Adopt(t *testing.T) {
+	Convey("Adopt()", t, func() {
+		withTempDataPath(t)
+
+		peer := NewDiskMeta()
+		peer.GetOrCreateID("temperature", MeasurementNumerical)
+		peer.GetOrCreateID("status", MeasurementCategorical)
+
+		Convey("takes over the ids if empty", func() {
+			meta := NewDiskMeta()
+			So(meta.Adopt(peer), ShouldBeEmpty)
+			So(meta.NameToID, ShouldResemble, peer.NameToID)
+			So(meta.HighestID, ShouldEqual, 2)
+		})
+
+		Convey("adds missing names otherwise", func() {
+			meta := NewDiskMeta()
+			meta.GetOrCreateID("status", MeasurementCategorical)
+			So(meta.Adopt(peer), ShouldBeEmpty)
+			So(meta.GetTypeForID(meta.NameToID["temperature"]), ShouldEqual, MeasurementNumerical)
+			So(meta.NameToID["status"], ShouldEqual, 1)
+		})
+
+		Convey("skips and returns series with conflicting types", func() {
+			meta := NewDiskMeta()
+			meta.GetOrCreateID("temperature", MeasurementCategorical)
+			conflicts := meta.Adopt(peer)
+			So(len(conflicts), ShouldEqual, 1)
+			So(conflicts["temperature"], ShouldNotBeNil)
+			So(meta.GetTypeForID(meta.NameToID["temperature"]), ShouldEqual, MeasurementCategorical)
+			So(meta.GetTypeForID(meta.NameToID["status"]), ShouldEqual, MeasurementCategorical)
+		})
+	})
+}
@@ -2,9 +2,13 @@ package mhist
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -12,83 +16,136 @@ const maxBuffer = 12 * 1024
 
 var dataPath = "data"
 
+//maintenanceInterval is the time between runs of retention, rollups and compaction
+var maintenanceInterval = time.Minute
+
+//readConcurrency is the maximum amount of data files a single read reads in parallel
+var readConcurrency = runtime.NumCPU()
+
 //DiskStore handles buffered writes to and reads from Disk
 type DiskStore struct {
 	block       *Block
 	meta        *DiskMeta
+	wal         *writeAheadLog
 	pools       *Pools
 	addChan     chan addMessage
-	readChan    chan readMessage
+	execChan    chan execMessage
 	stopChan    chan struct{}
 	maxFileSize int64
 	maxDiskSize int64
+
+	rollupAfter      time.Duration
+	rollupResolution time.Duration
+	rollupMaxAge     time.Duration
+
+	pinnedFiles map[string]int
+	pinMutex    sync.Mutex
 }
 
 type addMessage struct {
 	name        string
 	measurement Measurement
-	doneChan    chan struct{}
+	doneChan    chan error
 }
 
 type readResult map[string][]Measurement
 
-type readMessage struct {
-	fromTs           int64
-	toTs             int64
-	filterDefinition FilterDefinition
-	resultChan       chan readResult
+//DiskStoreConfig ...
+//Data files older than RollupAfter are compacted into rollups with buckets of RollupResolution, that are kept for RollupMaxAge.
+//Rollups are disabled if RollupAfter is 0 and kept forever if RollupMaxAge is 0
+type DiskStoreConfig struct {
+	MaxFileSize      int
+	MaxDiskSize      int
+	WALSyncPolicy    WALSyncPolicy
+	RollupAfter      time.Duration
+	RollupResolution time.Duration
+	RollupMaxAge     time.Duration
 }
 
-//NewDiskStore initializes the DiskBlockRoutine
-func NewDiskStore(pools *Pools, maxFileSize, maxDiskSize int) (*DiskStore, error) {
+const defaultRollupResolution = time.Minute
+
+//NewDiskStore initializes the DiskBlockRoutine, measurements left in the write-ahead log (i.e. after a crash) are committed first
+func NewDiskStore(pools *Pools, config DiskStoreConfig) (*DiskStore, error) {
 	err := os.MkdirAll(dataPath, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
+	if config.WALSyncPolicy == "" {
+		config.WALSyncPolicy = WALSyncInterval
+	}
+	if config.RollupResolution <= 0 {
+		config.RollupResolution = defaultRollupResolution
+	}
+	err = recoverCompaction()
+	if err != nil {
+		return nil, err
+	}
+	wal, err := openWriteAheadLog(config.WALSyncPolicy)
+	if err != nil {
+		return nil, err
+	}
 
 	block := &DiskStore{
 		meta:        InitMetaFromDisk(),
-		block:       &Block{},
+		block:       NewBlock(),
+		wal:         wal,
 		addChan:     make(chan addMessage),
-		readChan:    make(chan readMessage),
+		execChan:    make(chan execMessage),
+		pinnedFiles: map[string]int{},
 		stopChan:    make(chan struct{}),
 		pools:       pools,
-		maxFileSize: int64(maxFileSize),
-		maxDiskSize: int64(maxDiskSize),
+		maxFileSize: int64(config.MaxFileSize),
+		maxDiskSize: int64(config.MaxDiskSize),
+
+		rollupAfter:      config.RollupAfter,
+		rollupResolution: config.RollupResolution,
+		rollupMaxAge:     config.RollupMaxAge,
 	}
 
+	err = wal.replay(block.block.Add)
+	if err != nil {
+		fmt.Println("write-ahead log is partially corrupt, recovered what was readable:", err)
+	}
+	block.recover()
+	block.commit()
+
 	go block.Listen()
 	return block, nil
 }
 
-//Notify DiskStore about new Measurement
-func (s *DiskStore) Notify(name string, m Measurement) {
-	ownMeasurement := m.CopyFrom(s.pools)
-	s.Add(name, m)
-	s.pools.PutMeasurement(ownMeasurement)
-}
-
-//Add measurement to block
-func (s *DiskStore) Add(name string, measurement Measurement) {
-	doneChan := make(chan struct{})
+//Add measurement to block, returns an error if it couldn't be written to the write-ahead log
+func (s *DiskStore) Add(name string, measurement Measurement) error {
+	doneChan := make(chan error)
 	s.addChan <- addMessage{
 		name:        name,
 		doneChan:    doneChan,
 		measurement: measurement,
 	}
-	<-doneChan
+	return <-doneChan
 }
 
-//GetMeasurementsInTimeRange for all measurement names
+//GetMeasurementsInTimeRange for all measurement names, the data files are read without blocking new measurements
 func (s *DiskStore) GetMeasurementsInTimeRange(start, end int64, filterDefiniton FilterDefinition) map[string][]Measurement {
-	resultChan := make(chan readResult)
-	s.readChan <- readMessage{
-		fromTs:           start,
-		toTs:             end,
-		filterDefinition: filterDefiniton,
-		resultChan:       resultChan,
-	}
-	return <-resultChan
+	snapshot := s.snapshot(start, end)
+	defer snapshot.release()
+	return snapshot.read(filterDefiniton)
+}
+
+//GetRollupsInTimeRange of the series matching the names and tags of the filterDefinition, in buckets of its granularity.
+//The rollup files are read without blocking new measurements
+func (s *DiskStore) GetRollupsInTimeRange(start, end int64, filterDefiniton FilterDefinition) map[string][]Measurement {
+	var files []*os.File
+	var deleted tombstones
+	s.inListenRoutine(func() {
+		files = s.openRollupFiles(start, end)
+		deleted = s.meta.getTombstones()
+	})
+	return s.readRollups(files, deleted, start, end, filterDefiniton)
+}
+
+//RollupResolution is the smallest granularity that rollups can answer queries for
+func (s *DiskStore) RollupResolution() time.Duration {
+	return s.rollupResolution
 }
 
 //GetAllStoredInfos from meta
@@ -96,149 +153,314 @@ func (s *DiskStore) GetAllStoredInfos() []MeasurementTypeInfo {
 	return s.meta.GetAllStoredInfos()
 }
 
-//Shutdown DiskBlock goroutine
+//GetAllSeriesKeys from meta
+func (s *DiskStore) GetAllSeriesKeys() []string {
+	return s.meta.GetAllSeriesKeys()
+}
+
+//Shutdown DiskBlock goroutine, returns after the buffered writes are committed
 func (s *DiskStore) Shutdown() {
 	s.stopChan <- struct{}{}
+	<-s.stopChan
 }
 
 //Listen for new measurements
 func (s *DiskStore) Listen() {
 	timeBetweenWrites := 5 * time.Second
 	timer := time.NewTimer(timeBetweenWrites)
+	walSyncTicker := time.NewTicker(walSyncInterval)
+	defer walSyncTicker.Stop()
+	maintenanceTicker := time.NewTicker(maintenanceInterval)
+	defer maintenanceTicker.Stop()
 loop:
 	for {
 		select {
 		case <-s.stopChan:
 			s.commit()
+			s.wal.close()
+			s.meta.syncIfDirty()
+			s.stopChan <- struct{}{}
 			break loop
 		case <-timer.C:
 			s.commit()
 			timer.Stop()
 			timer.Reset(timeBetweenWrites)
-		case message := <-s.readChan:
-			message.resultChan <- s.handleRead(message.fromTs, message.toTs, message.filterDefinition)
-		case message := <-s.addChan:
-			s.handleAdd(message.name, message.measurement)
+		case <-walSyncTicker.C:
+			err := s.wal.sync()
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				//applied sequence numbers are only written once the measurements they stand for are
+				s.meta.syncIfDirty()
+			}
+		case <-maintenanceTicker.C:
+			s.enforceRetention(time.Now().UnixNano())
+			s.rollupAgedFiles(time.Now().UnixNano())
+			s.compact()
+			s.sealFiles()
+		case message := <-s.execChan:
+			message.f()
 			message.doneChan <- struct{}{}
+		case message := <-s.addChan:
+			message.doneChan <- s.handleAdd(message.name, message.measurement)
 		}
 	}
 }
 
-//Commit the buffered writes to actual disk
+//Commit the buffered writes to actual disk, the write-ahead log is only truncated if that worked
 func (s *DiskStore) commit() {
-	if s.block.Buffer.Len() == 0 {
+	if s.block.Len() == 0 {
 		return
 	}
 
-	fileList, err := GetSortedFileList()
+	err := s.writeBlock()
 	if err != nil {
-		fmt.Printf("couldn't get file List: %v", err)
-		return
-	}
-	defer s.block.Reset()
-	if len(fileList) == 0 {
-		WriteBlockToFile(s.block)
-		return
-	}
-	latestFile := fileList[len(fileList)-1]
-	if latestFile.size < s.maxFileSize {
-		AppendBlockToFile(latestFile, s.block)
+		//keep the block buffered, so the next commit retries
+		fmt.Println(err)
 		return
 	}
-	WriteBlockToFile(s.block)
-
-	if fileList.TotalSize() > s.maxDiskSize {
-		oldestFile := fileList[0]
-		os.Remove(filepath.Join(dataPath, oldestFile.name))
+	s.block.Reset()
+	err = s.wal.truncate()
+	if err != nil {
+		fmt.Println(err)
 	}
 }
 
-func (s *DiskStore) handleAdd(name string, m Measurement) {
-	id, err := s.meta.GetOrCreateID(name, m.Type())
+func (s *DiskStore) writeBlock() error {
+	fileList, err := GetSortedFileList()
 	if err != nil {
-		//measurement is probably of different type than it used to be, just ignore for now
-		return
+		return fmt.Errorf("couldn't get file List: %v", err)
+	}
+	if len(fileList) == 0 {
+		return WriteBlockToFile(s.block, s.meta, s.wal.commitFrame())
 	}
-	csvLineBytes, err := constructCsvLine(id, m)
+	latestFile := fileList[len(fileList)-1]
+	//pinned files are being read and can't be appended to, which renames them
+	if latestFile.size < s.maxFileSize && latestFile.hasCurrentFormat() && !s.isPinned(latestFile.name) {
+		return AppendBlockToFile(latestFile, s.block, s.meta, s.wal.commitFrame())
+	}
+	//a file with the same time range is appended to instead of being replaced
+	if clash := fileList.byName(fileNameFromTs(s.block.OldestTs(), s.block.LatestTs())); clash != nil {
+		if !clash.hasCurrentFormat() || s.isPinned(clash.name) {
+			return fmt.Errorf("%v already exists", clash.name)
+		}
+		return AppendBlockToFile(clash, s.block, s.meta, s.wal.commitFrame())
+	}
+	err = WriteBlockToFile(s.block, s.meta, s.wal.commitFrame())
 	if err != nil {
-		//ignore bad values
-		return
+		return err
 	}
-	s.block.AddBytes(m.Timestamp(), csvLineBytes)
-	if s.block.Buffer.Len() > maxBuffer {
-		s.commit()
+	if !latestFile.isCsv() {
+		err = sealDataFile(latestFile.name)
+		if err != nil {
+			fmt.Println(latestFile.name, err)
+		}
 	}
 
+	s.freeDiskSpace(fileList)
+	return nil
 }
 
-func (s *DiskStore) handleRead(start, end int64, filterDefinition FilterDefinition) readResult {
-	result := readResult{}
-	files, err := GetFilesInTimeRange(start, end)
+//freeDiskSpace if the data files together with the rollups take up more than maxDiskSize.
+//The oldest data file is rolled up, or removed if rollups are disabled. Once the rollups take up as much space as the data files, the oldest rollup is removed instead
+func (s *DiskStore) freeDiskSpace(fileList FileInfoSlice) {
+	rollupFiles, err := getSortedRollupFileList()
 	if err != nil {
 		fmt.Println(err)
-		return readResult{}
 	}
-	filter := NewFilterCollection(filterDefinition)
-	for _, file := range files {
-		f, err := os.Open(filepath.Join(dataPath, file.name))
+	if fileList.TotalSize()+rollupFiles.TotalSize() <= s.maxDiskSize {
+		return
+	}
+	if len(rollupFiles) > 0 && rollupFiles.TotalSize() >= fileList.TotalSize() {
+		//readers of the rollup keep reading it through their open handle
+		err = os.Remove(filepath.Join(dataPath, rollupFiles[0].name))
 		if err != nil {
 			fmt.Println(err)
-			continue
 		}
-		defer f.Close()
-		csvReader := newCsvReader(f)
-		lines, err := csvReader.ReadAll()
+		return
+	}
+	oldestFile := fileList[0]
+	if s.isPinned(oldestFile.name) {
+		return
+	}
+	if s.rollupAfter > 0 {
+		//keep at least the rollup of data we can't afford to keep raw
+		err = s.rollupFile(oldestFile)
 		if err != nil {
-			fmt.Println(err)
-			continue
+			fmt.Println(oldestFile.name, err)
 		}
-	lineLoop:
-		for _, line := range lines {
-			if len(line) != 3 {
-				continue
-			}
-			id, err := strconv.ParseInt(line[0], 10, 64)
-			if err != nil {
-				continue
-			}
-			ts, err := strconv.ParseInt(line[1], 10, 64)
-			if err != nil || ts > end || ts < start {
-				continue
-			}
-			valueString := line[2]
-			name := s.meta.GetNameForID(id)
-			if name == "" {
-				continue
-			}
+		return
+	}
+	removeDataFile(oldestFile.name)
+}
 
-			measurementType := s.meta.GetTypeForID(id)
-			if measurementType == 0 {
-				continue
+func (s *DiskStore) handleAdd(name string, m Measurement) error {
+	id, err := s.meta.GetOrCreateID(name, m.Type())
+	if err != nil {
+		//measurements with another type are rejected before they are added, unless they belong to an earlier version of the series
+		return err
+	}
+	err = s.wal.append(id, m)
+	if err != nil {
+		return fmt.Errorf("couldn't write to the write-ahead log: %v", err)
+	}
+	s.block.Add(id, m)
+	if s.block.Len() > maxBuffer {
+		s.commit()
+	}
+	return nil
+}
+
+//read the measurements of the snapshot that pass the filterDefinition. The data files are read in parallel, off the DiskStore goroutine
+func (d *diskSnapshot) read(filterDefinition FilterDefinition) readResult {
+	s := d.store
+	//the ids are resolved once, so the workers only read shared state
+	namesPerID := s.meta.namesOfIDs(NewFilterCollection(filterDefinition).Matches)
+	includeID := func(id int64) bool {
+		_, ok := namesPerID[id]
+		return ok
+	}
+	addTo := func(result readResult) func(id int64, measurement Measurement) {
+		return func(id int64, measurement Measurement) {
+			ts := measurement.Timestamp()
+			if ts > d.end || ts < d.start || d.deleted.covers(id, ts) {
+				return
+			}
+			if name, ok := namesPerID[id]; ok {
+				result[name] = append(result[name], measurement)
 			}
+		}
+	}
 
-			var measurement Measurement
-			switch measurementType {
-			case MeasurementNumerical:
-				value, err := strconv.ParseFloat(valueString, 64)
-				if err != nil {
-					continue lineLoop
+	fileResults := make([]readResult, len(d.files))
+	fileChan := make(chan int)
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < readConcurrency && i < len(d.files); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range fileChan {
+				file := d.files[index]
+				fileResults[index] = readResult{}
+				var err error
+				if file.isCsv() {
+					err = s.readCsvFile(file, addTo(fileResults[index]))
+				} else {
+					err = s.readBlockFile(file, d.start, d.end, includeID, addTo(fileResults[index]))
 				}
-				measurement = &Numerical{
-					Ts:    ts,
-					Value: value,
+				if err != nil {
+					fmt.Println(file.name, err)
 				}
+			}
+		}()
+	}
+	for index := range d.files {
+		fileChan <- index
+	}
+	close(fileChan)
+	waitGroup.Wait()
 
-			case MeasurementCategorical:
-				measurement = &Categorical{
-					Ts:    ts,
-					Value: valueString,
+	result := readResult{}
+	for _, fileResult := range fileResults {
+		for name, measurements := range fileResult {
+			result[name] = append(result[name], measurements...)
+		}
+	}
+	addToResult := addTo(result)
+	for id, measurements := range d.unflushed {
+		for _, m := range measurements {
+			addToResult(id, m)
+		}
+	}
+	for name, measurements := range result {
+		//measurements of merged series are read per id
+		sortByTimestampIfNeeded(measurements)
+		//the granularity can only be applied to the measurements of all files together
+		if filterDefinition.Granularity > 0 {
+			timestampFilter := &TimestampFilter{Granularity: filterDefinition.Granularity}
+			passed := measurements[:0]
+			for _, m := range measurements {
+				if timestampFilter.Passes(m) {
+					passed = append(passed, m)
 				}
 			}
-			if filter.Passes(name, measurement) {
-				result[name] = append(result[name], measurement)
-			}
+			result[name] = passed
 		}
 	}
-
 	return result
 }
+
+//readDataFile calls f for every measurement in the data file
+func (s *DiskStore) readDataFile(file *FileInfo, f func(id int64, m Measurement)) error {
+	if file.isCsv() {
+		return s.readCsvFile(file, f)
+	}
+	return s.readBlockFile(file, math.MinInt64, math.MaxInt64, nil, f)
+}
+
+//readBlockFile calls f for the measurements of the series that pass includeID (or all series if it is nil) and overlap the timerange.
+//Sealed files are read through their index, only the matching series data is read from disk
+func (s *DiskStore) readBlockFile(file *FileInfo, start, end int64, includeID func(id int64) bool, f func(id int64, m Measurement)) error {
+	index, err := readIndex(file)
+	if err == nil {
+		return s.readIndexedBlockFile(file, index, start, end, includeID, f)
+	}
+
+	osFile, err := os.Open(filepath.Join(dataPath, file.name))
+	if err != nil {
+		return err
+	}
+	defer osFile.Close()
+
+	inTimeRange := func(header seriesHeader) bool {
+		return header.latestTs >= start && header.oldestTs <= end && (includeID == nil || includeID(header.id))
+	}
+	return readBlockFile(osFile, func(payload []byte) error {
+		return decodeBlock(payload, inTimeRange, f)
+	})
+}
+
+//readCsvFile of the format before the binary block format, records that can't be read are skipped
+func (s *DiskStore) readCsvFile(file *FileInfo, f func(id int64, m Measurement)) error {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, file.name))
+	if err != nil {
+		return err
+	}
+	readCsvRecords(data, func(line []string, raw []byte, err error) {
+		if err != nil || len(line) != 3 {
+			return
+		}
+		id, err := strconv.ParseInt(line[0], 10, 64)
+		if err != nil {
+			return
+		}
+		ts, err := strconv.ParseInt(line[1], 10, 64)
+		if err != nil {
+			return
+		}
+		valueString := line[2]
+
+		var measurement Measurement
+		switch s.meta.GetTypeForID(id) {
+		case MeasurementNumerical:
+			value, err := strconv.ParseFloat(valueString, 64)
+			if err != nil {
+				return
+			}
+			measurement = &Numerical{
+				Ts:    ts,
+				Value: value,
+			}
+
+		case MeasurementCategorical:
+			measurement = &Categorical{
+				Ts:    ts,
+				Value: valueString,
+			}
+		default:
+			return
+		}
+		f(id, measurement)
+	})
+	return nil
+}
@@ -0,0 +1,159 @@
+package mhist
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_DiskStore_concurrentReads(t *testing.T) {
+	Convey("DiskStore reads", t, func() {
+		withTempDataPath(t)
+
+		meta := NewDiskMeta()
+		temperatureID, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+		pressureID, _ := meta.GetOrCreateID("pressure", MeasurementNumerical)
+		fileCount := 20
+		measurementsPerFile := 5000
+		ts := int64(0)
+		for i := 0; i < fileCount; i++ {
+			block := NewBlock()
+			for j := 0; j < measurementsPerFile; j++ {
+				ts++
+				block.Add(temperatureID, &Numerical{Ts: ts, Value: float64(ts)})
+				block.Add(pressureID, &Numerical{Ts: ts, Value: float64(ts)})
+			}
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+			So(sealDataFile(fileNameFromTs(ts-int64(measurementsPerFile)+1, ts)), ShouldBeNil)
+		}
+		latestTs := ts
+
+		diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+		So(err, ShouldBeNil)
+		defer diskStore.Shutdown()
+		diskStore.Add("temperature", &Numerical{Ts: latestTs + 1, Value: 1})
+
+		Convey("read all data files in parallel together with the unflushed measurements, in time order", func() {
+			result := diskStore.GetMeasurementsInTimeRange(0, latestTs+1, FilterDefinition{Names: []string{"temperature"}})
+			So(len(result), ShouldEqual, 1)
+			So(len(result["temperature"]), ShouldEqual, int(latestTs)+1)
+			inOrder := true
+			for i, m := range result["temperature"] {
+				if m.Timestamp() != int64(i)+1 {
+					inOrder = false
+				}
+			}
+			So(inOrder, ShouldBeTrue)
+
+			sampled := diskStore.GetMeasurementsInTimeRange(0, latestTs, FilterDefinition{Granularity: 1000})
+			So(len(sampled["temperature"]), ShouldEqual, int(latestTs)/1000)
+			So(len(sampled["pressure"]), ShouldEqual, int(latestTs)/1000)
+			So(sampled["temperature"][1].Timestamp(), ShouldEqual, 1001)
+		})
+
+		Convey("don't block new measurements while a stream is read", func() {
+			readingChan := make(chan struct{})
+			continueChan := make(chan struct{})
+			go diskStore.StreamMeasurementsInTimeRange(0, latestTs, FilterDefinition{}, func(name string, measurements []Measurement) error {
+				readingChan <- struct{}{}
+				<-continueChan
+				return errors.New("stopped")
+			})
+			<-readingChan
+
+			addedChan := make(chan struct{})
+			go func() {
+				diskStore.Add("temperature", &Numerical{Ts: latestTs + 2, Value: 2})
+				diskStore.GetMeasurementsInTimeRange(latestTs, latestTs+2, FilterDefinition{})
+				close(addedChan)
+			}()
+			select {
+			case <-addedChan:
+			case <-time.After(5 * time.Second):
+			}
+			close(continueChan)
+			So(isClosed(addedChan), ShouldBeTrue)
+		})
+
+		Convey("read snapshots without blocking new measurements", func() {
+			snapshot := diskStore.snapshot(0, latestTs+200)
+			defer snapshot.release()
+			//the measurements are added between taking and reading the snapshot, which only works if reads don't happen on the DiskStore goroutine
+			for i := int64(0); i < 100; i++ {
+				diskStore.Add("pressure", &Numerical{Ts: latestTs + 10 + i, Value: 1})
+			}
+			So(len(snapshot.read(FilterDefinition{Names: []string{"pressure"}})["pressure"]), ShouldEqual, int(latestTs))
+			So(len(diskStore.GetMeasurementsInTimeRange(0, latestTs+200, FilterDefinition{Names: []string{"pressure"}})["pressure"]), ShouldEqual, int(latestTs)+100)
+		})
+	})
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func Test_DiskStore_categoricalValues(t *testing.T) {
+	Convey("DiskStore stores categorical values losslessly", t, func() {
+		dir := withTempDataPath(t)
+
+		values := []string{
+			"disk full, retrying",
+			"{\"status\": \"ok\", \"load\": [1, 2]}",
+			"first line\nsecond line\r\nthird line",
+			"Grüße, 日本語 🙂",
+			"",
+		}
+		expected := []Measurement{}
+		for i, value := range values {
+			expected = append(expected, &Categorical{Ts: int64(i + 1), Value: value})
+		}
+
+		Convey("in data files", func() {
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			for _, m := range expected {
+				diskStore.Add("log", m)
+			}
+			diskStore.Shutdown()
+
+			diskStore, err = NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			defer diskStore.Shutdown()
+			So(diskStore.GetMeasurementsInTimeRange(0, 100, FilterDefinition{})["log"], ShouldResemble, expected)
+		})
+
+		Convey("in csv data files of the old format", func() {
+			meta := NewDiskMeta()
+			id, err := meta.GetOrCreateID("log", MeasurementCategorical)
+			So(err, ShouldBeNil)
+			meta.sync()
+			data := fmt.Sprintf("%[1]v,1,\"disk full, retrying\"\n"+
+				"%[1]v,2,\"{\"\"status\"\": \"\"ok\"\", \"\"load\"\": [1, 2]}\"\n"+
+				"%[1]v,3,\"first line\nsecond line\r\nthird line\"\n"+
+				"%[1]v,4,\"Grüße, 日本語 🙂\"\n"+
+				"%[1]v,5,\n", id)
+			So(ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("1-%v.csv", len(values))), []byte(data), 0600), ShouldBeNil)
+
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			defer diskStore.Shutdown()
+			result := diskStore.GetMeasurementsInTimeRange(0, 100, FilterDefinition{})["log"]
+			So(result, ShouldHaveLength, len(values))
+			for i, m := range result {
+				//the csv reader reads \r\n in quoted values as \n
+				So(m.(*Categorical).Value, ShouldEqual, strings.Replace(values[i], "\r\n", "\n", -1))
+			}
+		})
+	})
+}
@@ -1,7 +1,9 @@
 package mhist
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,6 +12,10 @@ import (
 	"strconv"
 )
 
+const blockFileExtension = ".mhist"
+
+const csvFileExtension = ".csv"
+
 //GetSortedFileList gets the FileInfo list for data files (not the meta file)
 func GetSortedFileList() (FileInfoSlice, error) {
 	infoList := FileInfoSlice{}
@@ -19,6 +25,9 @@ func GetSortedFileList() (FileInfoSlice, error) {
 	}
 
 	for _, f := range files {
+		if !isDataFileName(f.Name()) {
+			continue
+		}
 		info, err := timestampsFromFileName(f.Name())
 		if err != nil {
 			continue
@@ -56,26 +65,76 @@ type FileInfo struct {
 //FileInfoSlice ...
 type FileInfoSlice []*FileInfo
 
-//WriteBlockToFile ...
-func WriteBlockToFile(b *Block) error {
-	return ioutil.WriteFile(filepath.Join(dataPath, fileNameFromTs(b.OldestTs(), b.LatestTs())), b.Buffer.Bytes(), os.ModePerm)
+//WriteBlockToFile and sync it to disk, together with the schema of its series from meta.
+//The block is preceded by commit, the commitFrame of the write-ahead log, which can be nil.
+//Fails if a data file with the same time range exists already
+func WriteBlockToFile(b *Block, meta *DiskMeta, commit []byte) error {
+	f, err := os.OpenFile(filepath.Join(dataPath, fileNameFromTs(b.OldestTs(), b.LatestTs())), os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(append(append(append([]byte{}, blockFileHeader...), commit...), meta.encodeSchema(b.ids)...), b.encode()...))
+	if err != nil {
+		return err
+	}
+	return f.Sync()
 }
 
-//AppendBlockToFile ...
-func AppendBlockToFile(info *FileInfo, block *Block) error {
+//AppendBlockToFile and sync it to disk, together with commit and the schema of its series from meta. The file must have the current format version
+func AppendBlockToFile(info *FileInfo, block *Block, meta *DiskMeta, commit []byte) error {
+	//the file is not sealed anymore
+	os.Remove(indexPath(info.name))
 	f, err := os.OpenFile(filepath.Join(dataPath, info.name), os.O_APPEND|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	_, err = f.Write(block.Buffer.Bytes())
+	_, err = f.Write(append(append(append([]byte{}, commit...), meta.encodeSchema(block.ids)...), block.encode()...))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
 	if err != nil {
 		return err
 	}
-	return os.Rename(filepath.Join(dataPath, info.name), filepath.Join(dataPath, fileNameFromTs(info.oldestTs, block.LatestTs())))
+	//late measurements can extend the timerange of the file in both directions
+	oldestTs, latestTs := info.oldestTs, info.latestTs
+	if block.OldestTs() < oldestTs {
+		oldestTs = block.OldestTs()
+	}
+	if block.LatestTs() > latestTs {
+		latestTs = block.LatestTs()
+	}
+	return os.Rename(filepath.Join(dataPath, info.name), filepath.Join(dataPath, fileNameFromTs(oldestTs, latestTs)))
 }
 
 func fileNameFromTs(oldestTs, latestTs int64) string {
-	return fmt.Sprintf("%v-%v.csv", oldestTs, latestTs)
+	return fmt.Sprintf("%v-%v%v", oldestTs, latestTs, blockFileExtension)
+}
+
+func isDataFileName(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == blockFileExtension || ext == csvFileExtension
+}
+
+//isCsv is true for data files written before the binary block format
+func (i *FileInfo) isCsv() bool {
+	return filepath.Ext(i.name) == csvFileExtension
+}
+
+//hasCurrentFormat is true for binary data files of the current format version, only those can be appended to
+func (i *FileInfo) hasCurrentFormat() bool {
+	if i.isCsv() {
+		return false
+	}
+	f, err := os.Open(filepath.Join(dataPath, i.name))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(blockFileHeader))
+	_, err = io.ReadFull(f, header)
+	return err == nil && bytes.Equal(header, blockFileHeader)
 }
 
 func timestampsFromFileName(name string) (info *FileInfo, err error) {
@@ -111,6 +170,59 @@ func (s FileInfoSlice) TotalSize() (size int64) {
 	return
 }
 
+//byName returns the file with name or nil
+func (s FileInfoSlice) byName(name string) *FileInfo {
+	for _, info := range s {
+		if info.name == name {
+			return info
+		}
+	}
+	return nil
+}
+
 func (i *FileInfo) isInTimeRange(start, end int64) bool {
 	return (i.latestTs > start && !(i.oldestTs > end))
 }
+
+//writeFileAtomically writes data to a temporary file next to path and renames it over path once it is synced,
+//so path either contains the old or the new content even if the process crashes in between.
+//The directory is synced after the rename, so the rename itself survives a crash as well
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := writeSyncedFile(tmpPath, data)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//writeSyncedFile writes data to path and syncs it to disk
+func writeSyncedFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
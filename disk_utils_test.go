@@ -15,3 +15,61 @@ func Test_timestampsFromFileName(t *testing.T) {
 		So(info.latestTs, ShouldEqual, 56789)
 	})
 }
+
+func Test_AppendBlockToFile(t *testing.T) {
+	Convey("names the file after the oldest and latest timestamp, even if late measurements are appended", t, func() {
+		withTempDataPath(t)
+
+		block := NewBlock()
+		block.Add(1, &Numerical{Ts: 1000})
+		block.Add(1, &Numerical{Ts: 1010})
+		So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+
+		late := NewBlock()
+		late.Add(1, &Numerical{Ts: 1005})
+		late.Add(2, &Numerical{Ts: 990})
+		files, err := GetSortedFileList()
+		So(err, ShouldBeNil)
+		So(AppendBlockToFile(files[0], late, nil, nil), ShouldBeNil)
+
+		files, err = GetSortedFileList()
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 1)
+		So(files[0].name, ShouldEqual, fileNameFromTs(990, 1010))
+	})
+}
+
+func Test_WriteBlockToFile(t *testing.T) {
+	Convey("doesn't overwrite a data file with the same time range", t, func() {
+		withTempDataPath(t)
+
+		block := NewBlock()
+		block.Add(1, &Numerical{Ts: 1000})
+		block.Add(1, &Numerical{Ts: 1010})
+		So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+		So(WriteBlockToFile(block, nil, nil), ShouldNotBeNil)
+	})
+
+	Convey("the disk store appends to a data file with the same time range instead", t, func() {
+		withTempDataPath(t)
+
+		diskStore, err := NewDiskStore(NewPools(nil), DiskStoreConfig{MaxFileSize: 1, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		defer diskStore.Shutdown()
+		write := func(timestamps ...int64) {
+			for _, ts := range timestamps {
+				diskStore.Add("temperature", &Numerical{Ts: ts, Value: 1})
+			}
+			diskStore.inListenRoutine(diskStore.commit)
+			So(diskStore.block.Len(), ShouldEqual, 0)
+		}
+		write(1000, 1010)
+		write(2000)
+		write(1000, 1010)
+
+		files, err := GetSortedFileList()
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 2)
+		So(len(diskStore.GetMeasurementsInTimeRange(0, 3000, FilterDefinition{})["temperature"]), ShouldEqual, 5)
+	})
+}
@@ -1,13 +1,87 @@
 package mhist
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
-//FilterDefinition is the definition of what measurments to forward in what intervals
+//FilterDefinition is the definition of what measurments to forward in what intervals.
+//If Aggregate is set together with a Granularity, the measurements of every granularity bucket are aggregated instead of only forwarding the first one.
+//Tags are TagMatchers, that all have to match the tags of a series
 type FilterDefinition struct {
 	Names       []string      `json:"names"`
 	Granularity time.Duration `json:"granularity"`
+	Aggregate   string        `json:"aggregate,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+}
+
+//Validate the definition
+func (d FilterDefinition) Validate() error {
+	if d.Aggregate != "" && d.Granularity <= 0 {
+		return errors.New("aggregate requires a granularity")
+	}
+	_, err := d.aggregation()
+	if err != nil {
+		return err
+	}
+	_, err = ParseTagMatchers(d.Tags)
+	return err
+}
+
+//Matches checks if the series with the provided key is allowed according to the filterDefinition.
+//Names can either contain the name of the series or the whole key
+func (d FilterDefinition) Matches(key string) bool {
+	matchers, err := ParseTagMatchers(d.Tags)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return matchesSeriesKey(d, matchers, key)
+}
+
+func matchesSeriesKey(d FilterDefinition, matchers []*TagMatcher, key string) bool {
+	name, tags := ParseSeriesKey(key)
+	if !d.IsInNames(name) && (name == key || !d.IsInNames(key)) {
+		return false
+	}
+	for _, matcher := range matchers {
+		if !matcher.Matches(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d FilterDefinition) aggregation() (*Aggregation, error) {
+	if d.Aggregate == "" || d.Granularity <= 0 {
+		return nil, nil
+	}
+	return ParseAggregation(d.Aggregate)
+}
+
+//Apply the granularity and aggregation of the definition to the measurements of a single series
+func (d FilterDefinition) Apply(measurements []Measurement) []Measurement {
+	if d.Granularity <= 0 {
+		return measurements
+	}
+	aggregation, err := d.aggregation()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if aggregation != nil {
+		return aggregateMeasurements(measurements, d.Granularity, aggregation)
+	}
+
+	filter := &TimestampFilter{Granularity: d.Granularity}
+	filtered := make([]Measurement, 0, len(measurements))
+	for _, measurement := range measurements {
+		if filter.Passes(measurement) {
+			filtered = append(filtered, measurement)
+		}
+	}
+	return filtered
 }
 
 //IsInNames checks if the provided name is allowed according to the filterDefiniton
@@ -38,23 +112,93 @@ func (f *TimestampFilter) Passes(measurement Measurement) bool {
 	return false
 }
 
-//FilterCollection is the running state of the filter
+//FilterCollection is the running state of the filter, it is safe for concurrent use
 type FilterCollection struct {
-	Definition             FilterDefinition
-	timestampFilterPerName map[string]*TimestampFilter
+	Definition              FilterDefinition
+	aggregation             *Aggregation
+	tagMatchers             []*TagMatcher
+	matchesPerKey           map[string]bool
+	timestampFilterPerName  map[string]*TimestampFilter
+	bucketAggregatorPerName map[string]*BucketAggregator
+	mutex                   sync.Mutex
 }
 
 //NewFilterCollection creates a new filterState and initializes the map
 func NewFilterCollection(definition FilterDefinition) *FilterCollection {
+	aggregation, err := definition.aggregation()
+	if err != nil {
+		fmt.Println(err)
+	}
+	tagMatchers, err := ParseTagMatchers(definition.Tags)
+	if err != nil {
+		fmt.Println(err)
+	}
 	return &FilterCollection{
-		Definition:             definition,
-		timestampFilterPerName: make(map[string]*TimestampFilter),
+		Definition:              definition,
+		aggregation:             aggregation,
+		tagMatchers:             tagMatchers,
+		matchesPerKey:           make(map[string]bool),
+		timestampFilterPerName:  make(map[string]*TimestampFilter),
+		bucketAggregatorPerName: make(map[string]*BucketAggregator),
+	}
+}
+
+//Matches checks if the series with the provided key is allowed, the result is cached per key
+func (c *FilterCollection) Matches(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.matches(key)
+}
+
+func (c *FilterCollection) matches(key string) bool {
+	matches, ok := c.matchesPerKey[key]
+	if !ok {
+		matches = matchesSeriesKey(c.Definition, c.tagMatchers, key)
+		c.matchesPerKey[key] = matches
+	}
+	return matches
+}
+
+//alias lets name match like key, i.e. the versionName of a series like its key
+func (c *FilterCollection) alias(name, key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.matchesPerKey[name] = c.matches(key)
+}
+
+//Process the measurement and return what should be forwarded, if anything.
+//With an aggregation, the aggregated measurement of a bucket is returned once the first measurement of a later bucket arrives
+func (c *FilterCollection) Process(name string, measurement Measurement) (Measurement, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.aggregation == nil {
+		return measurement, c.passes(name, measurement)
+	}
+	if !c.matches(name) {
+		return nil, false
 	}
+	if c.aggregation.numericalOnly() && measurement.Type() != MeasurementNumerical {
+		return nil, false
+	}
+
+	aggregator := c.bucketAggregatorPerName[name]
+	if aggregator == nil {
+		aggregator = &BucketAggregator{Granularity: c.Definition.Granularity, Aggregation: c.aggregation}
+		c.bucketAggregatorPerName[name] = aggregator
+	}
+	return aggregator.Add(measurement)
 }
 
 //Passes checks if this measurement passes the filter. If it does, it updates the filter accordingly (passes one time max)
 func (c *FilterCollection) Passes(name string, measurement Measurement) bool {
-	if !c.Definition.IsInNames(name) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.passes(name, measurement)
+}
+
+func (c *FilterCollection) passes(name string, measurement Measurement) bool {
+	if !c.matches(name) {
 		return false
 	}
 	if c.Definition.Granularity == 0 {
@@ -0,0 +1,535 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//quarantineDirectory holds everything fsck removed from the data directory
+var quarantineDirectory = "quarantine"
+
+var dataFileNamePattern = regexp.MustCompile(`^\d+-\d+(\.mhist|\.csv)$`)
+
+//FsckProblem found in a file of the data directory, Repair describes how it was repaired, if it was.
+//Warnings are taken care of by mhist itself
+type FsckProblem struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+	Repair  string `json:"repair,omitempty"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+//FsckReport of a check of the data directory
+type FsckReport struct {
+	CheckedFiles int           `json:"checked_files"`
+	Problems     []FsckProblem `json:"problems"`
+}
+
+//Unrepaired problems of the report, without warnings
+func (r *FsckReport) Unrepaired() int {
+	unrepaired := 0
+	for _, problem := range r.Problems {
+		if problem.Repair == "" && !problem.Warning {
+			unrepaired++
+		}
+	}
+	return unrepaired
+}
+
+//fsck checks the data directory, repairing what it can if repair is set
+type fsck struct {
+	repair      bool
+	report      *FsckReport
+	meta        *DiskMeta
+	metaChanged bool
+	deleted     tombstones
+	checked     FileInfoSlice
+}
+
+//checkedContent of a data file
+type checkedContent struct {
+	oldestTs   int64
+	latestTs   int64
+	count      int
+	unknownIDs map[int64]int
+	schema     map[int64]schemaEntry
+}
+
+//Fsck checks the data directory while mhist is not running: the meta, the names and contents of data files, indexes and rollups.
+//With repair set, unreadable data is moved to the quarantine directory, misnamed files are renamed and the meta is rebuilt or completed from the schemas of the data files
+func Fsck(repair bool) (*FsckReport, error) {
+	c := &fsck{repair: repair, report: &FsckReport{Problems: []FsckProblem{}}}
+	c.checkMeta()
+	c.deleted = c.meta.getTombstones()
+
+	entries, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	indexNames := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		switch {
+		case entry.IsDir() || name == metaFilePath || name == metaFilePath+".corrupt" || name == walFilePath || name == compactionJournalPath:
+		case ext == indexFileExtension:
+			indexNames = append(indexNames, name)
+		case ext == compactingFileExtension:
+			c.warning(name, "unfinished compaction, it is finished or dropped on the next start")
+		case ext == ".tmp":
+			c.problem(name, "leftover of an interrupted write", func() (string, error) {
+				return "removed", os.Remove(filepath.Join(dataPath, name))
+			})
+		case isDataFileName(name) && dataFileNamePattern.MatchString(name):
+			info, err := timestampsFromFileName(name)
+			if err != nil {
+				c.checkMisnamedFile(name)
+				continue
+			}
+			info.name = name
+			info.size = entry.Size()
+			c.checkDataFile(info)
+		case isDataFileName(name):
+			c.checkMisnamedFile(name)
+		default:
+			c.problem(name, "unknown file, it is ignored", nil)
+		}
+	}
+	c.checkOverlaps()
+	c.checkIndexes(indexNames)
+	c.checkRollups()
+
+	if c.metaChanged {
+		c.meta.sync()
+	}
+	return c.report, nil
+}
+
+func (c *fsck) problem(file, problem string, repair func() (string, error)) {
+	p := FsckProblem{File: file, Problem: problem}
+	if c.repair && repair != nil {
+		description, err := repair()
+		if err != nil {
+			p.Problem = fmt.Sprintf("%v, repair failed: %v", problem, err)
+		} else {
+			p.Repair = description
+		}
+	}
+	c.report.Problems = append(c.report.Problems, p)
+}
+
+func (c *fsck) warning(file, problem string) {
+	c.report.Problems = append(c.report.Problems, FsckProblem{File: file, Problem: problem, Warning: true})
+}
+
+//checkMeta loads the meta, if it is missing or corrupt it is rebuilt from the data files
+func (c *fsck) checkMeta() {
+	c.report.CheckedFiles++
+	path := filepath.Join(dataPath, metaFilePath)
+	byteSlice, err := ioutil.ReadFile(path)
+	if err == nil {
+		meta := NewDiskMeta()
+		err = json.Unmarshal(byteSlice, meta)
+		if err == nil {
+			c.meta = meta
+			return
+		}
+		err = fmt.Errorf("is corrupt: %v", err)
+	} else if os.IsNotExist(err) {
+		err = fmt.Errorf("is missing")
+	}
+
+	meta, rebuildErr := rebuildMeta()
+	if meta == nil || rebuildErr != nil {
+		meta = NewDiskMeta()
+	}
+	c.meta = meta
+	c.problem(metaFilePath, err.Error(), func() (string, error) {
+		if rebuildErr != nil {
+			return "", rebuildErr
+		}
+		if _, statErr := os.Stat(path); statErr == nil {
+			os.Rename(path, path+".corrupt")
+		}
+		meta.sync()
+		return fmt.Sprintf("rebuilt from the data files with %v series, renames and deletions that weren't written to the data files yet are lost", len(meta.NameToID)), nil
+	})
+}
+
+//checkDataFile validates the content of the data file against its name and the meta
+func (c *fsck) checkDataFile(info *FileInfo) {
+	c.report.CheckedFiles++
+	content, exists := c.checkContent(info.name)
+	if !exists {
+		return
+	}
+	if content.count == 0 {
+		c.problem(info.name, "contains no measurements", func() (string, error) {
+			return "removed", removeDataFile(info.name)
+		})
+		return
+	}
+	c.checkUnknownIDs(info.name, content)
+
+	if content.oldestTs != info.oldestTs || content.latestTs != info.latestTs {
+		newName := dataFileNameFor(info.name, content.oldestTs, content.latestTs)
+		problem := fmt.Sprintf("is named after %v to %v, but contains measurements from %v to %v", info.oldestTs, info.latestTs, content.oldestTs, content.latestTs)
+		repaired := false
+		c.problem(info.name, problem, func() (string, error) {
+			err := renameDataFile(info.name, newName)
+			repaired = err == nil
+			return "renamed to " + newName, err
+		})
+		if repaired {
+			info.name = newName
+		}
+	}
+	info.oldestTs, info.latestTs = content.oldestTs, content.latestTs
+	c.checked = append(c.checked, info)
+}
+
+//checkMisnamedFile that GetSortedFileList skips, because its name doesn't describe its time range
+func (c *fsck) checkMisnamedFile(name string) {
+	c.report.CheckedFiles++
+	content, exists := c.checkContent(name)
+	if !exists {
+		return
+	}
+	problem := "is ignored, because its name doesn't describe its time range"
+	if content.count == 0 {
+		c.problem(name, problem, func() (string, error) {
+			return quarantineFile(name)
+		})
+		return
+	}
+	c.checkUnknownIDs(name, content)
+	newName := dataFileNameFor(name, content.oldestTs, content.latestTs)
+	c.problem(name, problem, func() (string, error) {
+		return "renamed to " + newName, renameDataFile(name, newName)
+	})
+}
+
+//checkContent of the data file, unreadable parts are quarantined on repair. exists is false if nothing of the file is left to check
+func (c *fsck) checkContent(name string) (content *checkedContent, exists bool) {
+	content = &checkedContent{unknownIDs: map[int64]int{}, schema: map[int64]schemaEntry{}}
+	isFirst := true
+	add := func(id int64, m Measurement) {
+		ts := m.Timestamp()
+		if isFirst || ts < content.oldestTs {
+			content.oldestTs = ts
+		}
+		if isFirst || ts > content.latestTs {
+			content.latestTs = ts
+		}
+		isFirst = false
+		content.count++
+		if c.meta.GetNameForID(id) == "" && !c.deleted.covers(id, ts) {
+			content.unknownIDs[id]++
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, name))
+	if err != nil {
+		c.problem(name, err.Error(), nil)
+		return content, false
+	}
+	if filepath.Ext(name) == csvFileExtension {
+		c.checkCsvContent(name, data, add)
+		return content, true
+	}
+
+	validEnd, err := scanBlockData(data, func(kind byte, payload []byte) error {
+		if kind == schemaFrame {
+			return decodeSchema(payload, func(entry schemaEntry) {
+				content.schema[entry.id] = entry
+			})
+		}
+		if kind != dataFrame {
+			return nil
+		}
+		return decodeBlock(payload, nil, add)
+	})
+	if validEnd == 0 {
+		c.problem(name, fmt.Sprintf("is unreadable: %v", err), func() (string, error) {
+			return quarantineFile(name)
+		})
+		return content, false
+	}
+	if err != nil {
+		problem := fmt.Sprintf("is unreadable from byte %v on (%v), %v bytes are lost", validEnd, err, len(data)-validEnd)
+		c.problem(name, problem, func() (string, error) {
+			quarantined, err := quarantine(name, data[validEnd:])
+			if err != nil {
+				return "", err
+			}
+			os.Remove(indexPath(name))
+			return "truncated, the unreadable bytes were moved to " + quarantined, writeFileAtomically(filepath.Join(dataPath, name), data[:validEnd])
+		})
+	}
+	return content, true
+}
+
+//checkCsvContent calls add for every readable record of a csv data file, the unreadable ones are quarantined on repair
+func (c *fsck) checkCsvContent(name string, data []byte, add func(id int64, m Measurement)) {
+	kept := []byte{}
+	unreadable := []byte{}
+	unreadableLines := 0
+	readCsvRecords(data, func(fields []string, raw []byte, err error) {
+		var id int64
+		var m Measurement
+		if err == nil {
+			id, m, err = c.parseCsvRecord(fields)
+		}
+		if err != nil {
+			unreadableLines++
+			unreadable = append(unreadable, raw...)
+			return
+		}
+		kept = append(kept, raw...)
+		add(id, m)
+	})
+	if unreadableLines == 0 {
+		return
+	}
+	c.problem(name, fmt.Sprintf("has %v unreadable lines", unreadableLines), func() (string, error) {
+		quarantined, err := quarantine(name, unreadable)
+		if err != nil {
+			return "", err
+		}
+		return "the unreadable lines were moved to " + quarantined, writeFileAtomically(filepath.Join(dataPath, name), kept)
+	})
+}
+
+//parseCsvRecord of a csv data file
+func (c *fsck) parseCsvRecord(fields []string) (id int64, m Measurement, err error) {
+	if len(fields) != 3 {
+		return 0, nil, fmt.Errorf("expected 3 fields but got %v", len(fields))
+	}
+	id, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch c.meta.GetTypeForID(id) {
+	case MeasurementNumerical:
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		return id, &Numerical{Ts: ts, Value: value}, nil
+	default:
+		//the value of an unknown series can't be checked, but its timestamp still counts for the time range of the file
+		return id, &Categorical{Ts: ts, Value: fields[2]}, nil
+	}
+}
+
+//checkUnknownIDs of the data file, they are added to the meta from the schema of the file on repair
+func (c *fsck) checkUnknownIDs(name string, content *checkedContent) {
+	if len(content.unknownIDs) == 0 {
+		return
+	}
+	ids := []int64{}
+	count := 0
+	for id, idCount := range content.unknownIDs {
+		ids = append(ids, id)
+		count += idCount
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	repair := func() (string, error) {
+		keys := []string{}
+		for _, id := range ids {
+			entry, ok := content.schema[id]
+			if !ok {
+				return "", fmt.Errorf("the file has no schema for id %v", id)
+			}
+			keys = append(keys, entry.key)
+		}
+		c.meta.Lock()
+		for i, id := range ids {
+			entry := content.schema[id]
+			c.meta.IDToName[id] = keys[i]
+			c.meta.IDToType[id] = entry.measurementType
+			if c.meta.NameToID[keys[i]] == 0 {
+				c.meta.NameToID[keys[i]] = id
+			}
+			if id > c.meta.HighestID {
+				c.meta.HighestID = id
+			}
+		}
+		c.meta.Unlock()
+		c.metaChanged = true
+		return "added " + strings.Join(keys, ", ") + " to the meta", nil
+	}
+	c.problem(name, fmt.Sprintf("has %v measurements of unknown series ids %v", count, ids), repair)
+}
+
+//checkOverlaps of the checked data files
+func (c *fsck) checkOverlaps() {
+	sort.SliceStable(c.checked, func(i, j int) bool {
+		return c.checked[i].oldestTs < c.checked[j].oldestTs
+	})
+	var latest *FileInfo
+	for _, file := range c.checked {
+		if latest != nil && file.oldestTs <= latest.latestTs {
+			c.warning(file.name, fmt.Sprintf("overlaps %v, both are merged by the next compaction", latest.name))
+		}
+		if latest == nil || file.latestTs > latest.latestTs {
+			latest = file
+		}
+	}
+}
+
+//checkIndexes for data files that don't exist anymore or that changed since they were indexed.
+//Removed indexes are rebuilt by the next maintenance run
+func (c *fsck) checkIndexes(names []string) {
+	for _, name := range names {
+		c.report.CheckedFiles++
+		dataFileName := strings.TrimSuffix(name, indexFileExtension)
+		remove := func() (string, error) {
+			return "removed", os.Remove(filepath.Join(dataPath, name))
+		}
+		info, err := os.Stat(filepath.Join(dataPath, dataFileName))
+		if err != nil {
+			c.problem(name, "belongs to no data file", remove)
+			continue
+		}
+		_, err = readIndex(&FileInfo{name: dataFileName, size: info.Size()})
+		if err != nil {
+			c.problem(name, fmt.Sprintf("is invalid: %v", err), remove)
+		}
+	}
+}
+
+//checkRollups for unreadable and ignored rollup files
+func (c *fsck) checkRollups() {
+	entries, err := ioutil.ReadDir(filepath.Join(dataPath, rollupDirectory))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := filepath.Join(rollupDirectory, entry.Name())
+		if entry.IsDir() {
+			continue
+		}
+		c.report.CheckedFiles++
+		//rollups of csv files keep the extension of their data file
+		dataFileName := strings.TrimSuffix(entry.Name(), rollupFileExtension)
+		if filepath.Ext(dataFileName) != csvFileExtension {
+			dataFileName += blockFileExtension
+		}
+		if filepath.Ext(name) != rollupFileExtension || !dataFileNamePattern.MatchString(dataFileName) {
+			c.problem(name, "unknown file, it is ignored", nil)
+			continue
+		}
+		file, err := os.Open(filepath.Join(dataPath, name))
+		if err != nil {
+			c.problem(name, err.Error(), nil)
+			continue
+		}
+		err = readRollupFile(file, func(id int64, series *rollupSeries) {})
+		file.Close()
+		if err != nil {
+			c.problem(name, fmt.Sprintf("is unreadable: %v", err), func() (string, error) {
+				return quarantineFile(name)
+			})
+		}
+	}
+}
+
+//scanBlockData calls f for every frame of a binary data file and returns the end of the last readable frame, which is 0 if the header is unreadable
+func scanBlockData(data []byte, f func(kind byte, payload []byte) error) (validEnd int, err error) {
+	if !bytes.HasPrefix(data, []byte(blockFileMagic)) || len(data) < len(blockFileHeader) {
+		return 0, fmt.Errorf("not a binary data file")
+	}
+	version := data[len(blockFileMagic)]
+	if version > blockFormatVersion {
+		return 0, fmt.Errorf("unsupported block format version %v", version)
+	}
+	position := len(blockFileHeader)
+	for position < len(data) {
+		payloadLength, n := binary.Uvarint(data[position:])
+		if n <= 0 || payloadLength > uint64(len(data)-position-n) {
+			return position, errCorruptBlock
+		}
+		payloadEnd := position + n + int(payloadLength)
+		if payloadEnd+4 > len(data) {
+			return position, errCorruptBlock
+		}
+		payload := data[position+n : payloadEnd]
+		if binary.BigEndian.Uint32(data[payloadEnd:payloadEnd+4]) != crc32.ChecksumIEEE(payload) {
+			return position, errCorruptBlock
+		}
+		kind := dataFrame
+		if version >= frameKindsVersion {
+			if len(payload) == 0 {
+				return position, errCorruptBlock
+			}
+			kind, payload = payload[0], payload[1:]
+		}
+		err := f(kind, payload)
+		if err != nil {
+			return position, err
+		}
+		position = payloadEnd + 4
+	}
+	return position, nil
+}
+
+//dataFileNameFor the time range, with the extension of name
+func dataFileNameFor(name string, oldestTs, latestTs int64) string {
+	return fmt.Sprintf("%v-%v%v", oldestTs, latestTs, filepath.Ext(name))
+}
+
+//renameDataFile without overwriting another one, its index is removed
+func renameDataFile(name, newName string) error {
+	if _, err := os.Stat(filepath.Join(dataPath, newName)); err == nil {
+		return fmt.Errorf("%v already exists", newName)
+	}
+	os.Remove(indexPath(name))
+	return os.Rename(filepath.Join(dataPath, name), filepath.Join(dataPath, newName))
+}
+
+//quarantine data of the file, returns the path of the quarantined data relative to dataPath
+func quarantine(name string, data []byte) (string, error) {
+	err := os.MkdirAll(filepath.Join(dataPath, quarantineDirectory), 0700)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(quarantineDirectory, filepath.Base(name))
+	path := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(dataPath, path)); os.IsNotExist(err) {
+			break
+		}
+		path = fmt.Sprintf("%v.%v", base, i)
+	}
+	return path, writeSyncedFile(filepath.Join(dataPath, path), data)
+}
+
+//quarantineFile moves the whole file into the quarantine directory
+func quarantineFile(name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, name))
+	if err != nil {
+		return "", err
+	}
+	quarantined, err := quarantine(name, data)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(indexPath(name))
+	return "moved to " + quarantined, os.Remove(filepath.Join(dataPath, name))
+}
@@ -0,0 +1,142 @@
+package mhist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Fsck(t *testing.T) {
+	Convey("Fsck", t, func() {
+		dir := withTempDataPath(t)
+
+		config := DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024}
+		diskStore, err := NewDiskStore(NewPools(nil), config)
+		So(err, ShouldBeNil)
+		for ts := int64(1000); ts < 1100; ts += 10 {
+			diskStore.Add("temperature", &Numerical{Ts: ts, Value: float64(ts)})
+			diskStore.Add("status", &Categorical{Ts: ts, Value: "on"})
+		}
+		diskStore.Shutdown()
+		name := fileNameFromTs(1000, 1090)
+		path := filepath.Join(dir, name)
+
+		read := func() map[string][]Measurement {
+			diskStore, err := NewDiskStore(NewPools(nil), config)
+			So(err, ShouldBeNil)
+			defer diskStore.Shutdown()
+			return diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{})
+		}
+		problems := func(report *FsckReport) []string {
+			problems := []string{}
+			for _, problem := range report.Problems {
+				problems = append(problems, problem.File+" "+problem.Problem)
+			}
+			return problems
+		}
+		expected := read()
+		So(expected["temperature"], ShouldHaveLength, 10)
+
+		Convey("finds nothing in a healthy data directory", func() {
+			report, err := Fsck(false)
+			So(err, ShouldBeNil)
+			So(report.Problems, ShouldBeEmpty)
+			So(report.CheckedFiles, ShouldEqual, 2)
+		})
+
+		Convey("only reports problems without repair", func() {
+			So(os.Rename(path, filepath.Join(dir, "backup.mhist")), ShouldBeNil)
+			report, err := Fsck(false)
+			So(err, ShouldBeNil)
+			So(problems(report), ShouldResemble, []string{"backup.mhist is ignored, because its name doesn't describe its time range"})
+			So(report.Unrepaired(), ShouldEqual, 1)
+			_, err = os.Stat(filepath.Join(dir, "backup.mhist"))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("renames files that are ignored or named after the wrong time range", func() {
+			So(os.Rename(path, filepath.Join(dir, "1-2.mhist")), ShouldBeNil)
+			report, err := Fsck(true)
+			So(err, ShouldBeNil)
+			So(problems(report), ShouldResemble, []string{"1-2.mhist is named after 1 to 2, but contains measurements from 1000 to 1090"})
+			So(report.Unrepaired(), ShouldEqual, 0)
+			So(read(), ShouldResemble, expected)
+
+			So(os.Rename(path, filepath.Join(dir, "backup.mhist")), ShouldBeNil)
+			report, err = Fsck(true)
+			So(err, ShouldBeNil)
+			So(report.Unrepaired(), ShouldEqual, 0)
+			So(read(), ShouldResemble, expected)
+		})
+
+		Convey("quarantines unreadable data", func() {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			So(err, ShouldBeNil)
+			f.Write([]byte("garbage"))
+			f.Close()
+			So(ioutil.WriteFile(filepath.Join(dir, "2000-2020.csv"), []byte("1,2000,1\n1,2010,\"broken\n1,2020,3\n"), 0600), ShouldBeNil)
+
+			report, err := Fsck(true)
+			So(err, ShouldBeNil)
+			So(len(report.Problems), ShouldEqual, 2)
+			So(report.Problems[0].Problem, ShouldStartWith, "is unreadable from byte")
+			So(report.Problems[1].Problem, ShouldEqual, "has 1 unreadable lines")
+			So(report.Unrepaired(), ShouldEqual, 0)
+
+			quarantined, err := ioutil.ReadFile(filepath.Join(dir, quarantineDirectory, name))
+			So(err, ShouldBeNil)
+			So(string(quarantined), ShouldEqual, "garbage")
+			quarantined, err = ioutil.ReadFile(filepath.Join(dir, quarantineDirectory, "2000-2020.csv"))
+			So(err, ShouldBeNil)
+			So(string(quarantined), ShouldEqual, "1,2010,\"broken\n")
+			So(read()["temperature"], ShouldHaveLength, 12)
+		})
+
+		Convey("completes the meta from the schemas of the data files", func() {
+			meta := InitMetaFromDisk()
+			id := meta.NameToID["status"]
+			delete(meta.NameToID, "status")
+			delete(meta.IDToName, id)
+			delete(meta.IDToType, id)
+			meta.sync()
+
+			report, err := Fsck(true)
+			So(err, ShouldBeNil)
+			So(problems(report), ShouldResemble, []string{name + " has 10 measurements of unknown series ids [2]"})
+			So(report.Problems[0].Repair, ShouldEqual, "added status to the meta")
+			So(read(), ShouldResemble, expected)
+		})
+
+		Convey("rebuilds a missing meta", func() {
+			So(os.Remove(filepath.Join(dir, metaFilePath)), ShouldBeNil)
+			report, err := Fsck(true)
+			So(err, ShouldBeNil)
+			So(problems(report), ShouldResemble, []string{"meta.json is missing"})
+			So(report.Unrepaired(), ShouldEqual, 0)
+			So(read(), ShouldResemble, expected)
+		})
+
+		Convey("removes leftovers and warns about overlapping files", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, "1-2.mhist.idx"), []byte{}, 0600), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "meta.json.tmp"), []byte{}, 0600), ShouldBeNil)
+			block := NewBlock()
+			block.Add(1, &Numerical{Ts: 1050, Value: 1})
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+
+			report, err := Fsck(true)
+			So(err, ShouldBeNil)
+			So(strings.Join(problems(report), "\n"), ShouldEqual, strings.Join([]string{
+				"meta.json.tmp leftover of an interrupted write",
+				"1050-1050.mhist overlaps " + name + ", both are merged by the next compaction",
+				"1-2.mhist.idx belongs to no data file",
+			}, "\n"))
+			So(report.Unrepaired(), ShouldEqual, 0)
+			_, err = os.Stat(filepath.Join(dir, "1-2.mhist.idx"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
@@ -1,7 +1,10 @@
 module github.com/codeuniversity/ppp-mhist
 
+go 1.27.1
+
 require (
 	github.com/jtolds/gls v4.2.1+incompatible
-	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
 	github.com/smartystreets/goconvey v0.0.0-20170602164621-9e8dc3f972df
 )
+
+require github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
@@ -0,0 +1,22 @@
+package mhist
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//withTempDataPath points dataPath to a new temporary directory until the test is finished, the directory is removed afterwards
+func withTempDataPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mhist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultDataPath := dataPath
+	dataPath = dir
+	t.Cleanup(func() {
+		dataPath = defaultDataPath
+		os.RemoveAll(dir)
+	})
+	return dir
+}
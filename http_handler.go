@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -21,6 +23,12 @@ type HTTPHandler struct {
 //Run the handler
 func (h *HTTPHandler) Run() {
 	http.HandleFunc("/meta", h.serveStoredMeta)
+	http.HandleFunc("/replication", h.serveReplicationStatus)
+	http.HandleFunc("/retention", h.serveRetention)
+	http.HandleFunc("/schema", h.serveSchema)
+	http.HandleFunc("/rename", h.serveRename)
+	http.HandleFunc("/import", h.serveImport)
+	http.HandleFunc("/snapshot", h.serveSnapshot)
 	http.Handle("/", h)
 	err := http.ListenAndServe(fmt.Sprintf(":%v", h.Port), nil)
 	if err != nil {
@@ -40,6 +48,8 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handlePost(w, r)
 	case http.MethodGet:
 		h.handleGet(w, r)
+	case http.MethodDelete:
+		h.handleDelete(w, r)
 	}
 }
 
@@ -61,15 +71,271 @@ func (h *HTTPHandler) serveStoredMeta(w http.ResponseWriter, r *http.Request) {
 	w.Write(byteSlice)
 }
 
+func (h *HTTPHandler) serveReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	byteSlice, err := json.Marshal(h.Server.replicationStatus())
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(byteSlice)
+}
+
+func (h *HTTPHandler) serveRetention(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	diskStore := h.Server.store.diskStore
+	if diskStore == nil {
+		renderError(errors.New("no disk store configured"), w, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		rule := RetentionRule{}
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+		err = diskStore.SetRetentionRule(rule)
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		pattern := r.URL.Query().Get("pattern")
+		if !diskStore.RemoveRetentionRule(pattern) {
+			renderError(fmt.Errorf("no retention rule with pattern '%v'", pattern), w, http.StatusNotFound)
+			return
+		}
+	}
+
+	byteSlice, err := json.Marshal(diskStore.GetRetentionRules())
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(byteSlice)
+}
+
+func (h *HTTPHandler) serveSchema(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	diskStore := h.Server.store.diskStore
+	if diskStore == nil {
+		renderError(errors.New("no disk store configured"), w, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		rule := SchemaRule{}
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+		err = diskStore.SetSchemaRule(rule)
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		pattern := r.URL.Query().Get("pattern")
+		if !diskStore.RemoveSchemaRule(pattern) {
+			renderError(fmt.Errorf("no schema rule with pattern '%v'", pattern), w, http.StatusNotFound)
+			return
+		}
+	}
+
+	byteSlice, err := json.Marshal(diskStore.GetSchemaRules())
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(byteSlice)
+}
+
+type renameResponse struct {
+	Rename
+	Merged bool `json:"merged"`
+}
+
+func (h *HTTPHandler) serveRename(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	if r.Method != http.MethodPost {
+		renderError(errors.New("only POST is supported"), w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	rename := Rename{}
+	err := json.NewDecoder(r.Body).Decode(&rename)
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
+	merged, err := h.Server.store.Rename(rename, false)
+	if err == errSeriesNotFound {
+		renderError(fmt.Errorf("series '%v' doesn't exist", rename.From), w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
+	rename.normalize()
+	byteSlice, err := json.Marshal(&renameResponse{Rename: rename, Merged: merged})
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.Write(byteSlice)
+}
+
+//serveImport writes the posted NDJSON or CSV directly to disk, ?format=csv or a text/csv Content-Type selects CSV and ?replicate=false skips replication
+func (h *HTTPHandler) serveImport(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	if r.Method != http.MethodPost {
+		renderError(errors.New("only POST is supported"), w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	format := ImportNDJSON
+	if params.Get("format") != "" {
+		parsed, err := ParseImportFormat(params.Get("format"))
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+		format = parsed
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		format = ImportCSV
+	}
+	replicate := true
+	if params.Get("replicate") != "" {
+		parsed, err := strconv.ParseBool(params.Get("replicate"))
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+		replicate = parsed
+	}
+
+	response, err := h.Server.Import(r.Body, format, replicate)
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	if response.Imported == 0 && len(response.Errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(data)
+}
+
+//serveSnapshot streams a consistent archive of the data directory on GET.
+//POST the manifest of an earlier archive to get an incremental one, that only includes the files changed since then
+func (h *HTTPHandler) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(r)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		renderError(errors.New("only GET and POST are supported"), w, http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Server.store.diskStore == nil {
+		renderError(errors.New("there is no disk store to snapshot"), w, http.StatusNotFound)
+		return
+	}
+	var previous *ArchiveManifest
+	if r.Method == http.MethodPost {
+		previous = &ArchiveManifest{}
+		err := json.NewDecoder(r.Body).Decode(previous)
+		if err == nil && previous.CreatedAt == 0 {
+			err = errors.New("the manifest of the earlier archive has no created_at")
+		}
+		if err != nil {
+			renderError(err, w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	archive, err := h.Server.store.diskStore.archive(previous)
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	defer archive.release()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=mhist-%v.tar.gz", archive.manifest.CreatedAt))
+	err = archive.write(w)
+	if err != nil {
+		//the response has started already, the client sees a truncated archive
+		fmt.Println(err)
+	}
+}
+
 func (h *HTTPHandler) handlePost(w http.ResponseWriter, r *http.Request) {
 	byteSlice, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		renderError(err, w, http.StatusBadRequest)
 		return
 	}
-	h.Server.handleNewMessage(byteSlice, false, func(err error, status int) {
-		renderError(err, w, status)
-	})
+	if !isBatch(byteSlice) {
+		h.Server.handleNewMessage(byteSlice, false, func(err error, status int) {
+			renderError(err, w, status)
+		})
+		return
+	}
+
+	response, err := h.Server.handleNewMessages(byteSlice, false)
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		renderError(err, w, http.StatusInternalServerError)
+		return
+	}
+	if response.Accepted == 0 && len(response.Errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(data)
 }
 
 type getParams struct {
@@ -89,14 +355,150 @@ func (h *HTTPHandler) handleGet(w http.ResponseWriter, r *http.Request) {
 		renderError(err, w, http.StatusBadRequest)
 		return
 	}
+	err = h.Server.store.validateAggregation(params.filterDefinition)
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
 
-	responseMap := h.Server.store.GetMeasurementsInTimeRange(params.startTs, params.endTs, params.filterDefinition)
-	data, err := json.Marshal(responseMap)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := newSeriesStreamEncoder(w)
+	err = h.Server.store.StreamMeasurementsInTimeRange(params.startTs, params.endTs, params.filterDefinition, encoder.write)
+	if err == nil {
+		err = encoder.close()
+	}
+	if err != nil {
+		//the status was already sent, the client notices the incomplete json
+		fmt.Println(err)
+	}
+}
+
+//seriesStreamEncoder writes streamed series as a json object of measurement lists per name, i.e. {"a":[...],"b":[...]}.
+//Every chunk is flushed right away, so the response is sent chunked and never kept in memory as a whole
+type seriesStreamEncoder struct {
+	w           io.Writer
+	flusher     http.Flusher
+	currentName string
+	started     bool
+	inSeries    bool
+	hasElements bool
+	buffer      []byte
+}
+
+func newSeriesStreamEncoder(w io.Writer) *seriesStreamEncoder {
+	flusher, _ := w.(http.Flusher)
+	return &seriesStreamEncoder{w: w, flusher: flusher}
+}
+
+//write a chunk of measurements of the series name, all chunks of a series have to be written one after another
+func (e *seriesStreamEncoder) write(name string, measurements []Measurement) error {
+	e.buffer = e.buffer[:0]
+	if !e.started {
+		e.buffer = append(e.buffer, '{')
+		e.started = true
+	}
+	if !e.inSeries || name != e.currentName {
+		if e.inSeries {
+			e.buffer = append(e.buffer, "],"...)
+		}
+		nameBytes, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		e.buffer = append(e.buffer, nameBytes...)
+		e.buffer = append(e.buffer, ":["...)
+		e.currentName = name
+		e.inSeries = true
+		e.hasElements = false
+	}
+
+	for _, m := range measurements {
+		if e.hasElements {
+			e.buffer = append(e.buffer, ',')
+		}
+		e.hasElements = true
+		byteSlice, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		e.buffer = append(e.buffer, byteSlice...)
+	}
+	return e.flush()
+}
+
+//close the json object
+func (e *seriesStreamEncoder) close() error {
+	e.buffer = e.buffer[:0]
+	if !e.started {
+		e.buffer = append(e.buffer, '{')
+	}
+	if e.inSeries {
+		e.buffer = append(e.buffer, ']')
+	}
+	e.buffer = append(e.buffer, '}')
+	return e.flush()
+}
+
+func (e *seriesStreamEncoder) flush() error {
+	_, err := e.w.Write(e.buffer)
+	if err == nil && e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return err
+}
+
+type deleteResponse struct {
+	Deleted []string `json:"deleted"`
+}
+
+//handleDelete deletes the series matching names and tags completely, or only their measurements from start to end if either is given
+func (h *HTTPHandler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("names") == "" {
+		renderError(errors.New("names are required for deleting"), w, http.StatusBadRequest)
+		return
+	}
+	filterDefinition := FilterDefinition{Names: strings.Split(query.Get("names"), ",")}
+	tags, err := parseTagsParam(query)
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
+	filterDefinition.Tags = tags
+
+	deletion := Deletion{Start: math.MinInt64, End: math.MaxInt64}
+	startParam := query.Get("start")
+	endParam := query.Get("end")
+	deletion.WholeSeries = startParam == "" && endParam == ""
+	if startParam != "" {
+		deletion.Start, err = strconv.ParseInt(startParam, 10, 64)
+	}
+	if err == nil && endParam != "" {
+		deletion.End, err = strconv.ParseInt(endParam, 10, 64)
+	}
+	if err == nil && deletion.Start > deletion.End {
+		err = errors.New("start can't be bigger than end")
+	}
+	if err != nil {
+		renderError(err, w, http.StatusBadRequest)
+		return
+	}
+
+	keys := h.Server.store.matchingSeriesKeys(filterDefinition)
+	if len(keys) == 0 {
+		renderError(errors.New("no series matches"), w, http.StatusNotFound)
+		return
+	}
+	for _, key := range keys {
+		deletion.Name, deletion.Tags = ParseSeriesKey(key)
+		h.Server.store.Delete(deletion, false)
+	}
+	byteSlice, err := json.Marshal(&deleteResponse{Deleted: keys})
 	if err != nil {
 		renderError(err, w, http.StatusInternalServerError)
 		return
 	}
-	w.Write(data)
+	w.Write(byteSlice)
 }
 
 func parseParams(params url.Values) (p *getParams, err error) {
@@ -105,6 +507,7 @@ func parseParams(params url.Values) (p *getParams, err error) {
 	endTsParam := params.Get("end")
 	granularityParam := params.Get("granularity")
 	namesParam := params.Get("names")
+	aggregateParam := params.Get("aggregate")
 	if endTsParam == "" {
 		p.endTs = time.Now().UnixNano()
 	} else {
@@ -131,9 +534,37 @@ func parseParams(params url.Values) (p *getParams, err error) {
 		names := strings.Split(namesParam, ",")
 		p.filterDefinition.Names = names
 	}
+
+	p.filterDefinition.Tags, err = parseTagsParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if aggregateParam != "" {
+		p.filterDefinition.Aggregate = aggregateParam
+		if err := p.filterDefinition.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	return
 }
 
+//parseTagsParam returns the tag matchers of the repeated tags query param, i.e. ?tags=room=kitchen&tags=floor=~1|2.
+//They aren't split on commas, so regular expressions and values can contain them
+func parseTagsParam(params url.Values) ([]string, error) {
+	var tags []string
+	for _, tag := range params["tags"] {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	_, err := ParseTagMatchers(tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
 type errorResponse struct {
 	Error string `json:"error"`
 }
@@ -0,0 +1,417 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+//importBatchSize is the amount of measurements that are sorted and written to data files at once
+var importBatchSize = 100000
+
+//importReplicationSize is the maximum amount of measurements per replicated import message
+const importReplicationSize = 1000
+
+const maxImportErrors = 100
+
+const maxImportLineSize = 1024 * 1024
+
+//ImportFormat of the data that is imported
+type ImportFormat string
+
+const (
+	//ImportNDJSON are newline delimited messages, like they are posted to mhist, with explicit timestamps
+	ImportNDJSON ImportFormat = "ndjson"
+	//ImportCSV are lines of `<series key>,<timestamp>,<value>`, i.e. `temperature{room=kitchen},1546300800000000000,21.5`. A header line is skipped
+	ImportCSV ImportFormat = "csv"
+)
+
+//ParseImportFormat from its name
+func ParseImportFormat(s string) (ImportFormat, error) {
+	switch ImportFormat(s) {
+	case ImportNDJSON, ImportCSV:
+		return ImportFormat(s), nil
+	}
+	return "", fmt.Errorf("unknown import format '%v', use ndjson or csv", s)
+}
+
+//importResponse reports how many measurements were imported and why the others were rejected, only the first maxImportErrors errors are listed
+type importResponse struct {
+	Imported int         `json:"imported"`
+	Rejected int         `json:"rejected"`
+	Errors   []itemError `json:"errors"`
+}
+
+type importedMeasurement struct {
+	key         string
+	id          int64
+	measurement Measurement
+}
+
+//importMessage is how imports are replicated: {"import": [...messages]}
+type importMessage struct {
+	Import []*Message `json:"import"`
+}
+
+var importMessagePrefix = []byte(`{"import":`)
+
+func isImportMessage(byteSlice []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(byteSlice), importMessagePrefix)
+}
+
+//importSubscriber is a Subscriber that also has to know about imported measurements, i.e. to replicate them
+type importSubscriber interface {
+	notifyImport(batch []importedMeasurement)
+}
+
+//Import measurements with explicit timestamps from r. They are written directly into data files, so they neither pass the memory store nor the subscribers.
+//If replicate is set, they are imported by the replication targets as well. Importing stops at the first batch that can't be written, the error tells how many measurements were imported before
+func (s *Server) Import(r io.Reader, format ImportFormat, replicate bool) (*importResponse, error) {
+	if s.store.diskStore == nil {
+		return nil, errors.New("importing requires a disk store")
+	}
+	response := &importResponse{Errors: []itemError{}}
+	batch := make([]importedMeasurement, 0, importBatchSize)
+	flush := func() error {
+		err := s.store.Import(batch, replicate)
+		if err == nil {
+			response.Imported += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+	add := func(index int, imported importedMeasurement, err error) error {
+		if err != nil {
+			response.Rejected++
+			if len(response.Errors) < maxImportErrors {
+				response.Errors = append(response.Errors, itemError{Index: index, Error: err.Error()})
+			}
+			return nil
+		}
+		batch = append(batch, imported)
+		if len(batch) >= importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	var err error
+	switch format {
+	case ImportCSV:
+		err = s.readCsvImport(r, add)
+	default:
+		err = s.readNDJSONImport(r, add)
+	}
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return response, fmt.Errorf("import stopped after %v measurements: %v", response.Imported, err)
+	}
+	return response, nil
+}
+
+func (s *Server) readNDJSONImport(r io.Reader, add func(index int, imported importedMeasurement, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	index := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		message := &Message{}
+		imported, err := importedMeasurement{}, json.Unmarshal(line, message)
+		if err == nil {
+			imported, err = s.importedMeasurementFromMessage(message)
+		}
+		err = add(index, imported, err)
+		if err != nil {
+			return err
+		}
+		index++
+	}
+	return scanner.Err()
+}
+
+func (s *Server) readCsvImport(r io.Reader, add func(index int, imported importedMeasurement, err error) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for index := 0; ; index++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			err = add(index, importedMeasurement{}, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) != 3 {
+			err = add(index, importedMeasurement{}, fmt.Errorf("expected 3 fields but got %v", len(record)))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		ts, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			if index == 0 {
+				//header
+				continue
+			}
+			err = add(index, importedMeasurement{}, fmt.Errorf("invalid timestamp '%v'", record[1]))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		message := &Message{Timestamp: ts}
+		message.SetSeriesKey(record[0])
+		message.Value = record[2]
+		//values are numerical, unless the series is already known to be categorical
+		if value, err := strconv.ParseFloat(record[2], 64); err == nil && !s.isCategorical(message.SeriesKey()) {
+			message.Value = value
+		}
+		imported, err := s.importedMeasurementFromMessage(message)
+		err = add(index, imported, err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//isCategorical if the series is known to be categorical
+func (s *Server) isCategorical(key string) bool {
+	meta := s.store.diskStore.meta
+	meta.RLock()
+	id := meta.NameToID[key]
+	meta.RUnlock()
+	return id != 0 && meta.GetTypeForID(id) == MeasurementCategorical
+}
+
+func (s *Server) importedMeasurementFromMessage(message *Message) (importedMeasurement, error) {
+	err := message.validate()
+	if err != nil {
+		return importedMeasurement{}, err
+	}
+	if message.Timestamp == 0 {
+		return importedMeasurement{}, errors.New("imported measurements need a timestamp")
+	}
+	var measurement Measurement
+	switch value := message.Value.(type) {
+	case float64:
+		measurement = &Numerical{Ts: message.Timestamp, Value: value}
+	case string:
+		measurement = &Categorical{Ts: message.Timestamp, Value: value}
+	default:
+		return importedMeasurement{}, errors.New("value is neither a float nor a string")
+	}
+	key := message.SeriesKey()
+	id, err := s.store.diskStore.meta.GetOrCreateID(key, measurement.Type())
+	if err != nil {
+		return importedMeasurement{}, err
+	}
+	return importedMeasurement{key: key, id: id, measurement: measurement}, nil
+}
+
+//notStoredError is returned for replicated measurements that couldn't be written, sending them again can succeed
+type notStoredError struct {
+	err error
+}
+
+func (e *notStoredError) Error() string {
+	return e.err.Error()
+}
+
+//handleImportMessage imports the valid measurements of the message, rejected ones are reported in the returned error
+func (s *Server) handleImportMessage(byteSlice []byte, isReplication bool) error {
+	if s.store.diskStore == nil {
+		return errors.New("importing requires a disk store")
+	}
+	message := &importMessage{}
+	err := json.Unmarshal(byteSlice, message)
+	if err != nil {
+		return err
+	}
+	batch := make([]importedMeasurement, 0, len(message.Import))
+	rejected := 0
+	var rejection error
+	for _, m := range message.Import {
+		imported, err := s.importedMeasurementFromMessage(m)
+		if err != nil {
+			if rejected == 0 {
+				rejection = err
+			}
+			rejected++
+			continue
+		}
+		batch = append(batch, imported)
+	}
+	err = s.store.Import(batch, !isReplication)
+	if err != nil {
+		return &notStoredError{err: err}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("rejected %v of %v imported measurements, the first one because: %v", rejected, len(message.Import), rejection)
+	}
+	return nil
+}
+
+//Import the batch into data files. Series in memory don't cover the imported timerange anymore, so it is read from disk.
+//The batch is replicated if replicate is set
+func (s *Store) Import(batch []importedMeasurement, replicate bool) error {
+	err := s.diskStore.importMeasurements(batch)
+	if err != nil {
+		return err
+	}
+	latestTsPerKey := map[string]int64{}
+	for _, imported := range batch {
+		if ts := imported.measurement.Timestamp(); ts > latestTsPerKey[imported.key] {
+			latestTsPerKey[imported.key] = ts
+		}
+	}
+	for key, latestTs := range latestTsPerKey {
+		if series := s.loadSeries(key); series != nil {
+			series.uncover(latestTs)
+		}
+	}
+
+	if !replicate {
+		return nil
+	}
+	for _, replication := range s.replications {
+		if subscriber, ok := replication.(importSubscriber); ok {
+			subscriber.notifyImport(batch)
+		}
+	}
+	return nil
+}
+
+//importMeasurements sorts the batch by time and writes it into new sealed data files of about maxFileSize
+func (s *DiskStore) importMeasurements(batch []importedMeasurement) error {
+	measurements := make([]idMeasurement, 0, len(batch))
+	for _, imported := range batch {
+		measurements = append(measurements, idMeasurement{id: imported.id, measurement: imported.measurement})
+	}
+	sort.SliceStable(measurements, func(i, j int) bool {
+		return measurements[i].measurement.Timestamp() < measurements[j].measurement.Timestamp()
+	})
+
+	fileStart := 0
+	var fileSize int64
+	for index, m := range measurements {
+		fileSize += int64(m.measurement.Size())
+		if fileSize < s.maxFileSize && index < len(measurements)-1 {
+			continue
+		}
+		var err error
+		s.inListenRoutine(func() {
+			err = s.writeImportedFile(measurements[fileStart : index+1])
+		})
+		if err != nil {
+			return err
+		}
+		fileStart = index + 1
+		fileSize = 0
+	}
+	return nil
+}
+
+//writeImportedFile of time sorted measurements and seal it. A data file with the same timerange is merged into it
+func (s *DiskStore) writeImportedFile(measurements []idMeasurement) error {
+	name := fileNameFromTs(measurements[0].measurement.Timestamp(), measurements[len(measurements)-1].measurement.Timestamp())
+	path := filepath.Join(dataPath, name)
+	if _, err := os.Stat(path); err == nil {
+		if s.isPinned(name) {
+			return fmt.Errorf("%v is being read, try again later", name)
+		}
+		info, err := timestampsFromFileName(name)
+		if err != nil {
+			return err
+		}
+		merged := append([]idMeasurement{}, measurements...)
+		err = s.readDataFile(info, func(id int64, m Measurement) {
+			merged = append(merged, idMeasurement{id: id, measurement: m})
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].measurement.Timestamp() < merged[j].measurement.Timestamp()
+		})
+		measurements = merged
+	}
+
+	err := writeFileAtomically(path, encodeDataFile(measurements, s.meta))
+	if err != nil {
+		return err
+	}
+	return sealDataFile(name)
+}
+
+//notifyImport queues the imported measurements of the replicated series for the replication target.
+//They are split into import messages of at most importReplicationSize measurements that fit into one tcp message
+func (r *Replication) notifyImport(batch []importedMeasurement) {
+	message := append(append([]byte{}, importMessagePrefix...), '[')
+	prefixLength := len(message)
+	count := 0
+	enqueue := func() {
+		err := r.outbox.enqueue(append(message, ']', '}'))
+		if err != nil {
+			fmt.Println(err)
+		}
+		message = message[:prefixLength]
+		count = 0
+	}
+
+	r.filterMutex.Lock()
+	defer r.filterMutex.Unlock()
+	for _, imported := range batch {
+		if !r.filter.Matches(imported.key) {
+			continue
+		}
+		m := &Message{Timestamp: imported.measurement.Timestamp(), Value: imported.measurement.ValueInterface()}
+		m.SetSeriesKey(imported.key)
+		byteSlice, err := json.Marshal(m)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if count >= importReplicationSize || (count > 0 && len(message)+len(byteSlice)+len(",]}") > maxOutboxMessageSize) {
+			enqueue()
+		}
+		if count > 0 {
+			message = append(message, ',')
+		}
+		message = append(message, byteSlice...)
+		count++
+	}
+	if count > 0 {
+		enqueue()
+	}
+}
+
+//uncover the series up to ts, measurements up to it were written to disk without being added to the series
+func (s *Series) uncover(ts int64) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+
+	if s.coveredFrom != 0 && s.coveredFrom <= ts {
+		s.coveredFrom = ts + 1
+	}
+}
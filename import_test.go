@@ -0,0 +1,265 @@
+package mhist
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/codeuniversity/ppp-mhist/tcp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Server_Import(t *testing.T) {
+	Convey("Server.Import", t, func() {
+		dir := withTempDataPath(t)
+
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		diskStore, err := NewDiskStore(pools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		defer store.Shutdown()
+		server := &Server{store: store, pools: pools}
+
+		timestamps := func(measurements []Measurement) []int64 {
+			timestamps := []int64{}
+			for _, m := range measurements {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			return timestamps
+		}
+
+		Convey("writes NDJSON into sealed data files of its timerange, without passing the memory store", func() {
+			response, err := server.Import(strings.NewReader(
+				"{\"name\":\"temperature\",\"tags\":{\"room\":\"kitchen\"},\"value\":21.5,\"timestamp\":1020}\n"+
+					"{\"name\":\"temperature\",\"tags\":{\"room\":\"kitchen\"},\"value\":20,\"timestamp\":1000}\n"+
+					"\n"+
+					"{\"name\":\"state\",\"value\":\"on\",\"timestamp\":1010}\n"+
+					"{\"name\":\"state\",\"value\":\"off\"}\n"+
+					"{\"name\":\"temperature\",\"tags\":{\"room\":\"kitchen\"},\"value\":\"hot\",\"timestamp\":1030}\n"+
+					"{broken\n"), ImportNDJSON, false)
+			So(err, ShouldBeNil)
+			So(response.Imported, ShouldEqual, 3)
+			So(response.Rejected, ShouldEqual, 3)
+			So(len(response.Errors), ShouldEqual, 3)
+			So(response.Errors[0].Index, ShouldEqual, 3)
+			So(response.Errors[1].Index, ShouldEqual, 4)
+			So(response.Errors[2].Index, ShouldEqual, 5)
+
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			So(files[0].name, ShouldEqual, fileNameFromTs(1000, 1020))
+			_, err = readIndex(files[0])
+			So(err, ShouldBeNil)
+			So(store.Size(), ShouldEqual, 0)
+
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			So(timestamps(result["temperature{room=kitchen}"]), ShouldResemble, []int64{1000, 1020})
+			So(timestamps(result["state"]), ShouldResemble, []int64{1010})
+		})
+
+		Convey("reads CSV, skipping the header and using the known type of a series", func() {
+			store.Add("state", &Categorical{Ts: 5000, Value: "on"}, false)
+			response, err := server.Import(strings.NewReader(
+				"series,timestamp,value\n"+
+					"\"temperature{room=kitchen}\",1000,20\n"+
+					"state,1010,1\n"+
+					"temperature,not a timestamp,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+			So(response.Imported, ShouldEqual, 2)
+			So(response.Rejected, ShouldEqual, 1)
+			So(response.Errors[0].Index, ShouldEqual, 3)
+
+			result := store.GetMeasurementsInTimeRange(0, 6000, FilterDefinition{})
+			So(result["temperature{room=kitchen}"], ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 20}})
+			So(result["state"], ShouldResemble, []Measurement{&Categorical{Ts: 1010, Value: "1"}, &Categorical{Ts: 5000, Value: "on"}})
+		})
+
+		Convey("splits large imports into multiple files", func() {
+			diskStore.maxFileSize = 1024
+			lines := []string{}
+			for ts := 1000; ts < 1200; ts++ {
+				lines = append(lines, "temperature,"+strconv.Itoa(ts)+",1")
+			}
+			response, err := server.Import(strings.NewReader(strings.Join(lines, "\n")), ImportCSV, false)
+			So(err, ShouldBeNil)
+			So(response.Imported, ShouldEqual, 200)
+
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldBeGreaterThan, 1)
+			for i := 1; i < len(files); i++ {
+				So(files[i].oldestTs, ShouldBeGreaterThan, files[i-1].latestTs)
+			}
+			So(len(store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldEqual, 200)
+		})
+
+		Convey("merges into a file with the same timerange", func() {
+			_, err := server.Import(strings.NewReader("a,1000,1\na,1020,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+			_, err = server.Import(strings.NewReader("b,1000,1\nb,1020,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			So(timestamps(result["a"]), ShouldResemble, []int64{1000, 1020})
+			So(timestamps(result["b"]), ShouldResemble, []int64{1000, 1020})
+		})
+
+		Convey("stops at the first batch that can't be written and only counts the written ones", func() {
+			defaultImportBatchSize := importBatchSize
+			importBatchSize = 2
+			defer func() { importBatchSize = defaultImportBatchSize }()
+			_, err := server.Import(strings.NewReader("a,1000,1\na,1020,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+			pinned := FileInfoSlice{{name: fileNameFromTs(1000, 1020)}}
+			diskStore.pin(pinned)
+			defer diskStore.unpin(pinned)
+
+			response, err := server.Import(strings.NewReader("b,1,1\nb,2,1\nb,1000,1\nb,1020,1\nb,3000,1\nb,3001,1\n"), ImportCSV, false)
+			So(err, ShouldNotBeNil)
+			So(response.Imported, ShouldEqual, 2)
+			So(timestamps(store.GetMeasurementsInTimeRange(0, 4000, FilterDefinition{})["b"]), ShouldResemble, []int64{1, 2})
+		})
+
+		Convey("makes series in memory read the imported timerange from disk", func() {
+			store.Add("temperature", &Numerical{Ts: 1000, Value: 1}, false)
+			store.Add("temperature", &Numerical{Ts: 1030, Value: 1}, false)
+			_, err := server.Import(strings.NewReader("temperature,1010,1\ntemperature,1020,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			So(timestamps(result["temperature"]), ShouldResemble, []int64{1000, 1010, 1020, 1030})
+		})
+
+		Convey("splits replicated imports into tcp messages that a replica stores over a tcp connection", func() {
+			replication, err := NewReplication("127.0.0.1:1", FilterDefinition{Names: []string{"log"}}, pools, 100*1024*1024)
+			So(err, ShouldBeNil)
+			defer replication.Shutdown()
+			store.AddReplication(replication)
+
+			value := strings.Repeat("a", 10*1024)
+			lines := []string{}
+			for i := 1; i <= 1000; i++ {
+				lines = append(lines, "{\"name\":\"log\",\"value\":\""+value+"\",\"timestamp\":"+strconv.Itoa(i)+"}")
+			}
+			_, err = server.Import(strings.NewReader(strings.Join(lines, "\n")), ImportNDJSON, true)
+			So(err, ShouldBeNil)
+			pending := replication.outbox.pendingAfter(0)
+			So(len(pending), ShouldBeGreaterThan, 1)
+			for _, entry := range pending {
+				So(len(encodeReplicationEnvelope(entry)), ShouldBeLessThanOrEqualTo, tcp.MaxMessageSize)
+			}
+
+			replicaDir, err := ioutil.TempDir("", "mhist")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(replicaDir)
+			defer func() { dataPath = dir }()
+			dataPath = replicaDir
+			replica := NewStore(100 * 1024 * 1024)
+			replicaPools := NewPools(replica)
+			replicaDiskStore, err := NewDiskStore(replicaPools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+			So(err, ShouldBeNil)
+			replica.SetDiskStore(replicaDiskStore)
+			defer replicaDiskStore.Shutdown()
+			defer replica.Shutdown()
+			handler := NewTCPHandler(&Server{store: replica, pools: replicaPools}, 0, replicaPools)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					handler.handleNewConnection(conn)
+				}
+			}()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			subscription, err := json.Marshal(&SubscriptionMessage{Publisher: true, Replication: true, Origin: "origin"})
+			So(err, ShouldBeNil)
+			_, err = conn.Write(append(subscription, '\n'))
+			So(err, ShouldBeNil)
+			go func() {
+				for _, entry := range pending {
+					conn.Write(encodeReplicationEnvelope(entry))
+				}
+			}()
+
+			reader := bufio.NewReader(conn)
+			for _, entry := range pending {
+				line, err := reader.ReadBytes('\n')
+				So(err, ShouldBeNil)
+				So(string(line), ShouldEqual, "{\"ack\":"+strconv.FormatUint(entry.seq, 10)+"}\n")
+			}
+			So(len(replica.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["log"]), ShouldEqual, 1000)
+		})
+
+		Convey("replicates imports, unless told not to", func() {
+			replication, err := NewReplication("127.0.0.1:1", FilterDefinition{Names: []string{"temperature"}}, pools, 1024*1024)
+			So(err, ShouldBeNil)
+			defer replication.Shutdown()
+			store.AddReplication(replication)
+
+			_, err = server.Import(strings.NewReader("temperature,1000,1\npressure,1000,1\n"), ImportCSV, false)
+			So(err, ShouldBeNil)
+			So(len(replication.outbox.pendingAfter(0)), ShouldEqual, 0)
+			_, err = server.Import(strings.NewReader("temperature,1010,1\npressure,1010,1\n"), ImportCSV, true)
+			So(err, ShouldBeNil)
+			pending := replication.outbox.pendingAfter(0)
+			So(len(pending), ShouldEqual, 1)
+			So(isImportMessage(pending[0].message), ShouldBeTrue)
+			So(string(pending[0].message), ShouldEqual, `{"import":[{"name":"temperature","timestamp":1010,"value":1}]}`)
+
+			replicaDir, err := ioutil.TempDir("", "mhist")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(replicaDir)
+			defer func() { dataPath = dir }()
+			dataPath = replicaDir
+			replica := NewStore(100 * 1024 * 1024)
+			replicaPools := NewPools(replica)
+			replicaDiskStore, err := NewDiskStore(replicaPools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+			So(err, ShouldBeNil)
+			replica.SetDiskStore(replicaDiskStore)
+			defer replicaDiskStore.Shutdown()
+			defer replica.Shutdown()
+			handler := NewTCPHandler(&Server{store: replica, pools: replicaPools}, 0, replicaPools)
+			So(handler.onNewMessage(pending[0].message, true), ShouldBeNil)
+			So(timestamps(replica.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{1010})
+			So(replica.Size(), ShouldEqual, 0)
+
+			err = handler.onNewMessage([]byte(`{"import":[{"name":"temperature","timestamp":1020,"value":1},{"name":"temperature","value":1}]}`), true)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "rejected 1 of 2 imported measurements")
+			So(timestamps(replica.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]), ShouldResemble, []int64{1010, 1020})
+
+			Convey("and doesn't acknowledge imports that couldn't be written, so they are sent again", func() {
+				pinned := FileInfoSlice{{name: fileNameFromTs(1010, 1010)}}
+				replicaDiskStore.pin(pinned)
+				serverConn, clientConn := net.Pipe()
+				conn := &tcp.Connection{Socket: serverConn}
+				envelope := encodeReplicationEnvelope(outboxEntry{seq: 7, message: pending[0].message})
+				handler.onReplicatedMessage(conn, "origin", envelope)
+				_, err := clientConn.Read(make([]byte, 1))
+				So(err, ShouldNotBeNil)
+				So(handler.appliedSeqPerOrigin["origin"], ShouldBeLessThan, 7)
+
+				replicaDiskStore.unpin(pinned)
+				serverConn, clientConn = net.Pipe()
+				defer clientConn.Close()
+				conn = &tcp.Connection{Socket: serverConn}
+				go handler.onReplicatedMessage(conn, "origin", envelope)
+				line, err := bufio.NewReader(clientConn).ReadBytes('\n')
+				So(err, ShouldBeNil)
+				So(string(line), ShouldEqual, "{\"ack\":7}\n")
+			})
+		})
+	})
+}
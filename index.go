@@ -0,0 +1,309 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//Sealed data files, that aren't appended to anymore, get a sidecar index <data file name>.idx.
+//It starts with indexFileMagic followed by the format version and a single frame with the payload
+//<uvarint data file size><uvarint entry count> and per entry
+//<varint id><uvarint type><uvarint count><varint oldest ts><varint latest ts><uvarint data offset><uvarint data length><uvarint crc32 of data>.
+//Every entry points to the encoded data of a series inside a block, entries are sorted by id and time,
+//so reads only have to seek to the entries of the requested series and time range
+const indexFileMagic = "MHSI"
+
+const indexFormatVersion = 1
+
+const indexFileExtension = ".idx"
+
+var indexFileHeader = append([]byte(indexFileMagic), indexFormatVersion)
+
+var errStaleIndex = errors.New("index doesn't match its data file")
+
+type indexEntry struct {
+	seriesHeader
+	offset   int64
+	length   int64
+	checksum uint32
+}
+
+//fileIndex of a sealed data file
+type fileIndex struct {
+	dataSize int64
+	entries  []indexEntry
+}
+
+func indexPath(dataFileName string) string {
+	return filepath.Join(dataPath, dataFileName+indexFileExtension)
+}
+
+//buildIndex for the binary data file
+func buildIndex(dataFileName string) (*fileIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, dataFileName))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(blockFileMagic)) || len(data) < len(blockFileHeader) {
+		return nil, errors.New("not a binary data file")
+	}
+
+	version := data[len(blockFileMagic)]
+	index := &fileIndex{dataSize: int64(len(data))}
+	position := len(blockFileHeader)
+	for position < len(data) {
+		payloadLength, n := binary.Uvarint(data[position:])
+		if n <= 0 || payloadLength > uint64(len(data)-position-n) {
+			return nil, errCorruptBlock
+		}
+		payloadStart := position + n
+		payloadEnd := payloadStart + int(payloadLength)
+		if payloadEnd+4 > len(data) {
+			return nil, errCorruptBlock
+		}
+		payload := data[payloadStart:payloadEnd]
+		if binary.BigEndian.Uint32(data[payloadEnd:payloadEnd+4]) != crc32.ChecksumIEEE(payload) {
+			return nil, errCorruptBlock
+		}
+		if version >= frameKindsVersion {
+			if len(payload) == 0 {
+				return nil, errCorruptBlock
+			}
+			if payload[0] != dataFrame {
+				position = payloadEnd + 4
+				continue
+			}
+			payload = payload[1:]
+			payloadStart++
+		}
+
+		reader := bytes.NewReader(payload)
+		_, err1 := binary.ReadVarint(reader)
+		_, err2 := binary.ReadVarint(reader)
+		seriesCount, err3 := binary.ReadUvarint(reader)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, errCorruptBlock
+		}
+		for i := uint64(0); i < seriesCount; i++ {
+			header, seriesData, err := readSeries(reader)
+			if err != nil {
+				return nil, err
+			}
+			dataEnd := len(payload) - reader.Len()
+			index.entries = append(index.entries, indexEntry{
+				seriesHeader: header,
+				offset:       int64(payloadStart + dataEnd - len(seriesData)),
+				length:       int64(len(seriesData)),
+				checksum:     crc32.ChecksumIEEE(seriesData),
+			})
+		}
+		position = payloadEnd + 4
+	}
+
+	sort.SliceStable(index.entries, func(i, j int) bool {
+		if index.entries[i].id != index.entries[j].id {
+			return index.entries[i].id < index.entries[j].id
+		}
+		return index.entries[i].oldestTs < index.entries[j].oldestTs
+	})
+	return index, nil
+}
+
+func (i *fileIndex) encode() []byte {
+	payload := appendUvarint(nil, uint64(i.dataSize))
+	payload = appendUvarint(payload, uint64(len(i.entries)))
+	for _, entry := range i.entries {
+		payload = appendVarint(payload, entry.id)
+		payload = appendUvarint(payload, uint64(entry.measurementType))
+		payload = appendUvarint(payload, uint64(entry.count))
+		payload = appendVarint(payload, entry.oldestTs)
+		payload = appendVarint(payload, entry.latestTs)
+		payload = appendUvarint(payload, uint64(entry.offset))
+		payload = appendUvarint(payload, uint64(entry.length))
+		payload = appendUvarint(payload, uint64(entry.checksum))
+	}
+	return appendFrame(append([]byte{}, indexFileHeader...), payload)
+}
+
+func decodeIndex(r io.Reader) (*fileIndex, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(indexFileHeader))
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(indexFileMagic)]) != indexFileMagic {
+		return nil, errors.New("not an index file")
+	}
+	if header[len(indexFileMagic)] > indexFormatVersion {
+		return nil, fmt.Errorf("unsupported index format version %v", header[len(indexFileMagic)])
+	}
+	payload, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadReader := bytes.NewReader(payload)
+	values := make([]uint64, 2)
+	for index := range values {
+		values[index], err = binary.ReadUvarint(payloadReader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+	}
+	index := &fileIndex{dataSize: int64(values[0])}
+	if values[1] > uint64(payloadReader.Len()) {
+		return nil, errCorruptBlock
+	}
+	index.entries = make([]indexEntry, 0, values[1])
+	for i := uint64(0); i < values[1]; i++ {
+		entry := indexEntry{}
+		entry.id, err = binary.ReadVarint(payloadReader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		fields := make([]uint64, 2)
+		for index := range fields {
+			fields[index], err = binary.ReadUvarint(payloadReader)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+		}
+		entry.measurementType = MeasurementType(fields[0])
+		entry.count = int(fields[1])
+		entry.oldestTs, err = binary.ReadVarint(payloadReader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		entry.latestTs, err = binary.ReadVarint(payloadReader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		for index := range fields {
+			fields[index], err = binary.ReadUvarint(payloadReader)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+		}
+		entry.offset = int64(fields[0])
+		entry.length = int64(fields[1])
+		checksum, err := binary.ReadUvarint(payloadReader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		entry.checksum = uint32(checksum)
+		index.entries = append(index.entries, entry)
+	}
+	return index, nil
+}
+
+//readIndex of the data file, returns an error if there is none or it doesn't belong to the current content of the file
+func readIndex(file *FileInfo) (*fileIndex, error) {
+	f, err := os.Open(indexPath(file.name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index, err := decodeIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	if index.dataSize != file.size {
+		return nil, errStaleIndex
+	}
+	return index, nil
+}
+
+//sealDataFile writes the index of a data file that won't be appended to anymore
+func sealDataFile(dataFileName string) error {
+	index, err := buildIndex(dataFileName)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(indexPath(dataFileName), index.encode())
+}
+
+//removeDataFile together with its index
+func removeDataFile(name string) error {
+	err := os.Remove(filepath.Join(dataPath, name))
+	indexErr := os.Remove(indexPath(name))
+	if err == nil && indexErr != nil && !os.IsNotExist(indexErr) {
+		err = indexErr
+	}
+	return err
+}
+
+//sealFiles indexes all binary data files except the latest one, that don't have a valid index yet, and removes indexes without a data file
+func (s *DiskStore) sealFiles() {
+	files, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	names := map[string]bool{}
+	for index, file := range files {
+		names[file.name] = true
+		if index == len(files)-1 || file.isCsv() {
+			continue
+		}
+		if _, err := readIndex(file); err == nil {
+			continue
+		}
+		err := sealDataFile(file.name)
+		if err != nil {
+			fmt.Println(file.name, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if filepath.Ext(name) == indexFileExtension && !names[name[:len(name)-len(indexFileExtension)]] {
+			os.Remove(filepath.Join(dataPath, name))
+		}
+	}
+}
+
+//readIndexedBlockFile reads only the series data of the index entries in the timerange that pass includeID
+func (s *DiskStore) readIndexedBlockFile(file *FileInfo, index *fileIndex, start, end int64, includeID func(id int64) bool, f func(id int64, m Measurement)) error {
+	osFile, err := os.Open(filepath.Join(dataPath, file.name))
+	if err != nil {
+		return err
+	}
+	defer osFile.Close()
+
+	for _, entry := range index.entries {
+		if entry.latestTs < start || entry.oldestTs > end || (includeID != nil && !includeID(entry.id)) {
+			continue
+		}
+		data := make([]byte, entry.length)
+		_, err := osFile.ReadAt(data, entry.offset)
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(data) != entry.checksum {
+			return errCorruptBlock
+		}
+		id := entry.id
+		err = decodeSeries(entry.seriesHeader, data, func(m Measurement) {
+			f(id, m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package mhist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_fileIndex(t *testing.T) {
+	Convey("file index", t, func() {
+		withTempDataPath(t)
+
+		meta := NewDiskMeta()
+		temperatureID, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+		statusID, _ := meta.GetOrCreateID("status", MeasurementCategorical)
+		diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		diskStore.Shutdown()
+
+		block := NewBlock()
+		for ts := int64(1000); ts < 1050; ts += 10 {
+			block.Add(temperatureID, &Numerical{Ts: ts, Value: float64(ts)})
+			block.Add(statusID, &Categorical{Ts: ts, Value: "on"})
+		}
+		So(WriteBlockToFile(block, meta, nil), ShouldBeNil)
+		file := &FileInfo{name: fileNameFromTs(1000, 1040), oldestTs: 1000, latestTs: 1040}
+		block.Reset()
+		for ts := int64(1050); ts < 1100; ts += 10 {
+			block.Add(temperatureID, &Numerical{Ts: ts, Value: float64(ts)})
+		}
+		So(AppendBlockToFile(file, block, meta, nil), ShouldBeNil)
+		file.name = fileNameFromTs(1000, 1090)
+		file.latestTs = 1090
+		info, err := os.Stat(filepath.Join(dataPath, file.name))
+		So(err, ShouldBeNil)
+		file.size = info.Size()
+
+		timestamps := func(read func(f func(id int64, m Measurement)) error) []int64 {
+			timestamps := []int64{}
+			So(read(func(id int64, m Measurement) {
+				So(id, ShouldEqual, temperatureID)
+				timestamps = append(timestamps, m.Timestamp())
+			}), ShouldBeNil)
+			return timestamps
+		}
+		onlyTemperature := func(id int64) bool { return id == temperatureID }
+
+		Convey("points to the series data of every block and round trips through its encoding", func() {
+			index, err := buildIndex(file.name)
+			So(err, ShouldBeNil)
+			So(len(index.entries), ShouldEqual, 3)
+			So(index.entries[0].id, ShouldEqual, temperatureID)
+			So(index.entries[1].oldestTs, ShouldEqual, 1050)
+			So(index.dataSize, ShouldEqual, file.size)
+
+			decoded, err := decodeIndex(bytes.NewReader(index.encode()))
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, index)
+		})
+
+		Convey("reads only the requested series and time range of sealed files", func() {
+			unsealed := timestamps(func(f func(id int64, m Measurement)) error {
+				return diskStore.readBlockFile(file, 1040, 1060, onlyTemperature, f)
+			})
+			So(sealDataFile(file.name), ShouldBeNil)
+			index, err := readIndex(file)
+			So(err, ShouldBeNil)
+			sealed := timestamps(func(f func(id int64, m Measurement)) error {
+				return diskStore.readIndexedBlockFile(file, index, 1040, 1060, onlyTemperature, f)
+			})
+			So(sealed, ShouldResemble, unsealed)
+			So(sealed, ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040, 1050, 1060, 1070, 1080, 1090})
+
+			all := 0
+			So(diskStore.readBlockFile(file, math.MinInt64, math.MaxInt64, nil, func(id int64, m Measurement) { all++ }), ShouldBeNil)
+			So(all, ShouldEqual, 15)
+		})
+
+		Convey("is ignored once the data file changed", func() {
+			So(sealDataFile(file.name), ShouldBeNil)
+			file.size++
+			_, err := readIndex(file)
+			So(err, ShouldEqual, errStaleIndex)
+		})
+
+		Convey("detects corrupt series data", func() {
+			So(sealDataFile(file.name), ShouldBeNil)
+			index, err := readIndex(file)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadFile(filepath.Join(dataPath, file.name))
+			So(err, ShouldBeNil)
+			data[index.entries[0].offset] ^= 0xff
+			So(ioutil.WriteFile(filepath.Join(dataPath, file.name), data, 0600), ShouldBeNil)
+			err = diskStore.readIndexedBlockFile(file, index, 0, 2000, nil, func(int64, Measurement) {})
+			So(err, ShouldEqual, errCorruptBlock)
+		})
+
+		Convey("is written for every file but the latest one and removed with its data file", func() {
+			block.Reset()
+			block.Add(temperatureID, &Numerical{Ts: 2000, Value: 1})
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+			So(ioutil.WriteFile(indexPath("5-6.mhist"), []byte("orphan"), 0600), ShouldBeNil)
+
+			diskStore.sealFiles()
+			_, err := readIndex(file)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(indexPath(fileNameFromTs(2000, 2000)))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(indexPath("5-6.mhist"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			So(removeDataFile(file.name), ShouldBeNil)
+			_, err = os.Stat(indexPath(file.name))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
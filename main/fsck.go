@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/codeuniversity/ppp-mhist"
+)
+
+//runFsck checks the data directory of a stopped mhist instance and returns the exit code, which is 1 if problems are left
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "defines whether problems are repaired: unreadable data is moved to data/quarantine, misnamed files are renamed and the meta is rebuilt or completed from the data files")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: mhist fsck [flags]")
+		fmt.Fprintln(flags.Output(), "checks the data directory, mhist must not be running meanwhile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	report, err := mhist.Fsck(*repair)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, problem := range report.Problems {
+		switch {
+		case problem.Warning:
+			fmt.Printf("%v %v (warning)\n", problem.File, problem.Problem)
+		case problem.Repair != "":
+			fmt.Printf("%v %v: repaired, %v\n", problem.File, problem.Problem, problem.Repair)
+		default:
+			fmt.Printf("%v %v\n", problem.File, problem.Problem)
+		}
+	}
+	unrepaired := report.Unrepaired()
+	fmt.Printf("checked %v files, found %v problems, %v of them are left\n", report.CheckedFiles, len(report.Problems), unrepaired)
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//runImport posts the given files, or stdin if there are none, to the /import endpoint of a running mhist instance and returns the exit code
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	address := flags.String("address", "http://localhost:6666", "defines the http address of the mhist instance to import into")
+	format := flags.String("format", "", "defines the format of the imported data: ndjson or csv. By default files ending with .csv are imported as csv and everything else as ndjson")
+	replicate := flags.Bool("replicate", true, "defines whether the imported measurements are replicated to the replication targets of the instance")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: mhist import [flags] [files...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return importFrom(os.Stdin, *address, formatOf("", *format), *replicate)
+	}
+	exitCode := 0
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Print(path, ": ")
+		if code := importFrom(file, *address, formatOf(path, *format), *replicate); code != 0 {
+			exitCode = code
+		}
+		file.Close()
+	}
+	return exitCode
+}
+
+func formatOf(path, format string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+func importFrom(r io.Reader, address, format string, replicate bool) int {
+	params := url.Values{}
+	params.Set("format", format)
+	params.Set("replicate", fmt.Sprint(replicate))
+	response, err := http.Post(strings.TrimSuffix(address, "/")+"/import?"+params.Encode(), "application/octet-stream", r)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	if response.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
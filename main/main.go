@@ -1,8 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "net/http/pprof" //pprof for performance analysis
 
@@ -10,18 +16,67 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "snapshot":
+			os.Exit(runSnapshot(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "fsck":
+			os.Exit(runFsck(os.Args[2:]))
+		}
+	}
+
 	config := mhist.ServerConfig{}
 	replicationConfigString := ""
+	walSyncPolicyString := ""
+	replicationFilterString := ""
 	flag.IntVar(&config.HTTPPort, "http_port", 6666, "defines the port on which the http handler operates")
 	flag.IntVar(&config.TCPPort, "tcp_port", 6667, "defines the port on which the tcp handler operates")
-	flag.IntVar(&config.MemorySize, "memory_size", 64*1024*1024, "defines the amount of memory the memory store limits itself to. Keep in mind that especially GET request can spike the actual memory usage of the process")
+	flag.IntVar(&config.MemorySize, "memory_size", 64*1024*1024, "defines the amount of memory the memory store limits itself to")
 	flag.IntVar(&config.DiskSize, "disk_size", 256*1024*1024, "defines the amount of disk space mhist should occupy")
 	flag.StringVar(&replicationConfigString, "replicate_to", "", "defines the addresses to replicate to, comma seperated")
+	flag.StringVar(&replicationFilterString, "replication_filter", "", `defines which series to replicate as json, i.e. {"names": ["temperature"], "tags": ["site=berlin"]}`)
+	flag.IntVar(&config.MaxOutboxSize, "replication_outbox_size", 64*1024*1024, "defines the amount of disk space the queue of unacknowledged messages per replication target may occupy, before the oldest messages are dropped")
+	flag.StringVar(&config.BootstrapAddress, "bootstrap_from", "", "defines the tcp address of a running mhist instance to pull all stored data from on startup and to keep receiving measurements from")
+	flag.DurationVar(&config.RollupAfter, "rollup_after", 0, "defines the age after which data files are compacted into rollups (aggregates per bucket of rollup_resolution), that answer queries with a coarse granularity. 0 disables rollups")
+	flag.DurationVar(&config.RollupResolution, "rollup_resolution", time.Minute, "defines the bucket size of rollups")
+	flag.DurationVar(&config.RollupMaxAge, "rollup_max_age", 0, "defines how long rollups are kept, 0 keeps them forever")
+	flag.DurationVar(&config.MaxLateness, "max_lateness", 0, "defines how late measurements may arrive compared to their timestamp, later ones are rejected. 0 accepts any lateness")
+	flag.StringVar(&walSyncPolicyString, "wal_sync", string(mhist.WALSyncInterval), "defines when the write-ahead log is synced to disk: always, interval (every second) or never")
 
 	flag.Parse()
 	if replicationConfigString != "" {
 		config.ReplicationAddresses = strings.Split(replicationConfigString, ",")
 	}
+	if replicationFilterString != "" {
+		err := json.Unmarshal([]byte(replicationFilterString), &config.ReplicationFilter)
+		if err == nil {
+			err = config.ReplicationFilter.Validate()
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	walSyncPolicy, err := mhist.ParseWALSyncPolicy(walSyncPolicyString)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	config.WALSyncPolicy = walSyncPolicy
+
 	server := mhist.NewServer(config)
+	go shutdownOnSignal(server)
 	server.Run()
 }
+
+func shutdownOnSignal(server *mhist.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	server.Shutdown()
+	os.Exit(0)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/codeuniversity/ppp-mhist"
+)
+
+//runSnapshot downloads a consistent archive of the data directory of a running mhist instance and returns the exit code
+func runSnapshot(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	address := flags.String("address", "http://localhost:6666", "defines the http address of the mhist instance to snapshot")
+	output := flags.String("o", "", "defines the file the archive is written to, by default it is written to stdout")
+	since := flags.String("since", "", "defines an earlier archive, only the files that changed since it are included. Restore both in order")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: mhist snapshot [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	url := strings.TrimSuffix(*address, "/") + "/snapshot"
+	response, err := requestArchive(url, *since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(string(body)))
+		return 1
+	}
+
+	if *output == "" {
+		_, err = io.Copy(os.Stdout, response.Body)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	//the archive is only moved in place once it is complete, so an interrupted download doesn't look like a valid archive
+	file, err := os.Create(*output + ".tmp")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_, err = io.Copy(file, response.Body)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, err = mhist.ReadArchiveManifest(*output + ".tmp")
+	}
+	if err == nil {
+		err = os.Rename(*output+".tmp", *output)
+	}
+	if err != nil {
+		os.Remove(*output + ".tmp")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+//requestArchive of the data directory, incremental to the archive at since if it is set
+func requestArchive(url, since string) (*http.Response, error) {
+	if since == "" {
+		return http.Get(url)
+	}
+	manifest, err := mhist.ReadArchiveManifest(since)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return http.Post(url, "application/json", bytes.NewReader(body))
+}
+
+//runRestore installs archives into the data directory of a stopped mhist instance and returns the exit code
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: mhist restore <full archive> [incremental archives...]")
+		fmt.Fprintln(flags.Output(), "replaces the data directory with the state of the last archive, mhist must not be running meanwhile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	err := mhist.RestoreArchives(flags.Args())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -133,3 +133,14 @@ const (
 	//MeasurementCategorical for measurements that are non numerical and not interpolateable
 	MeasurementCategorical
 )
+
+//String of the type, i.e. for errors
+func (t MeasurementType) String() string {
+	switch t {
+	case MeasurementNumerical:
+		return "numerical"
+	case MeasurementCategorical:
+		return "categorical"
+	}
+	return strconv.Itoa(int(t))
+}
@@ -1,10 +1,17 @@
 package mhist
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 //Message represents events sent to and from the server
 type Message struct {
-	Name      string      `json:"name"`
-	Timestamp int64       `json:"timestamp"`
-	Value     interface{} `json:"value"`
+	Name      string            `json:"name"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags,omitempty"`
 }
 
 //Reset message to zero value
@@ -12,4 +19,32 @@ func (m *Message) Reset() {
 	m.Name = ""
 	m.Timestamp = 0
 	m.Value = nil
+	m.Tags = nil
+}
+
+//SetSeriesKey sets name and tags of the message from the key of a series
+func (m *Message) SetSeriesKey(key string) {
+	m.Name, m.Tags = ParseSeriesKey(key)
+}
+
+//SeriesKey of the series the message belongs to
+func (m *Message) SeriesKey() string {
+	return SeriesKey(m.Name, m.Tags)
+}
+
+//validate name and tag keys of the message
+func (m *Message) validate() error {
+	if m.Name == "" {
+		return errors.New("name can't be empty")
+	}
+	//a name with these characters could be mistaken for the series key of a series with tags
+	if strings.ContainsAny(m.Name, "{}=,") {
+		return fmt.Errorf("name '%v' can't contain any of '{', '}', '=' and ','", m.Name)
+	}
+	for key := range m.Tags {
+		if key == "" {
+			return errors.New("tag keys can't be empty")
+		}
+	}
+	return nil
 }
@@ -0,0 +1,493 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codeuniversity/ppp-mhist/tcp"
+)
+
+var outboxDirectory = "outbox"
+
+var outboxRetryInterval = 2 * time.Second
+
+const outboxWriteTimeout = 10 * time.Second
+
+const maxOutboxEntriesPerWrite = 1000
+
+//maxOutboxMessageSize is the longest message that still fits into one tcp message once it is wrapped with its sequence number
+const maxOutboxMessageSize = tcp.MaxMessageSize - len(`{"seq":18446744073709551615,"message":}`+"\n")
+
+var errOutboxStopped = errors.New("outbox stopped")
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9.\-]`)
+
+//replicationOutbox is a persistent queue of the messages for one replication target.
+//Every message gets a sequence number and stays queued until the target acknowledged it, so delivery resumes in order after either side restarts.
+//Messages are appended to <target>.log as frames of <uvarint seq><varint enqueuedAt><message>, the acknowledged sequence number is kept in <target>.state
+type replicationOutbox struct {
+	address             string
+	logPath             string
+	statePath           string
+	maxSize             int64
+	subscriptionMessage *SubscriptionMessage
+
+	file       *os.File
+	logSize    int64
+	state      outboxState
+	stateDirty bool
+	entries    []outboxEntry
+	size       int64
+	nextSeq    uint64
+	dropped    uint64
+	connected  bool
+	sync.Mutex
+
+	notifyChan chan struct{}
+	closeChan  chan struct{}
+	doneChan   chan struct{}
+}
+
+type outboxState struct {
+	Origin string `json:"origin"`
+	Acked  uint64 `json:"acked"`
+}
+
+type outboxEntry struct {
+	seq        uint64
+	enqueuedAt int64
+	message    []byte
+}
+
+//ReplicationStatus describes the backlog of a replication target. Lag is the time in nanoseconds since the oldest unacknowledged message was queued
+type ReplicationStatus struct {
+	Address      string `json:"address"`
+	Connected    bool   `json:"connected"`
+	LastSeq      uint64 `json:"lastSeq"`
+	AckedSeq     uint64 `json:"ackedSeq"`
+	Backlog      int    `json:"backlog"`
+	BacklogBytes int64  `json:"backlogBytes"`
+	Dropped      uint64 `json:"dropped"`
+	Lag          int64  `json:"lag"`
+}
+
+//openReplicationOutbox loads the queue of address from disk and starts delivering it.
+//If the queue grows beyond maxSize bytes, the oldest messages are dropped
+func openReplicationOutbox(address string, maxSize int64) (*replicationOutbox, error) {
+	directory := filepath.Join(dataPath, outboxDirectory)
+	err := os.MkdirAll(directory, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	fileName := unsafeFileNameCharacters.ReplaceAllString(address, "_")
+	o := &replicationOutbox{
+		address:    address,
+		logPath:    filepath.Join(directory, fileName+".log"),
+		statePath:  filepath.Join(directory, fileName+".state"),
+		maxSize:    maxSize,
+		notifyChan: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+
+	err = o.loadState()
+	if err != nil {
+		return nil, err
+	}
+	err = o.loadLog()
+	if err != nil {
+		fmt.Println("replication outbox for", address, "is partially corrupt, recovered what was readable:", err)
+	}
+	o.dropOverflow()
+	err = o.rewriteLog()
+	if err != nil {
+		return nil, err
+	}
+	err = o.writeState()
+	if err != nil {
+		o.file.Close()
+		return nil, err
+	}
+	o.subscriptionMessage = &SubscriptionMessage{Publisher: true, Replication: true, Origin: o.state.Origin}
+
+	go o.run()
+	go o.send()
+	return o, nil
+}
+
+func (o *replicationOutbox) loadState() error {
+	byteSlice, err := ioutil.ReadFile(o.statePath)
+	if os.IsNotExist(err) {
+		origin := make([]byte, 8)
+		_, err = rand.Read(origin)
+		o.state.Origin = hex.EncodeToString(origin)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byteSlice, &o.state)
+}
+
+func (o *replicationOutbox) loadLog() error {
+	o.nextSeq = o.state.Acked + 1
+	f, err := os.Open(o.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := decodeOutboxEntry(payload)
+		if err != nil {
+			return err
+		}
+		if entry.seq >= o.nextSeq {
+			o.nextSeq = entry.seq + 1
+		}
+		if entry.seq > o.state.Acked {
+			o.entries = append(o.entries, entry)
+			o.size += int64(len(entry.message))
+		}
+	}
+}
+
+//enqueue message with the next sequence number.
+//A message that is too long for the target to read it is refused, it would be sent again forever
+func (o *replicationOutbox) enqueue(message []byte) error {
+	if len(message) > maxOutboxMessageSize {
+		return fmt.Errorf("couldn't replicate a message of %v bytes to %v, it is longer than %v bytes", len(message), o.address, maxOutboxMessageSize)
+	}
+	o.Lock()
+	entry := outboxEntry{
+		seq:        o.nextSeq,
+		enqueuedAt: time.Now().UnixNano(),
+		message:    append([]byte{}, message...),
+	}
+	o.nextSeq++
+	frame := appendFrame(nil, encodeOutboxEntry(entry))
+	_, err := o.file.Write(frame)
+	if err != nil {
+		fmt.Println(err)
+	}
+	o.logSize += int64(len(frame))
+	o.entries = append(o.entries, entry)
+	o.size += int64(len(entry.message))
+	o.dropOverflow()
+	o.Unlock()
+
+	select {
+	case o.notifyChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//ack removes all messages up to seq from the queue
+func (o *replicationOutbox) ack(seq uint64) {
+	o.Lock()
+	defer o.Unlock()
+
+	if seq <= o.state.Acked {
+		return
+	}
+	index := sort.Search(len(o.entries), func(i int) bool {
+		return o.entries[i].seq > seq
+	})
+	for _, entry := range o.entries[:index] {
+		o.size -= int64(len(entry.message))
+	}
+	o.entries = o.entries[index:]
+	o.state.Acked = seq
+	o.stateDirty = true
+}
+
+//pendingAfter returns the queued messages with a sequence number bigger than seq
+func (o *replicationOutbox) pendingAfter(seq uint64) []outboxEntry {
+	o.Lock()
+	defer o.Unlock()
+
+	index := sort.Search(len(o.entries), func(i int) bool {
+		return o.entries[i].seq > seq
+	})
+	end := len(o.entries)
+	if end-index > maxOutboxEntriesPerWrite {
+		end = index + maxOutboxEntriesPerWrite
+	}
+	return append([]outboxEntry{}, o.entries[index:end]...)
+}
+
+func (o *replicationOutbox) ackedSeq() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	return o.state.Acked
+}
+
+func (o *replicationOutbox) setConnected(connected bool) {
+	o.Lock()
+	defer o.Unlock()
+	o.connected = connected
+}
+
+//status of the queue
+func (o *replicationOutbox) status() ReplicationStatus {
+	o.Lock()
+	defer o.Unlock()
+
+	status := ReplicationStatus{
+		Address:      o.address,
+		Connected:    o.connected,
+		LastSeq:      o.nextSeq - 1,
+		AckedSeq:     o.state.Acked,
+		Backlog:      len(o.entries),
+		BacklogBytes: o.size,
+		Dropped:      o.dropped,
+	}
+	if len(o.entries) > 0 {
+		status.Lag = time.Now().UnixNano() - o.entries[0].enqueuedAt
+	}
+	return status
+}
+
+//shutdown delivery and persist the queue, returns after everything is written
+func (o *replicationOutbox) shutdown() {
+	close(o.closeChan)
+	<-o.doneChan
+}
+
+//dropOverflow drops the oldest messages, as if they were acknowledged, until the queue fits into maxSize again
+func (o *replicationOutbox) dropOverflow() {
+	if o.maxSize <= 0 || o.size <= o.maxSize {
+		return
+	}
+	dropped := 0
+	for len(o.entries) > 0 && o.size > o.maxSize {
+		o.size -= int64(len(o.entries[0].message))
+		o.state.Acked = o.entries[0].seq
+		o.entries = o.entries[1:]
+		dropped++
+	}
+	o.dropped += uint64(dropped)
+	o.stateDirty = true
+	fmt.Printf("replication outbox for %v is full, dropped %v messages\n", o.address, dropped)
+}
+
+//run persists the acknowledged sequence number and syncs the log periodically
+func (o *replicationOutbox) run() {
+	ticker := time.NewTicker(walSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.closeChan:
+			o.persist()
+			o.Lock()
+			o.file.Close()
+			o.Unlock()
+			close(o.doneChan)
+			return
+		case <-ticker.C:
+			o.persist()
+		}
+	}
+}
+
+//persist writes the state if it changed and compacts the log once most of it was acknowledged
+func (o *replicationOutbox) persist() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.stateDirty {
+		err := o.writeState()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if o.logSize > 2*o.size+maxBuffer {
+		err := o.rewriteLog()
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	err := o.file.Sync()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (o *replicationOutbox) writeState() error {
+	byteSlice, err := json.Marshal(o.state)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(o.statePath, byteSlice)
+	if err == nil {
+		o.stateDirty = false
+	}
+	return err
+}
+
+//rewriteLog with only the unacknowledged messages and reopen it for appending
+func (o *replicationOutbox) rewriteLog() error {
+	byteSlice := []byte{}
+	for _, entry := range o.entries {
+		byteSlice = appendFrame(byteSlice, encodeOutboxEntry(entry))
+	}
+	err := writeFileAtomically(o.logPath, byteSlice)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.logPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = f
+	o.logSize = int64(len(byteSlice))
+	return nil
+}
+
+//send keeps a connection to the target and writes the queue to it, starting after the last acknowledged message on every new connection
+func (o *replicationOutbox) send() {
+	for {
+		err := o.sendOnce()
+		o.setConnected(false)
+		if err == errOutboxStopped {
+			return
+		}
+		fmt.Println(err)
+		select {
+		case <-o.closeChan:
+			return
+		case <-time.After(outboxRetryInterval):
+		}
+	}
+}
+
+func (o *replicationOutbox) sendOnce() error {
+	conn, err := net.DialTimeout("tcp", o.address, outboxWriteTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	message, err := json.Marshal(o.subscriptionMessage)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(outboxWriteTimeout))
+	_, err = conn.Write(append(message, '\n'))
+	if err != nil {
+		return err
+	}
+	o.setConnected(true)
+
+	brokenChan := make(chan struct{})
+	go o.readAcks(conn, brokenChan)
+
+	writer := bufio.NewWriter(conn)
+	sent := o.ackedSeq()
+	for {
+		entries := o.pendingAfter(sent)
+		if len(entries) == 0 {
+			select {
+			case <-o.notifyChan:
+				continue
+			case <-brokenChan:
+				return errors.New("replication connection to " + o.address + " was closed")
+			case <-o.closeChan:
+				return errOutboxStopped
+			}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(outboxWriteTimeout))
+		for _, entry := range entries {
+			writer.Write(encodeReplicationEnvelope(entry))
+		}
+		err := writer.Flush()
+		if err != nil {
+			return err
+		}
+		sent = entries[len(entries)-1].seq
+	}
+}
+
+//readAcks from the target until the connection breaks
+func (o *replicationOutbox) readAcks(conn net.Conn, brokenChan chan struct{}) {
+	defer close(brokenChan)
+	reader := bufio.NewReader(conn)
+	for {
+		byteSlice, err := tcp.ReadMessage(reader)
+		if err == tcp.ErrMessageTooLarge {
+			fmt.Println(err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		ack := &replicationAck{}
+		err = json.Unmarshal(byteSlice, ack)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if ack.Error != "" {
+			fmt.Printf("%v rejected replicated message %v: %v\n", o.address, ack.Ack, ack.Error)
+		}
+		o.ack(ack.Ack)
+	}
+}
+
+func encodeReplicationEnvelope(entry outboxEntry) []byte {
+	byteSlice := []byte(fmt.Sprintf(`{"seq":%v,"message":`, entry.seq))
+	byteSlice = append(byteSlice, entry.message...)
+	return append(byteSlice, '}', '\n')
+}
+
+func encodeOutboxEntry(entry outboxEntry) []byte {
+	payload := appendUvarint(nil, entry.seq)
+	payload = appendVarint(payload, entry.enqueuedAt)
+	return append(payload, entry.message...)
+}
+
+func decodeOutboxEntry(payload []byte) (entry outboxEntry, err error) {
+	reader := bytes.NewReader(payload)
+	entry.seq, err = binary.ReadUvarint(reader)
+	if err != nil {
+		return entry, errCorruptBlock
+	}
+	entry.enqueuedAt, err = binary.ReadVarint(reader)
+	if err != nil {
+		return entry, errCorruptBlock
+	}
+	entry.message = payload[len(payload)-reader.Len():]
+	return entry, nil
+}
@@ -0,0 +1,148 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_replicationOutbox(t *testing.T) {
+	Convey("replication outbox", t, func() {
+		withTempDataPath(t)
+
+		message := func(ts int64) []byte {
+			byteSlice, err := json.Marshal(&Message{Name: "temperature", Value: float64(ts), Timestamp: ts})
+			So(err, ShouldBeNil)
+			return byteSlice
+		}
+
+		Convey("delivers in order until the target acknowledged everything", func() {
+			store := NewStore(100 * 1024 * 1024)
+			defer store.Shutdown()
+			pools := NewPools(store)
+			handler := NewTCPHandler(&Server{store: store, pools: pools}, 0, pools)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go handler.handleNewConnection(conn)
+				}
+			}()
+
+			outbox, err := openReplicationOutbox(listener.Addr().String(), 1024*1024)
+			So(err, ShouldBeNil)
+			for ts := int64(1000); ts <= 1030; ts += 10 {
+				outbox.enqueue(message(ts))
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for outbox.status().AckedSeq < 4 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			status := outbox.status()
+			So(status.AckedSeq, ShouldEqual, 4)
+			So(status.Backlog, ShouldEqual, 0)
+			So(status.Lag, ShouldEqual, 0)
+
+			measurements, _ := store.GetSeries("temperature", MeasurementNumerical).GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			timestamps := []int64{}
+			for _, m := range measurements {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			So(timestamps, ShouldResemble, []int64{1000, 1010, 1020, 1030})
+			outbox.shutdown()
+		})
+
+		Convey("keeps unacknowledged messages across restarts", func() {
+			outbox, err := openReplicationOutbox("127.0.0.1:1", 1024*1024)
+			So(err, ShouldBeNil)
+			origin := outbox.state.Origin
+			outbox.enqueue(message(1000))
+			outbox.enqueue(message(1010))
+			outbox.enqueue(message(1020))
+			outbox.ack(1)
+			outbox.shutdown()
+
+			outbox, err = openReplicationOutbox("127.0.0.1:1", 1024*1024)
+			So(err, ShouldBeNil)
+			defer outbox.shutdown()
+			So(outbox.state.Origin, ShouldEqual, origin)
+			status := outbox.status()
+			So(status.LastSeq, ShouldEqual, 3)
+			So(status.AckedSeq, ShouldEqual, 1)
+			So(status.Backlog, ShouldEqual, 2)
+			So(status.Lag, ShouldBeGreaterThan, 0)
+			pending := outbox.pendingAfter(1)
+			So(len(pending), ShouldEqual, 2)
+			So(pending[0].seq, ShouldEqual, 2)
+			So(pending[1].message, ShouldResemble, message(1020))
+		})
+
+		Convey("drops the oldest messages once it is full", func() {
+			outbox, err := openReplicationOutbox("127.0.0.1:1", 10)
+			So(err, ShouldBeNil)
+			defer outbox.shutdown()
+			outbox.enqueue([]byte("aaaaaa"))
+			outbox.enqueue([]byte("bbbbbb"))
+			outbox.enqueue([]byte("cccccc"))
+			status := outbox.status()
+			So(status.Dropped, ShouldEqual, 2)
+			So(status.AckedSeq, ShouldEqual, 2)
+			So(status.Backlog, ShouldEqual, 1)
+		})
+
+		Convey("refuses messages that are too long for the target to read them", func() {
+			outbox, err := openReplicationOutbox("127.0.0.1:1", 100*1024*1024)
+			So(err, ShouldBeNil)
+			defer outbox.shutdown()
+			So(outbox.enqueue(bytes.Repeat([]byte("a"), maxOutboxMessageSize+1)), ShouldNotBeNil)
+			So(outbox.enqueue(bytes.Repeat([]byte("a"), maxOutboxMessageSize)), ShouldBeNil)
+			So(outbox.status().LastSeq, ShouldEqual, 1)
+		})
+	})
+}
+
+func Test_markApplied(t *testing.T) {
+	Convey("only applies every sequence number of an origin once", t, func() {
+		handler := NewTCPHandler(&Server{}, 0, nil)
+		So(handler.markApplied("a", 1), ShouldBeTrue)
+		So(handler.markApplied("a", 1), ShouldBeFalse)
+		So(handler.markApplied("b", 1), ShouldBeTrue)
+		So(handler.markApplied("a", 2), ShouldBeTrue)
+		So(handler.markApplied("", 1), ShouldBeTrue)
+		So(handler.markApplied("", 1), ShouldBeTrue)
+	})
+
+	Convey("keeps the applied sequence numbers across restarts", t, func() {
+		withTempDataPath(t)
+		open := func() (*Store, *DiskStore, *TCPHandler) {
+			store := NewStore(100 * 1024 * 1024)
+			pools := NewPools(store)
+			diskStore, err := NewDiskStore(pools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+			So(err, ShouldBeNil)
+			store.SetDiskStore(diskStore)
+			return store, diskStore, NewTCPHandler(&Server{store: store, pools: pools}, 0, pools)
+		}
+
+		store, diskStore, handler := open()
+		So(handler.markApplied("a", 1), ShouldBeTrue)
+		So(handler.markApplied("a", 2), ShouldBeTrue)
+		handler.unmarkApplied("a", 2)
+		diskStore.Shutdown()
+		store.Shutdown()
+
+		store, diskStore, handler = open()
+		defer store.Shutdown()
+		defer diskStore.Shutdown()
+		So(handler.markApplied("a", 1), ShouldBeFalse)
+		So(handler.markApplied("a", 2), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,256 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//Rename moves the history of the series From to the series To, both are series keys like `temperature{room=kitchen}`.
+//If To already exists both series are merged, which requires them to have the same type of measurements
+type Rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var errSeriesNotFound = errors.New("series doesn't exist")
+
+//normalize the series keys, so tags can be given in any order
+func (r *Rename) normalize() {
+	r.From = SeriesKey(ParseSeriesKey(r.From))
+	r.To = SeriesKey(ParseSeriesKey(r.To))
+}
+
+//Validate the rename
+func (r Rename) Validate() error {
+	if NameOfSeriesKey(r.From) == "" || NameOfSeriesKey(r.To) == "" {
+		return errors.New("from and to can't be empty")
+	}
+	if r.From == r.To {
+		return errors.New("from and to are the same series")
+	}
+	return nil
+}
+
+//renameMessage is how renames are replicated: {"rename": {...}}
+type renameMessage struct {
+	Rename *Rename `json:"rename"`
+}
+
+var renameMessagePrefix = []byte(`{"rename":`)
+
+func isRenameMessage(byteSlice []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(byteSlice), renameMessagePrefix)
+}
+
+//Rename the series in memory and on disk, merged is true if the target series already existed.
+//The rename is replicated if it didn't come from a replication itself
+func (s *Store) Rename(rename Rename, isReplication bool) (merged bool, err error) {
+	rename.normalize()
+	err = rename.Validate()
+	if err != nil {
+		return false, err
+	}
+
+	s.renameMutex.Lock()
+	defer s.renameMutex.Unlock()
+	s.Lock()
+	defer s.Unlock()
+
+	source := s.loadSeries(rename.From)
+	target := s.loadSeries(rename.To)
+	//check before the meta is changed
+	if source != nil && target != nil && source.Type() != target.Type() {
+		return false, fmt.Errorf("can't merge %v into %v, they have different types", rename.From, rename.To)
+	}
+	if s.diskStore != nil {
+		merged, err = s.diskStore.meta.rename(rename.From, rename.To)
+		if err == errSeriesNotFound && source != nil {
+			//the series was never written to disk, i.e. because of a type conflict
+			err = nil
+			merged = target != nil
+		}
+		if err != nil {
+			return false, err
+		}
+	} else {
+		if source == nil {
+			return false, errSeriesNotFound
+		}
+		merged = target != nil
+	}
+
+	switch {
+	case source != nil && target != nil:
+		target.merge(source)
+		s.seriesMap.Delete(rename.From)
+		source.Shutdown()
+	case source != nil:
+		if merged {
+			source.merge(nil)
+		}
+		s.seriesMap.Store(rename.To, source)
+		s.seriesMap.Delete(rename.From)
+	case target != nil:
+		target.merge(nil)
+	}
+
+	if !isReplication {
+		for _, replication := range s.replications {
+			if subscriber, ok := replication.(RenameSubscriber); ok {
+				subscriber.NotifyRename(rename)
+			}
+		}
+	}
+	return merged, nil
+}
+
+func (s *Store) loadSeries(key string) *Series {
+	series, ok := s.seriesMap.Load(key)
+	if !ok || series == nil {
+		return nil
+	}
+	return series.(*Series)
+}
+
+//merge the measurements of other into the series. If other is nil, the history that is merged into the series isn't in memory,
+//so the series only covers the measurements that are added from now on and the history is read from disk
+func (s *Series) merge(other *Series) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+
+	if other == nil {
+		if len(s.measurements) == 0 {
+			s.coveredFrom = 0
+		} else {
+			s.coveredFrom = s.measurements[len(s.measurements)-1].Timestamp() + 1
+		}
+		return
+	}
+
+	other.rwLock.Lock()
+	defer other.rwLock.Unlock()
+	measurements := make([]Measurement, 0, len(s.measurements)+len(other.measurements))
+	measurements = append(measurements, s.measurements...)
+	measurements = append(measurements, other.measurements...)
+	sort.SliceStable(measurements, func(i, j int) bool {
+		return measurements[i].Timestamp() < measurements[j].Timestamp()
+	})
+	s.measurements = measurements
+	s.size += other.size
+	//the merged series is only complete from where both of them are
+	if s.coveredFrom == 0 || other.coveredFrom > s.coveredFrom {
+		s.coveredFrom = other.coveredFrom
+	}
+}
+
+//rename the series from to to, or merge it into to if that exists with the same type.
+//The ids of merged series keep pointing to the name of the series they were merged into, so their history is read as part of it
+func (m *DiskMeta) rename(from, to string) (merged bool, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	id := m.NameToID[from]
+	if id == 0 {
+		return false, errSeriesNotFound
+	}
+	targetID := m.NameToID[to]
+	if targetID != 0 && m.IDToType[targetID] != m.IDToType[id] {
+		return false, fmt.Errorf("can't merge %v into %v, they have different types", from, to)
+	}
+	delete(m.NameToID, from)
+	for otherID, name := range m.IDToName {
+		if name == from {
+			m.IDToName[otherID] = to
+		}
+	}
+	if targetID == 0 {
+		m.NameToID[to] = id
+		if history, ok := m.TypeHistory[from]; ok {
+			m.TypeHistory[to] = history
+		}
+	}
+	delete(m.TypeHistory, from)
+	delete(m.Rejections, from)
+	m.sync()
+	return targetID != 0, nil
+}
+
+//idsOfName are the id of the series and the ids of all series that were merged into it
+func (m *DiskMeta) idsOfName(key string) []int64 {
+	m.RLock()
+	defer m.RUnlock()
+
+	id := m.NameToID[key]
+	if id == 0 {
+		return nil
+	}
+	ids := []int64{id}
+	for otherID, name := range m.IDToName {
+		if name == key && otherID != id {
+			ids = append(ids, otherID)
+		}
+	}
+	return ids
+}
+
+//canonicalID of the series the id belongs to, which differs from id if its series was merged into another one.
+//Earlier versions of a series with another type keep their own id
+func (m *DiskMeta) canonicalID(id int64) int64 {
+	m.RLock()
+	defer m.RUnlock()
+
+	if canonicalID := m.NameToID[m.IDToName[id]]; canonicalID != 0 && m.IDToType[canonicalID] == m.IDToType[id] {
+		return canonicalID
+	}
+	return id
+}
+
+//RenameSubscriber is a Subscriber that also has to know about renames, i.e. to replicate them
+type RenameSubscriber interface {
+	NotifyRename(rename Rename)
+}
+
+//NotifyRename queues the rename for the replication target, if either series is replicated
+func (r *Replication) NotifyRename(rename Rename) {
+	r.filterMutex.Lock()
+	matches := r.filter.Matches(rename.From) || r.filter.Matches(rename.To)
+	r.filterMutex.Unlock()
+	if !matches {
+		return
+	}
+
+	byteSlice, err := json.Marshal(&renameMessage{Rename: &rename})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = r.outbox.enqueue(byteSlice)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (s *Server) handleRenameMessage(byteSlice []byte, isReplication bool) error {
+	message := &renameMessage{}
+	err := json.Unmarshal(byteSlice, message)
+	if err != nil {
+		return err
+	}
+	if message.Rename == nil {
+		return errors.New("rename is missing")
+	}
+	_, err = s.store.Rename(*message.Rename, isReplication)
+	return err
+}
+
+func sortByTimestampIfNeeded(measurements []Measurement) {
+	less := func(i, j int) bool {
+		return measurements[i].Timestamp() < measurements[j].Timestamp()
+	}
+	if !sort.SliceIsSorted(measurements, less) {
+		sort.SliceStable(measurements, less)
+	}
+}
@@ -0,0 +1,137 @@
+package mhist
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Store_Rename(t *testing.T) {
+	Convey("Store.Rename", t, func() {
+		withTempDataPath(t)
+
+		store := NewStore(100 * 1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		defer store.Shutdown()
+
+		for ts := int64(1000); ts <= 1050; ts += 10 {
+			store.Add("temp{room=1}", &Numerical{Ts: ts, Value: float64(ts)}, false)
+			store.Add("temperature{room=1}", &Numerical{Ts: ts + 5, Value: float64(ts + 5)}, false)
+			if ts == 1010 || ts == 1030 {
+				diskStore.inListenRoutine(diskStore.commit)
+			}
+		}
+		store.Add("status", &Categorical{Ts: 1000, Value: "on"}, false)
+		timestamps := func(measurements []Measurement) []int64 {
+			timestamps := []int64{}
+			for _, m := range measurements {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			return timestamps
+		}
+
+		Convey("renames a series, keeping its history and id", func() {
+			id := diskStore.meta.NameToID["temp{room=1}"]
+			merged, err := store.Rename(Rename{From: "temp{room=1}", To: "celsius{room=1}"}, false)
+			So(err, ShouldBeNil)
+			So(merged, ShouldBeFalse)
+
+			So(store.matchingSeriesKeys(FilterDefinition{}), ShouldResemble, []string{"celsius{room=1}", "status", "temperature{room=1}"})
+			So(timestamps(store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["celsius{room=1}"]), ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040, 1050})
+			store.Add("celsius{room=1}", &Numerical{Ts: 1060, Value: 1}, false)
+			So(diskStore.meta.NameToID["celsius{room=1}"], ShouldEqual, id)
+		})
+
+		Convey("merges series of the same type", func() {
+			mergedID := diskStore.meta.NameToID["temp{room=1}"]
+			merged, err := store.Rename(Rename{From: "temp{room=1}", To: "temperature{room=1}"}, false)
+			So(err, ShouldBeNil)
+			So(merged, ShouldBeTrue)
+			expected := []int64{1000, 1005, 1010, 1015, 1020, 1025, 1030, 1035, 1040, 1045, 1050, 1055}
+
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			_, ok := result["temp{room=1}"]
+			So(ok, ShouldBeFalse)
+			So(timestamps(result["temperature{room=1}"]), ShouldResemble, expected)
+			So(timestamps(diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature{room=1}"]), ShouldResemble, expected)
+
+			Convey("and rewrites them with a single id when compacting", func() {
+				var err error
+				diskStore.inListenRoutine(func() {
+					diskStore.commit()
+					files, _ := GetSortedFileList()
+					err = diskStore.compactFiles(files)
+				})
+				So(err, ShouldBeNil)
+				ids := map[int64]bool{}
+				files, err := GetSortedFileList()
+				So(err, ShouldBeNil)
+				for _, file := range files {
+					So(diskStore.readDataFile(file, func(id int64, m Measurement) {
+						ids[id] = true
+					}), ShouldBeNil)
+				}
+				So(ids[mergedID], ShouldBeFalse)
+				So(ids[diskStore.meta.NameToID["temperature{room=1}"]], ShouldBeTrue)
+				So(timestamps(diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature{room=1}"]), ShouldResemble, expected)
+			})
+
+			Convey("and deletes the merged history with the series", func() {
+				store.Delete(Deletion{Name: "temperature", Tags: map[string]string{"room": "1"}, Start: 1000, End: 1020}, false)
+				So(timestamps(store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature{room=1}"]), ShouldResemble, expected[5:])
+			})
+		})
+
+		Convey("doesn't merge series of different types", func() {
+			_, err := store.Rename(Rename{From: "status", To: "temperature{room=1}"}, false)
+			So(err, ShouldNotBeNil)
+			So(diskStore.meta.NameToID["status"], ShouldNotEqual, 0)
+			_, err = store.Rename(Rename{From: "humidity", To: "temperature{room=1}"}, false)
+			So(err, ShouldEqual, errSeriesNotFound)
+			So(store.matchingSeriesKeys(FilterDefinition{}), ShouldResemble, []string{"status", "temperature{room=1}", "temp{room=1}"})
+		})
+
+		Convey("keeps measurements that are added during the rename", func() {
+			doneChan := make(chan struct{})
+			go func() {
+				defer close(doneChan)
+				for ts := int64(2000); ts < 2200; ts++ {
+					store.Add("temp{room=1}", &Numerical{Ts: ts, Value: float64(ts)}, false)
+				}
+			}()
+			_, err := store.Rename(Rename{From: "temp{room=1}", To: "celsius{room=1}"}, false)
+			So(err, ShouldBeNil)
+			<-doneChan
+
+			count := func(result map[string][]Measurement) int {
+				return len(result["temp{room=1}"]) + len(result["celsius{room=1}"])
+			}
+			So(count(store.GetMeasurementsInTimeRange(2000, 3000, FilterDefinition{})), ShouldEqual, 200)
+			So(count(diskStore.GetMeasurementsInTimeRange(2000, 3000, FilterDefinition{})), ShouldEqual, 200)
+		})
+
+		Convey("replicates renames", func() {
+			replication, err := NewReplication("127.0.0.1:1", FilterDefinition{}, NewPools(store), 1024*1024)
+			So(err, ShouldBeNil)
+			defer replication.Shutdown()
+			store.AddReplication(replication)
+
+			_, err = store.Rename(Rename{From: "temp{room=1}", To: "celsius{room=1}"}, false)
+			So(err, ShouldBeNil)
+			pending := replication.outbox.pendingAfter(0)
+			So(len(pending), ShouldEqual, 1)
+			So(isRenameMessage(pending[0].message), ShouldBeTrue)
+
+			replica := NewStore(100 * 1024 * 1024)
+			defer replica.Shutdown()
+			pools := NewPools(replica)
+			handler := NewTCPHandler(&Server{store: replica, pools: pools}, 0, pools)
+			replica.Add("temp{room=1}", &Numerical{Ts: 1000, Value: 1}, true)
+			handler.onNewMessage(pending[0].message, true)
+			So(replica.matchingSeriesKeys(FilterDefinition{}), ShouldResemble, []string{"celsius{room=1}"})
+		})
+	})
+}
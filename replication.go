@@ -3,29 +3,58 @@ package mhist
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
-//Replication is a wrapper for tcp.Client, that implements the subscriber interface
+//Replication queues measurements for another mhist instance in a persistent outbox, that implements the subscriber interface
 type Replication struct {
-	client *TCPClient
-	pools  *Pools
+	outbox      *replicationOutbox
+	pools       *Pools
+	filter      *FilterCollection
+	filterMutex sync.Mutex
 }
 
-//NewReplication creates the underlying tcp.Client correctly
-func NewReplication(address string, pools *Pools) *Replication {
+//replicationEnvelope wraps every replicated message with its sequence number of the outbox
+type replicationEnvelope struct {
+	Seq     uint64          `json:"seq"`
+	Message json.RawMessage `json:"message"`
+}
+
+//replicationAck is sent back by the receiving instance once the message with the sequence number Ack is stored.
+//Error describes what the receiving instance rejected of the message
+type replicationAck struct {
+	Ack   uint64 `json:"ack"`
+	Error string `json:"error,omitempty"`
+}
+
+//NewReplication opens the outbox for address and starts delivering it, only series matching names and tags of the filterDefinition are replicated.
+//The outbox drops its oldest messages once it holds more than maxOutboxSize bytes
+func NewReplication(address string, filterDefinition FilterDefinition, pools *Pools, maxOutboxSize int) (*Replication, error) {
+	outbox, err := openReplicationOutbox(address, int64(maxOutboxSize))
+	if err != nil {
+		return nil, err
+	}
 	return &Replication{
-		client: NewReplicatorClient(address),
+		outbox: outbox,
 		pools:  pools,
-	}
+		filter: NewFilterCollection(FilterDefinition{Names: filterDefinition.Names, Tags: filterDefinition.Tags}),
+	}, nil
 }
 
 //Notify replication about new measurement
 func (r *Replication) Notify(name string, measurement Measurement) {
+	r.filterMutex.Lock()
+	matches := r.filter.Matches(name)
+	r.filterMutex.Unlock()
+	if !matches {
+		return
+	}
+
 	message := r.pools.GetMessage()
 	defer r.pools.PutMessage(message)
 
 	message.Reset()
-	message.Name = name
+	message.SetSeriesKey(name)
 	message.Value = measurement.ValueInterface()
 	message.Timestamp = measurement.Timestamp()
 
@@ -34,6 +63,18 @@ func (r *Replication) Notify(name string, measurement Measurement) {
 		fmt.Println(err)
 		return
 	}
-	go r.client.Write(byteSlice)
+	err = r.outbox.enqueue(byteSlice)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//Status of the outbox
+func (r *Replication) Status() ReplicationStatus {
+	return r.outbox.status()
+}
 
+//Shutdown delivery, the outbox is persisted and resumed on the next start
+func (r *Replication) Shutdown() {
+	r.outbox.shutdown()
 }
@@ -0,0 +1,221 @@
+package mhist
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+//RetentionRule keeps the measurements of all series whose name matches Pattern for MaxAge.
+//Pattern is either a name or a shell pattern like "alarm.*", MaxAge is a duration like "168h"
+type RetentionRule struct {
+	Pattern string `json:"pattern"`
+	MaxAge  string `json:"max_age"`
+}
+
+//Validate the rule
+func (r RetentionRule) Validate() error {
+	if r.Pattern == "" {
+		return errors.New("pattern can't be empty")
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%v': %v", r.Pattern, err)
+	}
+	maxAge, err := time.ParseDuration(r.MaxAge)
+	if err != nil {
+		return err
+	}
+	if maxAge <= 0 {
+		return errors.New("max_age has to be positive")
+	}
+	return nil
+}
+
+//Matches is true if the rule applies to the series with the name
+func (r RetentionRule) Matches(name string) bool {
+	matches, err := path.Match(r.Pattern, name)
+	return err == nil && matches
+}
+
+//SetRetentionRule adds the rule, or replaces the rule with the same pattern
+func (m *DiskMeta) SetRetentionRule(rule RetentionRule) error {
+	err := rule.Validate()
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	for index, existingRule := range m.RetentionRules {
+		if existingRule.Pattern == rule.Pattern {
+			m.RetentionRules[index] = rule
+			m.sync()
+			return nil
+		}
+	}
+	m.RetentionRules = append(m.RetentionRules, rule)
+	m.sync()
+	return nil
+}
+
+//RemoveRetentionRule with the pattern, returns false if there was none
+func (m *DiskMeta) RemoveRetentionRule(pattern string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	for index, rule := range m.RetentionRules {
+		if rule.Pattern == pattern {
+			m.RetentionRules = append(m.RetentionRules[:index], m.RetentionRules[index+1:]...)
+			m.sync()
+			return true
+		}
+	}
+	return false
+}
+
+//GetRetentionRules from meta
+func (m *DiskMeta) GetRetentionRules() []RetentionRule {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]RetentionRule{}, m.RetentionRules...)
+}
+
+//retentionCutoffs returns the timestamp per series id before which its measurements are expired.
+//A series is kept by the first rule that matches its name, series without a matching rule are not in the map
+func (m *DiskMeta) retentionCutoffs(now int64) map[int64]int64 {
+	m.RLock()
+	defer m.RUnlock()
+
+	cutoffs := map[int64]int64{}
+	if len(m.RetentionRules) == 0 {
+		return cutoffs
+	}
+	//merged series and earlier versions of a series have ids of their own, that point to its key as well
+	for id, key := range m.IDToName {
+		name := NameOfSeriesKey(key)
+		for _, rule := range m.RetentionRules {
+			if !rule.Matches(name) {
+				continue
+			}
+			maxAge, err := time.ParseDuration(rule.MaxAge)
+			if err == nil {
+				cutoffs[id] = now - maxAge.Nanoseconds()
+			}
+			break
+		}
+	}
+	return cutoffs
+}
+
+//GetRetentionRules from meta
+func (s *DiskStore) GetRetentionRules() []RetentionRule {
+	return s.meta.GetRetentionRules()
+}
+
+//SetRetentionRule in meta, it is enforced with the next run of the retention job
+func (s *DiskStore) SetRetentionRule(rule RetentionRule) error {
+	return s.meta.SetRetentionRule(rule)
+}
+
+//RemoveRetentionRule from meta
+func (s *DiskStore) RemoveRetentionRule(pattern string) bool {
+	return s.meta.RemoveRetentionRule(pattern)
+}
+
+//enforceRetention drops data and rollup files that only contain expired measurements and rewrites the ones that contain some.
+//Buckets of rollups are dropped once they start before the cutoff
+func (s *DiskStore) enforceRetention(now int64) {
+	cutoffs := s.meta.retentionCutoffs(now)
+	if len(cutoffs) == 0 {
+		return
+	}
+	var latestCutoff int64
+	for _, cutoff := range cutoffs {
+		if cutoff > latestCutoff {
+			latestCutoff = cutoff
+		}
+	}
+
+	files, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, file := range files {
+		if file.oldestTs >= latestCutoff || s.isPinned(file.name) {
+			continue
+		}
+		err := s.rewriteDataFile(file, func(id int64, m Measurement) bool {
+			cutoff, ok := cutoffs[id]
+			return !ok || m.Timestamp() >= cutoff
+		})
+		if err != nil {
+			fmt.Println(file.name, err)
+		}
+	}
+
+	rollupFiles, err := getSortedRollupFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	expired := tombstones{}
+	for id, cutoff := range cutoffs {
+		expired = append(expired, Tombstone{ID: id, Start: math.MinInt64, End: cutoff - 1})
+	}
+	for _, file := range rollupFiles {
+		if file.oldestTs >= latestCutoff {
+			continue
+		}
+		err := rewriteRollupFile(file, expired, s.meta)
+		if err != nil {
+			fmt.Println(file.name, err)
+		}
+	}
+}
+
+//rewriteDataFile with only the measurements keep returns true for. The file is removed if nothing is kept and left untouched if everything is.
+//The rewritten file is completely written before the old one is removed, so a crash in between leaves duplicates instead of losing measurements.
+//If another data file already has the name of the rewritten file, it isn't rewritten until compaction merged them
+func (s *DiskStore) rewriteDataFile(file *FileInfo, keep func(id int64, m Measurement) bool) error {
+	block := NewBlock()
+	removed := 0
+	collect := func(id int64, m Measurement) {
+		if keep(id, m) {
+			block.Add(id, m)
+		} else {
+			removed++
+		}
+	}
+
+	err := s.readDataFile(file, collect)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return nil
+	}
+
+	if block.Len() == 0 {
+		return removeDataFile(file.name)
+	}
+	newName := fileNameFromTs(block.OldestTs(), block.LatestTs())
+	if _, err := os.Stat(filepath.Join(dataPath, newName)); err == nil && newName != file.name {
+		return fmt.Errorf("%v already exists", newName)
+	}
+	err = writeFileAtomically(filepath.Join(dataPath, newName), append(append(append([]byte{}, blockFileHeader...), s.meta.encodeSchema(block.ids)...), block.encode()...))
+	if err != nil {
+		return err
+	}
+	if newName != file.name {
+		err = removeDataFile(file.name)
+		if err != nil {
+			return err
+		}
+	}
+	return sealDataFile(newName)
+}
@@ -0,0 +1,143 @@
+package mhist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_RetentionRules(t *testing.T) {
+	Convey("retention rules", t, func() {
+		withTempDataPath(t)
+
+		meta := NewDiskMeta()
+		vibrationID, _ := meta.GetOrCreateID("vibration", MeasurementNumerical)
+		doorID, _ := meta.GetOrCreateID(SeriesKey("alarm.door", map[string]string{"site": "berlin"}), MeasurementCategorical)
+		otherID, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+
+		Convey("are validated", func() {
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "", MaxAge: "1h"}), ShouldNotBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "[", MaxAge: "1h"}), ShouldNotBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "soon"}), ShouldNotBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "-1h"}), ShouldNotBeNil)
+			So(meta.GetRetentionRules(), ShouldBeEmpty)
+		})
+
+		Convey("are replaced per pattern, persisted and applied by the first matching rule", func() {
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "2h"}), ShouldBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "alarm.*", MaxAge: "5h"}), ShouldBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "*", MaxAge: "100h"}), ShouldBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "1h"}), ShouldBeNil)
+			So(len(InitMetaFromDisk().GetRetentionRules()), ShouldEqual, 3)
+
+			now := (200 * time.Hour).Nanoseconds()
+			cutoffs := meta.retentionCutoffs(now)
+			So(cutoffs[vibrationID], ShouldEqual, now-time.Hour.Nanoseconds())
+			So(cutoffs[doorID], ShouldEqual, now-(5*time.Hour).Nanoseconds())
+			So(cutoffs[otherID], ShouldEqual, now-(100*time.Hour).Nanoseconds())
+
+			So(meta.RemoveRetentionRule("*"), ShouldBeTrue)
+			So(meta.RemoveRetentionRule("*"), ShouldBeFalse)
+			_, ok := meta.retentionCutoffs(now)[otherID]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("drop and rewrite data files with expired measurements", func() {
+			hour := time.Hour.Nanoseconds()
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "1h"}), ShouldBeNil)
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "alarm.*", MaxAge: "5h"}), ShouldBeNil)
+
+			expiredBlock := NewBlock()
+			expiredBlock.Add(vibrationID, &Numerical{Ts: 1 * hour, Value: 1})
+			expiredBlock.Add(doorID, &Categorical{Ts: 2 * hour, Value: "open"})
+			So(WriteBlockToFile(expiredBlock, nil, nil), ShouldBeNil)
+			mixedBlock := NewBlock()
+			mixedBlock.Add(otherID, &Numerical{Ts: 3 * hour, Value: 20})
+			mixedBlock.Add(vibrationID, &Numerical{Ts: 4 * hour, Value: 2})
+			mixedBlock.Add(doorID, &Categorical{Ts: 6 * hour, Value: "closed"})
+			mixedBlock.Add(vibrationID, &Numerical{Ts: 9*hour + hour/2, Value: 3})
+			So(WriteBlockToFile(mixedBlock, nil, nil), ShouldBeNil)
+
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			diskStore.Shutdown()
+			diskStore.enforceRetention(10 * hour)
+
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			So(files[0].name, ShouldEqual, fileNameFromTs(3*hour, 9*hour+hour/2))
+
+			result := diskStore.takeSnapshot(0, 10*hour).read(FilterDefinition{})
+			So(len(result["vibration"]), ShouldEqual, 1)
+			So(result["vibration"][0].Timestamp(), ShouldEqual, 9*hour+hour/2)
+			So(len(result["alarm.door{site=berlin}"]), ShouldEqual, 1)
+			So(len(result["temperature"]), ShouldEqual, 1)
+		})
+
+		Convey("don't replace another data file with the rewritten one", func() {
+			hour := time.Hour.Nanoseconds()
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "1h"}), ShouldBeNil)
+
+			block := NewBlock()
+			block.Add(vibrationID, &Numerical{Ts: 1 * hour, Value: 1})
+			block.Add(otherID, &Numerical{Ts: 3 * hour, Value: 2})
+			block.Add(otherID, &Numerical{Ts: 5 * hour, Value: 3})
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+			clashingBlock := NewBlock()
+			clashingBlock.Add(otherID, &Numerical{Ts: 3 * hour, Value: 4})
+			clashingBlock.Add(otherID, &Numerical{Ts: 5 * hour, Value: 5})
+			So(WriteBlockToFile(clashingBlock, nil, nil), ShouldBeNil)
+
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			diskStore.Shutdown()
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(diskStore.rewriteDataFile(files.byName(fileNameFromTs(1*hour, 5*hour)), func(id int64, m Measurement) bool {
+				return id != vibrationID
+			}), ShouldNotBeNil)
+
+			result := diskStore.takeSnapshot(0, 10*hour).read(FilterDefinition{})
+			So(len(result["vibration"]), ShouldEqual, 1)
+			So(len(result["temperature"]), ShouldEqual, 4)
+		})
+
+		Convey("drop the expired buckets of rollups", func() {
+			hour := time.Hour.Nanoseconds()
+			So(meta.SetRetentionRule(RetentionRule{Pattern: "vibration", MaxAge: "5h"}), ShouldBeNil)
+
+			block := NewBlock()
+			block.Add(vibrationID, &Numerical{Ts: 1 * hour, Value: 1})
+			block.Add(vibrationID, &Numerical{Ts: 6 * hour, Value: 2})
+			block.Add(otherID, &Numerical{Ts: 1 * hour, Value: 3})
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024, RollupAfter: time.Hour, RollupResolution: time.Hour})
+			So(err, ShouldBeNil)
+			diskStore.Shutdown()
+			diskStore.rollupAgedFiles(8 * hour)
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(files, ShouldBeEmpty)
+
+			diskStore.enforceRetention(10 * hour)
+			rollupFiles, err := getSortedRollupFileList()
+			So(err, ShouldBeNil)
+			So(len(rollupFiles), ShouldEqual, 1)
+			osFile, err := os.Open(filepath.Join(dataPath, rollupFiles[0].name))
+			So(err, ShouldBeNil)
+			defer osFile.Close()
+			bucketStarts := map[int64][]int64{}
+			So(readRollupFile(osFile, func(id int64, series *rollupSeries) {
+				for _, bucket := range series.buckets {
+					bucketStarts[id] = append(bucketStarts[id], bucket.start)
+				}
+			}), ShouldBeNil)
+			So(bucketStarts, ShouldResemble, map[int64][]int64{vibrationID: {6 * hour}, otherID: {1 * hour}})
+		})
+	})
+}
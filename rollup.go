@@ -0,0 +1,505 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//Data files older than the rollup age are compacted into rollup files in rollupDirectory, with the name of the data file they were made from.
+//A rollup file starts with rollupFileMagic followed by the format version and contains frames of the same kinds as data files, a schemaFrame followed by a dataFrame:
+//<uvarint series count> and per series <varint id><uvarint type><uvarint bucket count> followed by the buckets.
+//Every bucket is <varint start><uvarint count> and for numerical series <first><last><min><max><sum> as float64 bits,
+//for categorical series <uvarint length><first><uvarint length><last><uvarint transitions>
+const rollupFileMagic = "MHSR"
+
+const rollupFormatVersion = 2
+
+const rollupFileExtension = ".rollup"
+
+var rollupDirectory = "rollup"
+
+var rollupFileHeader = append([]byte(rollupFileMagic), rollupFormatVersion)
+
+//rollupBucket summarizes all measurements of a series in a time bucket
+type rollupBucket struct {
+	start int64
+	count int64
+
+	first float64
+	last  float64
+	min   float64
+	max   float64
+	sum   float64
+
+	firstValue  string
+	lastValue   string
+	transitions int64
+}
+
+type rollupSeries struct {
+	measurementType MeasurementType
+	buckets         []*rollupBucket
+}
+
+//rollup holds the buckets per series id
+type rollup struct {
+	series map[int64]*rollupSeries
+	ids    []int64
+}
+
+func newRollup() *rollup {
+	return &rollup{series: map[int64]*rollupSeries{}}
+}
+
+//add m to the bucket of the resolution it belongs to, the buckets are kept sorted even if measurements are added out of order
+func (r *rollup) add(id int64, m Measurement, resolution time.Duration) {
+	series := r.series[id]
+	if series == nil {
+		series = &rollupSeries{measurementType: m.Type()}
+		r.series[id] = series
+		r.ids = append(r.ids, id)
+	}
+	start := alignToBucket(m.Timestamp(), resolution)
+	buckets := series.buckets
+	if len(buckets) == 0 || buckets[len(buckets)-1].start < start {
+		series.buckets = append(buckets, &rollupBucket{start: start})
+		buckets = series.buckets
+	}
+	if last := buckets[len(buckets)-1]; last.start == start {
+		last.add(m)
+		return
+	}
+	index := sort.Search(len(buckets), func(i int) bool {
+		return buckets[i].start >= start
+	})
+	if buckets[index].start != start {
+		series.buckets = append(buckets, nil)
+		copy(series.buckets[index+1:], series.buckets[index:])
+		series.buckets[index] = &rollupBucket{start: start}
+	}
+	series.buckets[index].add(m)
+}
+
+func (b *rollupBucket) add(m Measurement) {
+	switch value := m.(type) {
+	case *Numerical:
+		b.merge(&rollupBucket{start: b.start, count: 1, first: value.Value, last: value.Value, min: value.Value, max: value.Value, sum: value.Value})
+	case *Categorical:
+		b.merge(&rollupBucket{start: b.start, count: 1, firstValue: value.Value, lastValue: value.Value})
+	}
+}
+
+//merge a bucket with later measurements into b
+func (b *rollupBucket) merge(later *rollupBucket) {
+	if later.count == 0 {
+		return
+	}
+	if b.count == 0 {
+		start := b.start
+		*b = *later
+		b.start = start
+		return
+	}
+	b.last = later.last
+	b.min = math.Min(b.min, later.min)
+	b.max = math.Max(b.max, later.max)
+	b.sum += later.sum
+	b.transitions += later.transitions
+	if b.lastValue != later.firstValue {
+		b.transitions++
+	}
+	b.lastValue = later.lastValue
+	b.count += later.count
+}
+
+//measurement that represents the bucket for the aggregation, without an aggregation the bucket is represented by its first value.
+//Aggregations that need every single value are approximated: percentiles by the mean for numerical series,
+//mode by the last value and distinct by the amount of transitions for categorical series
+func (b *rollupBucket) measurement(measurementType MeasurementType, aggregation *Aggregation) Measurement {
+	function := "first"
+	if aggregation != nil {
+		function = aggregation.Function
+	}
+	switch function {
+	case "count":
+		return &Numerical{Ts: b.start, Value: float64(b.count)}
+	}
+
+	if measurementType == MeasurementCategorical {
+		switch function {
+		case "first":
+			return &Categorical{Ts: b.start, Value: b.firstValue}
+		case "distinct":
+			distinct := b.transitions + 1
+			if distinct > b.count {
+				distinct = b.count
+			}
+			return &Numerical{Ts: b.start, Value: float64(distinct)}
+		}
+		return &Categorical{Ts: b.start, Value: b.lastValue}
+	}
+
+	value := b.sum / float64(b.count)
+	switch function {
+	case "first", "mode":
+		value = b.first
+	case "last":
+		value = b.last
+	case "min":
+		value = b.min
+	case "max":
+		value = b.max
+	case "sum":
+		value = b.sum
+	case "distinct":
+		value = float64(b.count)
+	}
+	return &Numerical{Ts: b.start, Value: value}
+}
+
+func (r *rollup) encode(schema []byte) []byte {
+	payload := appendUvarint([]byte{dataFrame}, uint64(len(r.ids)))
+	for _, id := range r.ids {
+		series := r.series[id]
+		payload = appendVarint(payload, id)
+		payload = appendUvarint(payload, uint64(series.measurementType))
+		payload = appendUvarint(payload, uint64(len(series.buckets)))
+		for _, bucket := range series.buckets {
+			payload = appendVarint(payload, bucket.start)
+			payload = appendUvarint(payload, uint64(bucket.count))
+			switch series.measurementType {
+			case MeasurementNumerical:
+				for _, value := range []float64{bucket.first, bucket.last, bucket.min, bucket.max, bucket.sum} {
+					valueBytes := make([]byte, 8)
+					binary.BigEndian.PutUint64(valueBytes, math.Float64bits(value))
+					payload = append(payload, valueBytes...)
+				}
+			case MeasurementCategorical:
+				payload = appendUvarint(payload, uint64(len(bucket.firstValue)))
+				payload = append(payload, bucket.firstValue...)
+				payload = appendUvarint(payload, uint64(len(bucket.lastValue)))
+				payload = append(payload, bucket.lastValue...)
+				payload = appendUvarint(payload, uint64(bucket.transitions))
+			}
+		}
+	}
+	return appendFrame(append(append([]byte{}, rollupFileHeader...), schema...), payload)
+}
+
+//decodeRollup calls f for every series in the payload
+func decodeRollup(payload []byte, f func(id int64, series *rollupSeries)) error {
+	reader := bytes.NewReader(payload)
+	seriesCount, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return errCorruptBlock
+	}
+	for i := uint64(0); i < seriesCount; i++ {
+		id, err := binary.ReadVarint(reader)
+		if err != nil {
+			return errCorruptBlock
+		}
+		measurementType, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errCorruptBlock
+		}
+		bucketCount, err := binary.ReadUvarint(reader)
+		if err != nil || bucketCount > uint64(reader.Len()) {
+			return errCorruptBlock
+		}
+		series := &rollupSeries{measurementType: MeasurementType(measurementType), buckets: make([]*rollupBucket, 0, bucketCount)}
+		for j := uint64(0); j < bucketCount; j++ {
+			bucket, err := readRollupBucket(reader, series.measurementType)
+			if err != nil {
+				return err
+			}
+			series.buckets = append(series.buckets, bucket)
+		}
+		f(id, series)
+	}
+	return nil
+}
+
+func readRollupBucket(reader *bytes.Reader, measurementType MeasurementType) (*rollupBucket, error) {
+	bucket := &rollupBucket{}
+	start, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, errCorruptBlock
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, errCorruptBlock
+	}
+	bucket.start = start
+	bucket.count = int64(count)
+
+	switch measurementType {
+	case MeasurementNumerical:
+		values := make([]float64, 5)
+		valueBytes := make([]byte, 8)
+		for index := range values {
+			_, err := io.ReadFull(reader, valueBytes)
+			if err != nil {
+				return nil, errCorruptBlock
+			}
+			values[index] = math.Float64frombits(binary.BigEndian.Uint64(valueBytes))
+		}
+		bucket.first, bucket.last, bucket.min, bucket.max, bucket.sum = values[0], values[1], values[2], values[3], values[4]
+	case MeasurementCategorical:
+		bucket.firstValue, err = readRollupString(reader)
+		if err != nil {
+			return nil, err
+		}
+		bucket.lastValue, err = readRollupString(reader)
+		if err != nil {
+			return nil, err
+		}
+		transitions, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		bucket.transitions = int64(transitions)
+	default:
+		return nil, fmt.Errorf("unknown measurement type %v", measurementType)
+	}
+	return bucket, nil
+}
+
+func readRollupString(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return "", errCorruptBlock
+	}
+	value := make([]byte, length)
+	_, err = io.ReadFull(reader, value)
+	if err != nil {
+		return "", errCorruptBlock
+	}
+	return string(value), nil
+}
+
+//readRollupFile calls f for every series in the rollup file
+func readRollupFile(r io.Reader, f func(id int64, series *rollupSeries)) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(rollupFileHeader))
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(rollupFileMagic)]) != rollupFileMagic {
+		return errors.New("not a rollup file")
+	}
+	if header[len(rollupFileMagic)] > rollupFormatVersion {
+		return fmt.Errorf("unsupported rollup format version %v", header[len(rollupFileMagic)])
+	}
+	return readFrames(reader, header[len(rollupFileMagic)], func(kind byte, payload []byte) error {
+		if kind != dataFrame {
+			return nil
+		}
+		return decodeRollup(payload, f)
+	})
+}
+
+//getSortedRollupFileList gets the FileInfo list for rollup files, their names are relative to dataPath
+func getSortedRollupFileList() (FileInfoSlice, error) {
+	infoList := FileInfoSlice{}
+	files, err := ioutil.ReadDir(filepath.Join(dataPath, rollupDirectory))
+	if os.IsNotExist(err) {
+		return infoList, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != rollupFileExtension {
+			continue
+		}
+		info, err := timestampsFromFileName(f.Name())
+		if err != nil {
+			continue
+		}
+		info.name = filepath.Join(rollupDirectory, f.Name())
+		info.size = f.Size()
+		infoList = append(infoList, info)
+	}
+	sort.Sort(infoList)
+	return infoList, nil
+}
+
+//rollupFileNameFor the data file. Rollups of csv files keep the extension of their data file,
+//so they don't replace the rollup of a binary data file with the same timerange
+func rollupFileNameFor(file *FileInfo) string {
+	name := filepath.Base(file.name)
+	if !file.isCsv() {
+		name = name[:len(name)-len(filepath.Ext(name))]
+	}
+	return filepath.Join(rollupDirectory, name+rollupFileExtension)
+}
+
+//rollupAgedFiles compacts the data files that are older than rollupAfter and drops rollup files older than rollupMaxAge
+func (s *DiskStore) rollupAgedFiles(now int64) {
+	if s.rollupAfter <= 0 {
+		return
+	}
+	files, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, file := range files {
+		if file.latestTs >= now-s.rollupAfter.Nanoseconds() {
+			break
+		}
+		if s.isPinned(file.name) {
+			continue
+		}
+		err := s.rollupFile(file)
+		if err != nil {
+			fmt.Println(file.name, err)
+		}
+	}
+
+	if s.rollupMaxAge <= 0 {
+		return
+	}
+	rollupFiles, err := getSortedRollupFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, file := range rollupFiles {
+		if file.latestTs >= now-s.rollupMaxAge.Nanoseconds() {
+			break
+		}
+		os.Remove(filepath.Join(dataPath, file.name))
+	}
+}
+
+//rollupFile compacts the data file into a rollup file and removes it afterwards
+func (s *DiskStore) rollupFile(file *FileInfo) error {
+	r := newRollup()
+	err := s.readDataFile(file, func(id int64, m Measurement) {
+		r.add(id, m, s.rollupResolution)
+	})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dataPath, rollupDirectory), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(filepath.Join(dataPath, rollupFileNameFor(file)), r.encode(s.meta.encodeSchema(r.ids)))
+	if err != nil {
+		return err
+	}
+	return removeDataFile(file.name)
+}
+
+//openRollupFiles in the timerange, except the ones whose data file wasn't removed after rolling it up, it is still read as raw data.
+//It has to be called on the DiskStore goroutine, the files are read through their handles afterwards, even if they are replaced or removed in the meantime
+func (s *DiskStore) openRollupFiles(start, end int64) []*os.File {
+	files, err := getSortedRollupFileList()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	rawFiles, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	rawFileNames := map[string]bool{}
+	for _, file := range rawFiles {
+		rawFileNames[rollupFileNameFor(file)] = true
+	}
+
+	openFiles := []*os.File{}
+	for _, file := range files {
+		if rawFileNames[file.name] || !file.isInTimeRange(start, end) {
+			continue
+		}
+		osFile, err := os.Open(filepath.Join(dataPath, file.name))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		openFiles = append(openFiles, osFile)
+	}
+	return openFiles
+}
+
+//readRollups of the matching series in the timerange from the open files and close them. The buckets are combined into buckets of the granularity
+//and represented as measurements according to the aggregation
+func (s *DiskStore) readRollups(files []*os.File, deleted tombstones, start, end int64, filterDefinition FilterDefinition) readResult {
+	result := readResult{}
+	aggregation, err := filterDefinition.aggregation()
+	if err != nil {
+		fmt.Println(err)
+	}
+	filter := NewFilterCollection(FilterDefinition{Names: filterDefinition.Names, Tags: filterDefinition.Tags})
+	type seriesBuckets struct {
+		name            string
+		buckets         map[int64]*rollupBucket
+		measurementType MeasurementType
+	}
+	type nameAndType struct {
+		name            string
+		measurementType MeasurementType
+	}
+	//merged series have buckets of several ids, so they are collected per name before they are combined in order.
+	//The versions of a series with different types are collected separately, since their buckets can't be merged
+	bucketsPerName := map[nameAndType]*seriesBuckets{}
+
+	for _, osFile := range files {
+		err := readRollupFile(osFile, func(id int64, series *rollupSeries) {
+			key := s.meta.GetNameForID(id)
+			if key == "" || !filter.Matches(key) {
+				return
+			}
+			name := s.meta.readNameForID(id)
+			current := bucketsPerName[nameAndType{name, series.measurementType}]
+			if current == nil {
+				current = &seriesBuckets{name: name, buckets: map[int64]*rollupBucket{}, measurementType: series.measurementType}
+				bucketsPerName[nameAndType{name, series.measurementType}] = current
+			}
+			for _, bucket := range series.buckets {
+				if bucket.start < start || bucket.start > end || deleted.covers(id, bucket.start) {
+					continue
+				}
+				bucketStart := alignToBucket(bucket.start, filterDefinition.Granularity)
+				if current.buckets[bucketStart] == nil {
+					current.buckets[bucketStart] = &rollupBucket{start: bucketStart}
+				}
+				current.buckets[bucketStart].merge(bucket)
+			}
+		})
+		osFile.Close()
+		if err != nil {
+			fmt.Println(osFile.Name(), err)
+		}
+	}
+	for _, current := range bucketsPerName {
+		starts := make([]int64, 0, len(current.buckets))
+		for bucketStart := range current.buckets {
+			starts = append(starts, bucketStart)
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+		for _, bucketStart := range starts {
+			result[current.name] = append(result[current.name], current.buckets[bucketStart].measurement(current.measurementType, aggregation))
+		}
+	}
+	for name, measurements := range result {
+		sort.SliceStable(measurements, func(i, j int) bool { return measurements[i].Timestamp() < measurements[j].Timestamp() })
+		result[name] = measurements
+	}
+	return result
+}
@@ -0,0 +1,170 @@
+package mhist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_rollup(t *testing.T) {
+	Convey("rollup", t, func() {
+		minute := time.Minute.Nanoseconds()
+
+		Convey("summarizes numerical buckets", func() {
+			r := newRollup()
+			for i, value := range []float64{3, 1, 4, 1, 5} {
+				r.add(1, &Numerical{Ts: int64(i) * 10, Value: value}, time.Minute)
+			}
+			r.add(1, &Numerical{Ts: minute, Value: 9}, time.Minute)
+			buckets := r.series[1].buckets
+			So(len(buckets), ShouldEqual, 2)
+
+			value := func(function string) float64 {
+				aggregation, err := ParseAggregation(function)
+				So(err, ShouldBeNil)
+				return buckets[0].measurement(MeasurementNumerical, aggregation).(*Numerical).Value
+			}
+			So(value("mean"), ShouldEqual, 2.8)
+			So(value("min"), ShouldEqual, 1)
+			So(value("max"), ShouldEqual, 5)
+			So(value("sum"), ShouldEqual, 14)
+			So(value("count"), ShouldEqual, 5)
+			So(value("first"), ShouldEqual, 3)
+			So(value("last"), ShouldEqual, 5)
+			So(buckets[1].measurement(MeasurementNumerical, nil).Timestamp(), ShouldEqual, minute)
+		})
+
+		Convey("counts transitions of categorical buckets, also when they are merged", func() {
+			r := newRollup()
+			for i, value := range []string{"on", "on", "off"} {
+				r.add(1, &Categorical{Ts: int64(i), Value: value}, time.Minute)
+			}
+			for i, value := range []string{"on", "off"} {
+				r.add(1, &Categorical{Ts: minute + int64(i), Value: value}, time.Minute)
+			}
+			merged := &rollupBucket{}
+			for _, bucket := range r.series[1].buckets {
+				merged.merge(bucket)
+			}
+			So(merged.count, ShouldEqual, 5)
+			So(merged.transitions, ShouldEqual, 3)
+			So(merged.measurement(MeasurementCategorical, nil).(*Categorical).Value, ShouldEqual, "on")
+			So(merged.measurement(MeasurementCategorical, &Aggregation{Function: "last"}).(*Categorical).Value, ShouldEqual, "off")
+			So(merged.measurement(MeasurementCategorical, &Aggregation{Function: "distinct"}).(*Numerical).Value, ShouldEqual, 4)
+		})
+
+		Convey("round trips through its encoding", func() {
+			r := newRollup()
+			r.add(1, &Numerical{Ts: 10, Value: 1.5}, time.Minute)
+			r.add(1, &Numerical{Ts: minute, Value: -2}, time.Minute)
+			r.add(2, &Categorical{Ts: 20, Value: "on"}, time.Minute)
+
+			decoded := newRollup()
+			err := readRollupFile(bytes.NewReader(r.encode(nil)), func(id int64, series *rollupSeries) {
+				decoded.series[id] = series
+				decoded.ids = append(decoded.ids, id)
+			})
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, r)
+		})
+	})
+}
+
+func Test_Store_answersCoarseQueriesFromRollups(t *testing.T) {
+	Convey("answers queries with a coarse granularity from rollups", t, func() {
+		withTempDataPath(t)
+
+		minute := time.Minute.Nanoseconds()
+		meta := NewDiskMeta()
+		id, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+		for _, minutes := range [][]int64{{0, 20}, {20, 30}} {
+			block := NewBlock()
+			for i := minutes[0]; i < minutes[1]; i++ {
+				block.Add(id, &Numerical{Ts: i*minute + 1, Value: float64(i)})
+			}
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+		}
+
+		config := DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024, RollupAfter: time.Hour, RollupResolution: time.Minute}
+		diskStore, err := NewDiskStore(NewPools(NewStore(1024)), config)
+		So(err, ShouldBeNil)
+		diskStore.Shutdown()
+		diskStore.rollupAgedFiles(80 * minute)
+
+		files, err := GetSortedFileList()
+		So(err, ShouldBeNil)
+		So(len(files), ShouldEqual, 1)
+		rollupFiles, err := getSortedRollupFileList()
+		So(err, ShouldBeNil)
+		So(len(rollupFiles), ShouldEqual, 1)
+		So(rollupFiles[0].name, ShouldEqual, filepath.Join(rollupDirectory, "1-1140000000001"+rollupFileExtension))
+
+		store := NewStore(1024 * 1024)
+		diskStore, err = NewDiskStore(NewPools(store), config)
+		So(err, ShouldBeNil)
+		defer diskStore.Shutdown()
+		store.SetDiskStore(diskStore)
+
+		values := func(measurements []Measurement) (values []float64) {
+			for _, m := range measurements {
+				values = append(values, m.(*Numerical).Value)
+			}
+			return
+		}
+		means := store.GetMeasurementsInTimeRange(0, 80*minute, FilterDefinition{Granularity: 10 * time.Minute, Aggregate: "mean"})
+		So(values(means["temperature"]), ShouldResemble, []float64{4.5, 14.5, 24.5})
+		So(means["temperature"][1].Timestamp(), ShouldEqual, 10*minute)
+
+		counts := store.GetMeasurementsInTimeRange(0, 80*minute, FilterDefinition{Granularity: 10 * time.Minute, Aggregate: "count"})
+		So(values(counts["temperature"]), ShouldResemble, []float64{10, 10, 10})
+
+		samples := store.GetMeasurementsInTimeRange(0, 80*minute, FilterDefinition{Granularity: 10 * time.Minute})
+		So(values(samples["temperature"]), ShouldResemble, []float64{0, 10, 20})
+
+		raw := store.GetMeasurementsInTimeRange(0, 80*minute, FilterDefinition{Granularity: time.Second})
+		So(len(raw["temperature"]), ShouldEqual, 10)
+	})
+}
+
+func Test_DiskStore_rollupFiles(t *testing.T) {
+	Convey("rollup files", t, func() {
+		dir := withTempDataPath(t)
+
+		Convey("of csv and binary data files with the same timerange don't replace each other", func() {
+			So(rollupFileNameFor(&FileInfo{name: "1-2.mhist"}), ShouldEqual, filepath.Join(rollupDirectory, "1-2"+rollupFileExtension))
+			So(rollupFileNameFor(&FileInfo{name: "1-2.csv"}), ShouldEqual, filepath.Join(rollupDirectory, "1-2.csv"+rollupFileExtension))
+		})
+
+		Convey("count toward the disk size", func() {
+			diskStore, err := NewDiskStore(NewPools(NewStore(1024)), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 100, RollupAfter: time.Hour})
+			So(err, ShouldBeNil)
+			diskStore.Shutdown()
+
+			So(os.MkdirAll(filepath.Join(dir, rollupDirectory), os.ModePerm), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, rollupDirectory, "1-2"+rollupFileExtension), make([]byte, 60), 0600), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, rollupDirectory, "3-4"+rollupFileExtension), make([]byte, 20), 0600), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(dir, "5-6.csv"), make([]byte, 40), 0600), ShouldBeNil)
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+
+			diskStore.freeDiskSpace(files)
+			rollupFiles, err := getSortedRollupFileList()
+			So(err, ShouldBeNil)
+			So(len(rollupFiles), ShouldEqual, 1)
+			So(rollupFiles[0].name, ShouldEqual, filepath.Join(rollupDirectory, "3-4"+rollupFileExtension))
+			files, err = GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+
+			diskStore.freeDiskSpace(files)
+			files, err = GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+		})
+	})
+}
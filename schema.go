@@ -0,0 +1,175 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//A schemaFrame makes data and rollup files self-describing, so the meta can be rebuilt from them if meta.json is lost:
+//<uvarint entry count> and per series <varint id><uvarint type><uvarint flags><uvarint key length><key>.
+//The canonicalSchemaFlag is set if the series key refers to the id, instead of the id being merged into another series
+const canonicalSchemaFlag = 1
+
+type schemaEntry struct {
+	id              int64
+	measurementType MeasurementType
+	key             string
+	canonical       bool
+}
+
+//encodeSchema frame of the ids, ids without a series key are left out. A nil meta encodes no schema
+func (m *DiskMeta) encodeSchema(ids []int64) []byte {
+	if m == nil {
+		return nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+
+	entries := 0
+	payload := []byte{}
+	for _, id := range ids {
+		key := m.IDToName[id]
+		if key == "" {
+			continue
+		}
+		flags := uint64(0)
+		if m.NameToID[key] == id {
+			flags |= canonicalSchemaFlag
+		}
+		payload = appendVarint(payload, id)
+		payload = appendUvarint(payload, uint64(m.IDToType[id]))
+		payload = appendUvarint(payload, flags)
+		payload = appendUvarint(payload, uint64(len(key)))
+		payload = append(payload, key...)
+		entries++
+	}
+	if entries == 0 {
+		return nil
+	}
+	return appendFrame(nil, append(appendUvarint([]byte{schemaFrame}, uint64(entries)), payload...))
+}
+
+func decodeSchema(payload []byte, f func(entry schemaEntry)) error {
+	reader := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return errCorruptBlock
+	}
+	for i := uint64(0); i < count; i++ {
+		entry := schemaEntry{}
+		entry.id, err = binary.ReadVarint(reader)
+		if err != nil {
+			return errCorruptBlock
+		}
+		measurementType, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errCorruptBlock
+		}
+		entry.measurementType = MeasurementType(measurementType)
+		flags, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errCorruptBlock
+		}
+		entry.canonical = flags&canonicalSchemaFlag != 0
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return errCorruptBlock
+		}
+		key := make([]byte, length)
+		_, err = io.ReadFull(reader, key)
+		if err != nil {
+			return errCorruptBlock
+		}
+		entry.key = string(key)
+		f(entry)
+	}
+	return nil
+}
+
+//readSchema calls f for every schema entry of the binary data or rollup file at path.
+//Files written before frameKindsVersion have no schema
+func readSchema(path string, f func(entry schemaEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(blockFileHeader))
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	magic := string(header[:len(blockFileMagic)])
+	if magic != blockFileMagic && magic != rollupFileMagic {
+		return errors.New("neither a binary data file nor a rollup file")
+	}
+	return readFrames(reader, header[len(blockFileMagic)], func(kind byte, payload []byte) error {
+		if kind != schemaFrame {
+			return nil
+		}
+		return decodeSchema(payload, f)
+	})
+}
+
+//rebuildMeta from the schemas of the rollup and data files, read from the oldest to the latest one, so the latest series key of an id wins.
+//Retention rules, schema rules, type histories and tombstones can't be rebuilt, neither can series that were only written to files without a schema.
+//So renames and merges are undone until the series was written again under its new key, and deleted series whose measurements weren't purged yet come back.
+//Returns nil if there are no files to rebuild from
+func rebuildMeta() (*DiskMeta, error) {
+	rollupFiles, err := getSortedRollupFileList()
+	if err != nil {
+		return nil, err
+	}
+	files, err := GetSortedFileList()
+	if err != nil {
+		return nil, err
+	}
+	if len(rollupFiles) == 0 && len(files) == 0 {
+		return nil, nil
+	}
+
+	meta := NewDiskMeta()
+	canonicalIDs := map[string]int64{}
+	add := func(entry schemaEntry) {
+		meta.IDToName[entry.id] = entry.key
+		meta.IDToType[entry.id] = entry.measurementType
+		if entry.canonical {
+			canonicalIDs[entry.key] = entry.id
+		}
+		if entry.id > meta.HighestID {
+			meta.HighestID = entry.id
+		}
+	}
+	for _, file := range append(rollupFiles, files...) {
+		if file.isCsv() {
+			continue
+		}
+		err := readSchema(filepath.Join(dataPath, file.name), add)
+		if err != nil {
+			fmt.Println("couldn't read the schema of", file.name, ":", err)
+		}
+	}
+	for key, id := range canonicalIDs {
+		if meta.IDToName[id] == key {
+			meta.NameToID[key] = id
+		}
+	}
+	//series that are only known as merged ones keep their latest id
+	fallbackIDs := map[string]int64{}
+	for id, key := range meta.IDToName {
+		if meta.NameToID[key] == 0 && id > fallbackIDs[key] {
+			fallbackIDs[key] = id
+		}
+	}
+	for key, id := range fallbackIDs {
+		meta.NameToID[key] = id
+	}
+	return meta, nil
+}
@@ -0,0 +1,302 @@
+package mhist
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+//SchemaMode decides what happens to a measurement whose type differs from the type its series had so far
+type SchemaMode string
+
+const (
+	//SchemaStrict rejects the measurement, it is the mode of all series without a matching schema rule
+	SchemaStrict SchemaMode = "strict"
+
+	//SchemaVersioned starts a new version of the series with the new type, the earlier versions stay readable under the same name
+	SchemaVersioned SchemaMode = "versioned"
+)
+
+//SchemaRule sets the mode for all series whose name matches Pattern.
+//Pattern is either a name or a shell pattern like "status.*"
+type SchemaRule struct {
+	Pattern string     `json:"pattern"`
+	Mode    SchemaMode `json:"mode"`
+}
+
+//TypeVersion of a series. Since is the timestamp of the first measurement of the version, it is 0 for the initial one
+type TypeVersion struct {
+	ID    int64           `json:"id"`
+	Type  MeasurementType `json:"type"`
+	Since int64           `json:"since,omitempty"`
+}
+
+//TypeRejection counts the measurements of a series that were rejected because of their type, Error and At are the ones of the latest rejection
+type TypeRejection struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+	At    int64  `json:"at"`
+}
+
+//Validate the rule
+func (r SchemaRule) Validate() error {
+	if r.Pattern == "" {
+		return errors.New("pattern can't be empty")
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%v': %v", r.Pattern, err)
+	}
+	if r.Mode != SchemaStrict && r.Mode != SchemaVersioned {
+		return fmt.Errorf("unknown mode '%v', it has to be %v or %v", r.Mode, SchemaStrict, SchemaVersioned)
+	}
+	return nil
+}
+
+//Matches is true if the rule applies to the series with the name
+func (r SchemaRule) Matches(name string) bool {
+	matches, err := path.Match(r.Pattern, name)
+	return err == nil && matches
+}
+
+//SetSchemaRule adds the rule, or replaces the rule with the same pattern
+func (m *DiskMeta) SetSchemaRule(rule SchemaRule) error {
+	err := rule.Validate()
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	for index, existingRule := range m.SchemaRules {
+		if existingRule.Pattern == rule.Pattern {
+			m.SchemaRules[index] = rule
+			m.sync()
+			return nil
+		}
+	}
+	m.SchemaRules = append(m.SchemaRules, rule)
+	m.sync()
+	return nil
+}
+
+//RemoveSchemaRule with the pattern, returns false if there was none
+func (m *DiskMeta) RemoveSchemaRule(pattern string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	for index, rule := range m.SchemaRules {
+		if rule.Pattern == pattern {
+			m.SchemaRules = append(m.SchemaRules[:index], m.SchemaRules[index+1:]...)
+			m.sync()
+			return true
+		}
+	}
+	return false
+}
+
+//GetSchemaRules from meta
+func (m *DiskMeta) GetSchemaRules() []SchemaRule {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]SchemaRule{}, m.SchemaRules...)
+}
+
+//schemaMode of the series, decided by the first rule that matches its name. The caller has to hold the lock
+func (m *DiskMeta) schemaMode(key string) SchemaMode {
+	name := NameOfSeriesKey(key)
+	for _, rule := range m.SchemaRules {
+		if rule.Matches(name) {
+			return rule.Mode
+		}
+	}
+	return SchemaStrict
+}
+
+//acceptType of a measurement with the timestamp ts for the series and return the id it is stored with.
+//If the series has another type, the measurement is rejected in strict mode. In versioned mode the series gets a new id with the new type,
+//or the id of its earlier version with that type, while the ids of the other versions keep pointing to the series, so their history is read as part of it
+func (m *DiskMeta) acceptType(key string, t MeasurementType, ts int64) (int64, error) {
+	m.RLock()
+	id := m.NameToID[key]
+	savedType := m.IDToType[id]
+	m.RUnlock()
+	if id == 0 {
+		return m.GetOrCreateID(key, t)
+	}
+	if savedType == t {
+		return id, nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	//Check again, the type might have changed in parallel
+	id = m.NameToID[key]
+	savedType = m.IDToType[id]
+	if savedType == t {
+		return id, nil
+	}
+	if m.schemaMode(key) != SchemaVersioned {
+		err := fmt.Errorf("%v has type %v but was provided %v", key, savedType, t)
+		m.reject(key, err)
+		return 0, err
+	}
+
+	history := m.TypeHistory[key]
+	if len(history) == 0 {
+		history = []TypeVersion{{ID: id, Type: savedType}}
+	}
+	versionID := m.versionID(key, t)
+	if versionID == 0 {
+		m.HighestID++
+		versionID = m.HighestID
+		m.IDToName[versionID] = key
+		m.IDToType[versionID] = t
+	}
+	m.NameToID[key] = versionID
+	if m.TypeHistory == nil {
+		m.TypeHistory = map[string][]TypeVersion{}
+	}
+	m.TypeHistory[key] = append(history, TypeVersion{ID: versionID, Type: t, Since: ts})
+	m.sync()
+	return versionID, nil
+}
+
+//versionID is the id of the latest version of the series with the type, 0 if it never had that type. The caller has to hold the lock
+func (m *DiskMeta) versionID(key string, t MeasurementType) int64 {
+	var id int64
+	for _, version := range m.TypeHistory[key] {
+		if version.Type == t && m.IDToName[version.ID] == key {
+			id = version.ID
+		}
+	}
+	return id
+}
+
+//reject counts the rejected measurement of the series, it is written with the next syncIfDirty. The caller has to hold the lock
+func (m *DiskMeta) reject(key string, err error) {
+	if m.Rejections == nil {
+		m.Rejections = map[string]*TypeRejection{}
+	}
+	rejection := m.Rejections[key]
+	if rejection == nil {
+		rejection = &TypeRejection{}
+		m.Rejections[key] = rejection
+	}
+	rejection.Error = err.Error()
+	rejection.Count++
+	rejection.At = time.Now().UnixNano()
+	m.dirty = true
+}
+
+//versionName of an earlier version of the series with another type than its current one, it is read as a series of its own
+func versionName(key string, t MeasurementType) string {
+	return key + "@" + t.String()
+}
+
+//readName of the series id, its key or the versionName if it is an earlier version with another type. The caller has to hold the lock
+func (m *DiskMeta) readName(id int64) string {
+	key := m.IDToName[id]
+	if len(m.TypeHistory[key]) == 0 {
+		return key
+	}
+	if t := m.IDToType[id]; t != m.IDToType[m.NameToID[key]] {
+		return versionName(key, t)
+	}
+	return key
+}
+
+//readNameForID is the name the measurements of the series id are read with, see readName
+func (m *DiskMeta) readNameForID(id int64) string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.readName(id)
+}
+
+//versionTypes are the types of the earlier versions of the series with another type than the current one, per versionName
+func (m *DiskMeta) versionTypes(key string) map[string]MeasurementType {
+	m.RLock()
+	defer m.RUnlock()
+
+	currentType := m.IDToType[m.NameToID[key]]
+	types := map[string]MeasurementType{}
+	for _, version := range m.TypeHistory[key] {
+		if version.Type != currentType && m.IDToName[version.ID] == key {
+			types[versionName(key, version.Type)] = version.Type
+		}
+	}
+	return types
+}
+
+//seriesKeyOf the name a series was read with, the key of an earlier version is its versionName
+func (m *DiskMeta) seriesKeyOf(name string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	if _, ok := m.NameToID[name]; ok {
+		return name
+	}
+	for _, t := range []MeasurementType{MeasurementNumerical, MeasurementCategorical} {
+		key := strings.TrimSuffix(name, "@"+t.String())
+		if key != name && len(m.TypeHistory[key]) > 0 {
+			return key
+		}
+	}
+	return name
+}
+
+//currentType of the series, 0 if it doesn't exist
+func (m *DiskMeta) currentType(key string) MeasurementType {
+	m.RLock()
+	defer m.RUnlock()
+	return m.IDToType[m.NameToID[key]]
+}
+
+//GetSchemaRules from meta
+func (s *DiskStore) GetSchemaRules() []SchemaRule {
+	return s.meta.GetSchemaRules()
+}
+
+//SetSchemaRule in meta, it applies to the next measurement with another type
+func (s *DiskStore) SetSchemaRule(rule SchemaRule) error {
+	return s.meta.SetSchemaRule(rule)
+}
+
+//RemoveSchemaRule from meta
+func (s *DiskStore) RemoveSchemaRule(pattern string) bool {
+	return s.meta.RemoveSchemaRule(pattern)
+}
+
+//acceptType of the measurement for the series, see DiskMeta.acceptType. Without a disk store, series keep the type they were created with
+func (s *Store) acceptType(key string, m Measurement) error {
+	if s.diskStore == nil {
+		if series := s.loadSeries(key); series != nil && series.Type() != m.Type() {
+			return fmt.Errorf("%v has type %v but was provided %v", key, series.Type(), m.Type())
+		}
+		return nil
+	}
+	_, err := s.diskStore.meta.acceptType(key, m.Type(), m.Timestamp())
+	return err
+}
+
+//seriesFor the measurement. If the series in memory has another type, but the type of the measurement is the current type of the series on disk,
+//a new version of the series was started, so the series in memory is replaced. Its older measurements are read from disk from then on
+func (s *Store) seriesFor(key string, m Measurement) *Series {
+	series := s.GetSeries(key, m.Type())
+	if series.Type() == m.Type() || s.diskStore == nil || s.diskStore.meta.currentType(key) != m.Type() {
+		return series
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	//Make sure the series wasn't replaced in parallel
+	if current := s.loadSeries(key); current != nil && current != series {
+		return current
+	}
+	createdSeries := NewSeries(m.Type())
+	s.seriesMap.Store(key, createdSeries)
+	series.Shutdown()
+	return createdSeries
+}
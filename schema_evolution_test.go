@@ -0,0 +1,142 @@
+package mhist
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SchemaEvolution(t *testing.T) {
+	Convey("a measurement with another type than its series", t, func() {
+		withTempDataPath(t)
+
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		diskStore, err := NewDiskStore(pools, DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		server := &Server{store: store, pools: pools}
+		defer diskStore.Shutdown()
+		defer store.Shutdown()
+
+		publish := func(message string) (err error, status int) {
+			server.handleNewMessage([]byte(message), false, func(e error, s int) {
+				err, status = e, s
+			})
+			return
+		}
+		So(diskStore.meta.SetSchemaRule(SchemaRule{Pattern: "status", Mode: "sometimes"}), ShouldNotBeNil)
+		So(diskStore.meta.SetSchemaRule(SchemaRule{Pattern: "[", Mode: SchemaVersioned}), ShouldNotBeNil)
+
+		err, _ = publish(`{"name":"status","value":1,"timestamp":1000}`)
+		So(err, ShouldBeNil)
+		err, _ = publish(`{"name":"status","value":2,"timestamp":1010}`)
+		So(err, ShouldBeNil)
+		numericalID := diskStore.meta.NameToID["status"]
+		diskStore.inListenRoutine(diskStore.commit)
+
+		infoOf := func(name string) MeasurementTypeInfo {
+			for _, info := range diskStore.GetAllStoredInfos() {
+				if info.Name == name {
+					return info
+				}
+			}
+			return MeasurementTypeInfo{}
+		}
+
+		Convey("is rejected in strict mode, which is the default", func() {
+			err, status := publish(`{"name":"status","value":"on","timestamp":1020}`)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "status has type numerical but was provided categorical")
+			So(status, ShouldEqual, http.StatusConflict)
+			publish(`{"name":"status","value":"off","timestamp":1030}`)
+
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+			So(result["status"], ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1}, &Numerical{Ts: 1010, Value: 2}})
+			info := infoOf("status")
+			So(info.Type, ShouldEqual, MeasurementNumerical)
+			So(info.TypeHistory, ShouldBeNil)
+			So(info.Rejections["status"].Count, ShouldEqual, 2)
+			So(info.Rejections["status"].Error, ShouldEqual, err.Error())
+
+			diskStore.meta.syncIfDirty()
+			So(InitMetaFromDisk().Rejections["status"].Count, ShouldEqual, 2)
+		})
+
+		Convey("starts a new version of the series in versioned mode", func() {
+			So(diskStore.meta.SetSchemaRule(SchemaRule{Pattern: "stat*", Mode: SchemaVersioned}), ShouldBeNil)
+			err, _ := publish(`{"name":"status","value":"on","timestamp":1020}`)
+			So(err, ShouldBeNil)
+			err, _ = publish(`{"name":"status","value":"off, for maintenance","timestamp":1030}`)
+			So(err, ShouldBeNil)
+
+			categoricalID := diskStore.meta.NameToID["status"]
+			So(categoricalID, ShouldNotEqual, numericalID)
+			expected := []Measurement{
+				&Numerical{Ts: 1000, Value: 1},
+				&Numerical{Ts: 1010, Value: 2},
+				&Categorical{Ts: 1020, Value: "on"},
+				&Categorical{Ts: 1030, Value: "off, for maintenance"},
+			}
+			//the earlier version is read as a series of its own
+			result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{Names: []string{"status"}})
+			So(result["status"], ShouldResemble, expected[2:])
+			So(result["status@numerical"], ShouldResemble, expected[:2])
+			result = store.GetMeasurementsInTimeRange(1020, 2000, FilterDefinition{})
+			So(result["status"], ShouldResemble, expected[2:])
+			So(result["status@numerical"], ShouldBeEmpty)
+			So(store.seriesKeyOf("status@numerical"), ShouldEqual, "status")
+			So(store.seriesKeyOf("status"), ShouldEqual, "status")
+
+			history := []TypeVersion{{ID: numericalID, Type: MeasurementNumerical}, {ID: categoricalID, Type: MeasurementCategorical, Since: 1020}}
+			info := infoOf("status")
+			So(info.Type, ShouldEqual, MeasurementCategorical)
+			So(info.TypeHistory["status"], ShouldResemble, history)
+			So(info.Rejections, ShouldBeNil)
+			So(InitMetaFromDisk().TypeHistory["status"], ShouldResemble, history)
+
+			Convey("keeps the versions apart when compacting", func() {
+				var err error
+				diskStore.inListenRoutine(func() {
+					diskStore.commit()
+					files, _ := GetSortedFileList()
+					err = diskStore.compactFiles(files)
+				})
+				So(err, ShouldBeNil)
+				result := diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+				So(result["status"], ShouldResemble, expected[2:])
+				So(result["status@numerical"], ShouldResemble, expected[:2])
+			})
+
+			Convey("continues an earlier version when switching back to its type", func() {
+				err, _ := publish(`{"name":"status","value":3,"timestamp":1040}`)
+				So(err, ShouldBeNil)
+				So(diskStore.meta.NameToID["status"], ShouldEqual, numericalID)
+				So(infoOf("status").TypeHistory["status"], ShouldResemble, append(history, TypeVersion{ID: numericalID, Type: MeasurementNumerical, Since: 1040}))
+				result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+				So(result["status"], ShouldResemble, []Measurement{expected[0], expected[1], &Numerical{Ts: 1040, Value: 3}})
+				So(result["status@categorical"], ShouldResemble, expected[2:])
+
+				Convey("and aggregates every version by itself", func() {
+					result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{Granularity: time.Second, Aggregate: "mode"})
+					So(result["status"], ShouldResemble, []Measurement{&Numerical{Ts: 0, Value: 1}})
+					So(result["status@categorical"], ShouldResemble, []Measurement{&Categorical{Ts: 0, Value: "on"}})
+
+					result = store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{Granularity: time.Second, Aggregate: "max"})
+					So(result["status"], ShouldResemble, []Measurement{&Numerical{Ts: 0, Value: 3}})
+					So(result, ShouldNotContainKey, "status@categorical")
+				})
+			})
+
+			Convey("stores late measurements of an earlier version with it", func() {
+				store.Add("status", &Numerical{Ts: 1025, Value: 2.5}, false)
+				So(diskStore.meta.NameToID["status"], ShouldEqual, categoricalID)
+				result := store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})
+				So(result["status"], ShouldResemble, expected[2:])
+				So(result["status@numerical"], ShouldResemble, []Measurement{expected[0], expected[1], &Numerical{Ts: 1025, Value: 2.5}})
+			})
+		})
+	})
+}
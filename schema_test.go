@@ -0,0 +1,122 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_rebuildMeta(t *testing.T) {
+	Convey("meta is rebuilt from the data files", t, func() {
+		dir := withTempDataPath(t)
+
+		config := DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024}
+		store := NewStore(100 * 1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), config)
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+
+		for ts := int64(1000); ts < 1100; ts += 10 {
+			store.Add("temperature{room=kitchen}", &Numerical{Ts: ts, Value: float64(ts)}, false)
+			store.Add("temp{room=kitchen}", &Numerical{Ts: ts + 5, Value: float64(ts)}, false)
+			store.Add("status", &Categorical{Ts: ts, Value: "on"}, false)
+		}
+		diskStore.inListenRoutine(diskStore.commit)
+		//the old series is only kept as alias of the one it was merged into
+		_, err = store.Rename(Rename{From: "temp{room=kitchen}", To: "temperature{room=kitchen}"}, false)
+		So(err, ShouldBeNil)
+		diskStore.maxFileSize = 1
+		store.Add("temperature{room=kitchen}", &Numerical{Ts: 2000, Value: 1}, false)
+		store.Add("pressure", &Numerical{Ts: 2000, Value: 1}, false)
+		diskStore.inListenRoutine(func() {
+			diskStore.commit()
+			files, _ := GetSortedFileList()
+			diskStore.rollupFile(files[0])
+		})
+		rollups, err := getSortedRollupFileList()
+		So(err, ShouldBeNil)
+		So(len(rollups), ShouldEqual, 1)
+
+		expected := diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{})
+		So(expected["pressure"], ShouldHaveLength, 1)
+		expectedMeta := diskStore.meta
+		store.Shutdown()
+		diskStore.Shutdown()
+
+		reopen := func() *DiskStore {
+			diskStore, err := NewDiskStore(NewPools(nil), config)
+			So(err, ShouldBeNil)
+			return diskStore
+		}
+
+		Convey("if meta.json is lost", func() {
+			So(os.Remove(filepath.Join(dir, metaFilePath)), ShouldBeNil)
+			diskStore := reopen()
+			defer diskStore.Shutdown()
+
+			So(diskStore.meta.NameToID, ShouldResemble, expectedMeta.NameToID)
+			So(diskStore.meta.IDToName, ShouldResemble, expectedMeta.IDToName)
+			So(diskStore.meta.IDToType, ShouldResemble, expectedMeta.IDToType)
+			So(diskStore.meta.HighestID, ShouldEqual, expectedMeta.HighestID)
+			So(diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{}), ShouldResemble, expected)
+			_, err := os.Stat(filepath.Join(dir, metaFilePath))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("if meta.json is corrupt, which is kept for inspection", func() {
+			So(ioutil.WriteFile(filepath.Join(dir, metaFilePath), []byte(`{"name_to_id": {"temp`), 0600), ShouldBeNil)
+			diskStore := reopen()
+			defer diskStore.Shutdown()
+
+			So(diskStore.meta.NameToID, ShouldResemble, expectedMeta.NameToID)
+			corrupt, err := ioutil.ReadFile(filepath.Join(dir, metaFilePath+".corrupt"))
+			So(err, ShouldBeNil)
+			So(string(corrupt), ShouldEqual, `{"name_to_id": {"temp`)
+		})
+	})
+}
+
+func Test_formatVersion1(t *testing.T) {
+	Convey("data files without schema", t, func() {
+		dir := withTempDataPath(t)
+
+		diskStore, err := NewDiskStore(NewPools(nil), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024 * 1024})
+		So(err, ShouldBeNil)
+		defer diskStore.Shutdown()
+		id, err := diskStore.meta.GetOrCreateID("temperature", MeasurementNumerical)
+		So(err, ShouldBeNil)
+
+		block := NewBlock()
+		for ts := int64(1000); ts < 1050; ts += 10 {
+			block.Add(id, &Numerical{Ts: ts, Value: float64(ts)})
+		}
+		//version 1 frames have no kind
+		payload, err := readFrame(bufio.NewReader(bytes.NewReader(block.encode())))
+		So(err, ShouldBeNil)
+		data := append([]byte(blockFileMagic), 1)
+		data = appendFrame(data, payload[1:])
+		So(ioutil.WriteFile(filepath.Join(dir, fileNameFromTs(1000, 1040)), data, 0600), ShouldBeNil)
+
+		Convey("are still read and indexed", func() {
+			So(diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{})["temperature"], ShouldHaveLength, 5)
+			So(sealDataFile(fileNameFromTs(1000, 1040)), ShouldBeNil)
+			So(diskStore.GetMeasurementsInTimeRange(1020, 5000, FilterDefinition{})["temperature"], ShouldHaveLength, 3)
+		})
+
+		Convey("aren't appended to", func() {
+			diskStore.Add("temperature", &Numerical{Ts: 1050, Value: 1})
+			diskStore.inListenRoutine(diskStore.commit)
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 2)
+			So(files[0].name, ShouldEqual, fileNameFromTs(1000, 1040))
+			So(files[1].hasCurrentFormat(), ShouldBeTrue)
+			So(diskStore.GetMeasurementsInTimeRange(0, 5000, FilterDefinition{})["temperature"], ShouldHaveLength, 6)
+		})
+	})
+}
@@ -1,24 +1,29 @@
 package mhist
 
 import (
-	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 )
 
-//Series represents a series of measurements over time
-//assumes measurements are taken in order
+//Series represents a series of measurements over time, sorted by their timestamps
 type Series struct {
 	measurements    []Measurement
-	addChan         chan Measurement
+	addChan         chan *seriesAddMessage
 	cutoffChan      chan *cutoffMessage
 	stopChan        chan struct{}
 	size            int
 	measurementType MeasurementType
+	coveredFrom     int64
 	rwLock          sync.RWMutex
 }
 
+type seriesAddMessage struct {
+	measurement Measurement
+	doneChan    chan struct{}
+}
+
 type cutoffMessage struct {
 	lowestTs   int64
 	returnChan chan []Measurement
@@ -28,7 +33,7 @@ type cutoffMessage struct {
 func NewSeries(measurementType MeasurementType) *Series {
 	s := &Series{
 		measurements:    []Measurement{},
-		addChan:         make(chan Measurement),
+		addChan:         make(chan *seriesAddMessage),
 		stopChan:        make(chan struct{}),
 		cutoffChan:      make(chan *cutoffMessage),
 		measurementType: measurementType,
@@ -38,58 +43,94 @@ func NewSeries(measurementType MeasurementType) *Series {
 	return s
 }
 
-//Add m to series
+//Add m to series, returns after m is visible to readers. m is dropped if the series was shut down, i.e. because it was deleted
 func (s *Series) Add(m Measurement) {
-	s.addChan <- m
+	doneChan := make(chan struct{})
+	select {
+	case s.addChan <- &seriesAddMessage{
+		measurement: m,
+		doneChan:    doneChan,
+	}:
+		<-doneChan
+	case <-s.stopChan:
+	}
 }
 
 //CutoffBelow a timestamp and return thrown away measurements
 func (s *Series) CutoffBelow(lowestTs int64) []Measurement {
 	returnChan := make(chan []Measurement)
-	s.cutoffChan <- &cutoffMessage{
+	select {
+	case s.cutoffChan <- &cutoffMessage{
 		lowestTs:   lowestTs,
 		returnChan: returnChan,
+	}:
+		return <-returnChan
+	case <-s.stopChan:
+		return []Measurement{}
+	}
+}
+
+//DeleteTimeRange removes the measurements from start to end
+func (s *Series) DeleteTimeRange(start, end int64) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+
+	startIndex, endIndex := s.indexRange(start, end)
+	if startIndex == endIndex {
+		return
+	}
+	remaining := make([]Measurement, 0, len(s.measurements)-(endIndex-startIndex))
+	remaining = append(remaining, s.measurements[:startIndex]...)
+	for _, m := range s.measurements[startIndex:endIndex] {
+		s.size -= m.Size()
 	}
-	returnedSlice := <-returnChan
-	return returnedSlice
+	s.measurements = append(remaining, s.measurements[endIndex:]...)
 }
 
-//Shutdown series goroutine
+//Shutdown series goroutine, it must only be called once
 func (s *Series) Shutdown() {
-	s.stopChan <- struct{}{}
+	close(s.stopChan)
 }
 
-//GetMeasurementsInTimeRange returns the measurements in approx. the given timerange
-////assumes equally distributed measurements over time
+//GetMeasurementsInTimeRange returns the measurements in the given timerange.
+//possiblyIncomplete is true if the series in memory doesn't cover the whole timerange, i.e. older measurements were cut off or were stored before this series was created
 func (s *Series) GetMeasurementsInTimeRange(start int64, end int64, filterDefinition FilterDefinition) (measurements []Measurement, possiblyIncomplete bool) {
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
-	startIndex, err := s.calcIndexAbove(start)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	endIndex, err := s.calcIndexBelow(end)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
 
+	startIndex, endIndex := s.indexRange(start, end)
 	filter := &TimestampFilter{Granularity: filterDefinition.Granularity}
 
-	length := endIndex - startIndex + 1
-	measurements = make([]Measurement, 0, length)
-	for i := 0; i < length; i++ {
-		if filter.Passes(s.measurements[i+startIndex]) {
-			measurements = append(measurements, s.measurements[i+startIndex].Copy())
+	measurements = make([]Measurement, 0, endIndex-startIndex)
+	for _, m := range s.measurements[startIndex:endIndex] {
+		if filter.Passes(m) {
+			measurements = append(measurements, m.Copy())
 		}
 	}
-	if startIndex == 0 {
-		possiblyIncomplete = true
-	}
+	possiblyIncomplete = s.coveredFrom == 0 || start < s.coveredFrom
 	return
 }
 
+//measurementsCoveredInTimeRange returns the measurements in the given timerange, that the series covers completely, together with the timestamp from which on it does.
+//Measurements before coveredFrom have to be read from disk. If the series doesn't cover anything yet, coveredFrom is math.MaxInt64
+func (s *Series) measurementsCoveredInTimeRange(start int64, end int64) (measurements []Measurement, coveredFrom int64) {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	if s.coveredFrom == 0 {
+		return []Measurement{}, math.MaxInt64
+	}
+	if start < s.coveredFrom {
+		start = s.coveredFrom
+	}
+	startIndex, endIndex := s.indexRange(start, end)
+	measurements = make([]Measurement, 0, endIndex-startIndex)
+	for _, m := range s.measurements[startIndex:endIndex] {
+		measurements = append(measurements, m.Copy())
+	}
+	return measurements, s.coveredFrom
+}
+
 //Listen for new measurements
 func (s *Series) Listen() {
 loop:
@@ -99,14 +140,17 @@ loop:
 			break loop
 		case message := <-s.cutoffChan:
 			s.handleCutoff(message)
-		case measurement := <-s.addChan:
-			s.handleAdd(measurement)
+		case message := <-s.addChan:
+			s.handleAdd(message.measurement)
+			message.doneChan <- struct{}{}
 		}
 	}
 }
 
 //Size of all measurements contained in the Series
 func (s *Series) Size() int {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 	return s.size
 }
 
@@ -119,7 +163,7 @@ func (s *Series) handleCutoff(message *cutoffMessage) {
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
 
-	if message.lowestTs <= s.OldestTs() {
+	if message.lowestTs <= s.oldestTs() {
 		message.returnChan <- []Measurement{}
 		return
 	}
@@ -138,52 +182,56 @@ func (s *Series) handleCutoff(message *cutoffMessage) {
 	remainingSlices := s.measurements[index:]
 	s.measurements = remainingSlices
 	s.size -= removedBytes
+	if message.lowestTs >= s.coveredFrom {
+		s.coveredFrom = message.lowestTs + 1
+	}
 	message.returnChan <- cutoffSlices
 }
 
 func (s *Series) handleAdd(m Measurement) {
 	if s.measurementType == m.Type() {
+		s.rwLock.Lock()
+		defer s.rwLock.Unlock()
+
+		if s.coveredFrom == 0 {
+			s.coveredFrom = m.Timestamp()
+		}
 		s.size += m.Size()
-		s.measurements = append(s.measurements, m)
+		last := len(s.measurements) - 1
+		if last < 0 || m.Timestamp() >= s.measurements[last].Timestamp() {
+			s.measurements = append(s.measurements, m)
+			return
+		}
+		//late measurements are inserted where they belong
+		index := sort.Search(len(s.measurements), func(i int) bool {
+			return s.measurements[i].Timestamp() > m.Timestamp()
+		})
+		s.measurements = append(s.measurements, nil)
+		copy(s.measurements[index+1:], s.measurements[index:])
+		s.measurements[index] = m
 		return
 	}
 	fmt.Println(m, " is not the correct type for this series")
 }
 
-func (s *Series) calcIndexAbove(ts int64) (int, error) {
-	if ts <= s.OldestTs() {
-		return 0, nil
-	}
-	//shouldn't happen
-	if ts > s.LatestTs() {
-		return 0, errors.New("given ts is above the latest measured timestamp")
-	}
-
-	//assumes equally distributed measurements over time, no need for perfectly accurate results yet
-	timeRange := s.LatestTs() - s.OldestTs()
-	posInRange := ts - s.OldestTs()
-	index := float64(posInRange) / float64(timeRange) * float64(len(s.measurements)-1)
-	return int(math.Ceil(index)), nil
-}
-
-func (s *Series) calcIndexBelow(ts int64) (int, error) {
-	//shouldn't happen
-	if ts < s.OldestTs() {
-		return 0, errors.New("given ts is below the oldest measured timestamp")
-	}
-	if ts >= s.LatestTs() {
-		return len(s.measurements) - 1, nil
+//indexRange returns the indexes of the measurements with start <= timestamp <= end as [startIndex, endIndex)
+func (s *Series) indexRange(start, end int64) (startIndex, endIndex int) {
+	startIndex = sort.Search(len(s.measurements), func(i int) bool {
+		return s.measurements[i].Timestamp() >= start
+	})
+	endIndex = sort.Search(len(s.measurements), func(i int) bool {
+		return s.measurements[i].Timestamp() > end
+	})
+	if endIndex < startIndex {
+		endIndex = startIndex
 	}
-
-	//assumes equally distributed measurements over time, no need for perfectly accurate results yet
-	timeRange := s.LatestTs() - s.OldestTs()
-	posInRange := ts - s.OldestTs()
-	index := float64(posInRange) / float64(timeRange) * float64(len(s.measurements)-1)
-	return int(index), nil
+	return
 }
 
 //LatestTs in series
 func (s *Series) LatestTs() int64 {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
 	if len(s.measurements) == 0 {
 		return 0
 	}
@@ -193,6 +241,12 @@ func (s *Series) LatestTs() int64 {
 
 //OldestTs in series
 func (s *Series) OldestTs() int64 {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+	return s.oldestTs()
+}
+
+func (s *Series) oldestTs() int64 {
 	if len(s.measurements) == 0 {
 		return 0
 	}
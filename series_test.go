@@ -21,6 +21,21 @@ func TestSeries(t *testing.T) {
 				returnedMeasurements, _ := s.GetMeasurementsInTimeRange(0, 3000, emptyFilterDefinition)
 				So(len(returnedMeasurements), ShouldEqual, 1)
 			})
+			Convey("It inserts late measurements where they belong", func() {
+				s := mhist.NewSeries(mhist.MeasurementNumerical)
+				defer s.Shutdown()
+				for _, ts := range []int64{1000, 1030, 1010, 1040, 1020, 900} {
+					s.Add(&mhist.Numerical{Ts: ts})
+				}
+				returnedMeasurements, _ := s.GetMeasurementsInTimeRange(1005, 1035, emptyFilterDefinition)
+				timestamps := []int64{}
+				for _, m := range returnedMeasurements {
+					timestamps = append(timestamps, m.Timestamp())
+				}
+				So(timestamps, ShouldResemble, []int64{1010, 1020, 1030})
+				So(s.OldestTs(), ShouldEqual, 900)
+				So(s.LatestTs(), ShouldEqual, 1040)
+			})
 		})
 		Convey("GetMeasurementsInTimeRange()", func() {
 			Convey("returns no measurements if empty", func() {
@@ -64,6 +79,37 @@ func TestSeries(t *testing.T) {
 				s.Shutdown()
 				So(len(returnedMeasurements), ShouldEqual, 2)
 			})
+			Convey("returns exactly the measurements in range for irregular intervals", func() {
+				s := mhist.NewSeries(mhist.MeasurementNumerical)
+				for _, ts := range []int64{1000, 1001, 1002, 1003, 5000, 5001} {
+					s.Add(&mhist.Numerical{Ts: ts})
+				}
+				returnedMeasurements, _ := s.GetMeasurementsInTimeRange(1002, 5000, emptyFilterDefinition)
+
+				s.Shutdown()
+				So(len(returnedMeasurements), ShouldEqual, 3)
+				So(returnedMeasurements[0].Timestamp(), ShouldEqual, 1002)
+				So(returnedMeasurements[2].Timestamp(), ShouldEqual, 5000)
+			})
+			Convey("returns incomplete = false if the series covers start", func() {
+				s := mhist.NewSeries(mhist.MeasurementNumerical)
+				testhelpers.AddMeasurementsToSeries(s)
+				_, incomplete := s.GetMeasurementsInTimeRange(1000, 4000, emptyFilterDefinition)
+
+				s.Shutdown()
+				So(incomplete, ShouldEqual, false)
+			})
+			Convey("returns incomplete = true if start Ts is below a cutoff", func() {
+				s := mhist.NewSeries(mhist.MeasurementNumerical)
+				testhelpers.AddMeasurementsToSeries(s)
+				s.CutoffBelow(1015)
+				_, incompleteAtCutoff := s.GetMeasurementsInTimeRange(1015, 4000, emptyFilterDefinition)
+				_, incompleteAboveCutoff := s.GetMeasurementsInTimeRange(1016, 4000, emptyFilterDefinition)
+
+				s.Shutdown()
+				So(incompleteAtCutoff, ShouldEqual, true)
+				So(incompleteAboveCutoff, ShouldEqual, false)
+			})
 			Convey("returns incomplete = true if start Ts is below lowest measurement in series", func() {
 				s := mhist.NewSeries(mhist.MeasurementNumerical)
 				testhelpers.AddMeasurementsToSeries(s)
@@ -3,6 +3,7 @@ package mhist
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -10,11 +11,15 @@ import (
 
 //Server is the handler for requests
 type Server struct {
-	store       *Store
-	pools       *Pools
-	httpHandler *HTTPHandler
-	tcpHandler  *TCPHandler
-	waitGroup   *sync.WaitGroup
+	store            *Store
+	pools            *Pools
+	httpHandler      *HTTPHandler
+	tcpHandler       *TCPHandler
+	waitGroup        *sync.WaitGroup
+	bootstrapAddress string
+	replications     []*Replication
+	maxLateness      time.Duration
+	stopChan         chan struct{}
 }
 
 //ServerConfig ...
@@ -24,23 +29,40 @@ type ServerConfig struct {
 	MemorySize           int
 	DiskSize             int
 	ReplicationAddresses []string
+	ReplicationFilter    FilterDefinition
+	BootstrapAddress     string
+	WALSyncPolicy        WALSyncPolicy
+	MaxOutboxSize        int
+	RollupAfter          time.Duration
+	RollupResolution     time.Duration
+	RollupMaxAge         time.Duration
+	MaxLateness          time.Duration
 }
 
 //NewServer returns a new Server
 func NewServer(config ServerConfig) *Server {
 	memStore := NewStore(config.MemorySize)
 	pools := NewPools(memStore)
-	diskStore, err := NewDiskStore(pools, config.MemorySize, config.DiskSize)
+	diskStore, err := NewDiskStore(pools, DiskStoreConfig{
+		MaxFileSize:      config.MemorySize,
+		MaxDiskSize:      config.DiskSize,
+		WALSyncPolicy:    config.WALSyncPolicy,
+		RollupAfter:      config.RollupAfter,
+		RollupResolution: config.RollupResolution,
+		RollupMaxAge:     config.RollupMaxAge,
+	})
 	if err != nil {
 		panic(err)
 	}
-	memStore.AddSubscriber(diskStore)
 	memStore.SetDiskStore(diskStore)
 
 	server := &Server{
-		store:     memStore,
-		pools:     pools,
-		waitGroup: &sync.WaitGroup{},
+		store:            memStore,
+		pools:            pools,
+		waitGroup:        &sync.WaitGroup{},
+		bootstrapAddress: config.BootstrapAddress,
+		maxLateness:      config.MaxLateness,
+		stopChan:         make(chan struct{}),
 	}
 	tcpHandler := NewTCPHandler(server, config.TCPPort, pools)
 	server.tcpHandler = tcpHandler
@@ -52,14 +74,21 @@ func NewServer(config ServerConfig) *Server {
 	}
 	server.httpHandler = httpHandler
 	for _, address := range config.ReplicationAddresses {
-		replication := NewReplication(address, pools)
+		replication, err := NewReplication(address, config.ReplicationFilter, pools, config.MaxOutboxSize)
+		if err != nil {
+			panic(err)
+		}
 		memStore.AddReplication(replication)
+		server.replications = append(server.replications, replication)
 	}
 	return server
 }
 
 //Run the server
 func (s *Server) Run() {
+	if s.bootstrapAddress != "" {
+		go s.bootstrapFrom(s.bootstrapAddress)
+	}
 	s.waitGroup.Add(2)
 	go func() {
 		s.httpHandler.Run()
@@ -72,9 +101,25 @@ func (s *Server) Run() {
 	s.waitGroup.Wait()
 }
 
-//Shutdown all goroutines
+//Shutdown all goroutines and commit the buffered writes to disk
 func (s *Server) Shutdown() {
+	close(s.stopChan)
 	s.store.Shutdown()
+	for _, replication := range s.replications {
+		replication.Shutdown()
+	}
+	if s.store.diskStore != nil {
+		s.store.diskStore.Shutdown()
+	}
+}
+
+//replicationStatus of all replication targets
+func (s *Server) replicationStatus() []ReplicationStatus {
+	statuses := []ReplicationStatus{}
+	for _, replication := range s.replications {
+		statuses = append(statuses, replication.Status())
+	}
+	return statuses
 }
 
 func (s *Server) handleNewMessage(byteSlice []byte, isReplication bool, onError func(err error, status int)) {
@@ -87,17 +132,40 @@ func (s *Server) handleNewMessage(byteSlice []byte, isReplication bool, onError
 		onError(err, http.StatusBadRequest)
 		return
 	}
-	if data.Name == "" {
-		err = errors.New("name can't be empty")
+	s.handleMessage(data, isReplication, onError)
+}
+
+func (s *Server) handleMessage(data *Message, isReplication bool, onError func(err error, status int)) {
+	err := data.validate()
+	if err != nil {
 		onError(err, http.StatusBadRequest)
 		return
 	}
+	//replicated measurements were accepted by the instance they come from already
+	if !isReplication && s.maxLateness > 0 && data.Timestamp != 0 {
+		lateness := time.Duration(time.Now().UnixNano() - data.Timestamp)
+		if lateness > s.maxLateness {
+			err := fmt.Errorf("measurement is %v late, measurements more than %v late are rejected", lateness.Round(time.Millisecond), s.maxLateness)
+			onError(err, http.StatusBadRequest)
+			return
+		}
+	}
 	measurement, err := s.constructMeasurementFromMessage(data)
 	if err != nil {
 		onError(err, http.StatusBadRequest)
 		return
 	}
-	s.store.Add(data.Name, measurement, isReplication)
+	err = s.store.acceptType(data.SeriesKey(), measurement)
+	if err != nil {
+		s.pools.PutMeasurement(measurement)
+		onError(err, http.StatusConflict)
+		return
+	}
+	err = s.store.Add(data.SeriesKey(), measurement, isReplication)
+	if err != nil {
+		s.pools.PutMeasurement(measurement)
+		onError(err, http.StatusInternalServerError)
+	}
 }
 
 func (s *Server) constructMeasurementFromMessage(message *Message) (measurement Measurement, err error) {
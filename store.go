@@ -2,6 +2,7 @@ package mhist
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -9,6 +10,8 @@ import (
 type Store struct {
 	seriesMap *sync.Map
 	sync.Mutex
+	//renameMutex keeps renames from happening while a measurement is added, so it ends up either in the renamed series or in a new one
+	renameMutex  sync.RWMutex
 	maxSize      int
 	subscribers  SubscriberSlice
 	replications SubscriberSlice
@@ -60,48 +63,101 @@ func (s *Store) GetSeries(name string, measurementType MeasurementType) *Series
 }
 
 //Add named measurement to correct Series
-func (s *Store) Add(name string, m Measurement, isReplication bool) {
+//the measurement is added to the series before subscribers are notified, so a subscriber never misses it between reading the history and receiving realtime updates.
+//It is written to the disk store first and rejected if that fails
+func (s *Store) Add(name string, m Measurement, isReplication bool) error {
+	s.renameMutex.RLock()
+	defer s.renameMutex.RUnlock()
+
+	if s.diskStore != nil {
+		err := s.diskStore.Add(name, m)
+		if err != nil {
+			return err
+		}
+	}
+	series := s.seriesFor(name, m)
+	if series.Type() == m.Type() {
+		series.Add(m)
+	} else {
+		//a late measurement of an earlier version of the series is only stored on disk, so it is read from there
+		series.uncover(m.Timestamp())
+	}
+
 	if !isReplication {
 		s.replications.NotifyAll(name, m)
 	}
 	s.subscribers.NotifyAll(name, m)
-
-	s.GetSeries(name, m.Type()).Add(m)
+	return nil
 }
 
 //GetMeasurementsInTimeRange for all series
-//TODO: change interface of diskStore to only read necessary parts, for now read all if any in memroy series is incomplete
+//Every series is served from memory as far as it covers the timerange, only the older part of the timerange is read from disk for the series that need it
 func (s *Store) GetMeasurementsInTimeRange(start, end int64, filterDefinition FilterDefinition) map[string][]Measurement {
 	m := map[string][]Measurement{}
-	anyIncomplete := false
-
-	s.forEachSeries(func(name string, series *Series) {
-		if !filterDefinition.IsInNames(name) {
-			return
-		}
-		measurements, possiblyIncomplete := series.GetMeasurementsInTimeRange(start, end, filterDefinition)
-		m[name] = measurements
-		if possiblyIncomplete {
-			anyIncomplete = true
+	s.StreamMeasurementsInTimeRange(start, end, filterDefinition, func(name string, measurements []Measurement) error {
+		if m[name] == nil {
+			m[name] = measurements
+		} else {
+			m[name] = append(m[name], measurements...)
 		}
+		return nil
 	})
+	return m
+}
 
-	if s.diskStore != nil {
-		allInfos := s.diskStore.GetAllStoredInfos()
-		anyNameNotIncluded := false
-		for _, info := range allInfos {
-			if len(m[info.Name]) == 0 {
-				anyNameNotIncluded = true
-				break
-			}
+//validateAggregation of the filterDefinition, numerical-only functions are rejected if a matching series is categorical
+func (s *Store) validateAggregation(filterDefinition FilterDefinition) error {
+	aggregation, err := filterDefinition.aggregation()
+	if err != nil || aggregation == nil || !aggregation.numericalOnly() {
+		return err
+	}
+	for _, key := range s.matchingSeriesKeys(filterDefinition) {
+		if s.seriesType(key) == MeasurementCategorical {
+			return fmt.Errorf("aggregate '%v' only works for numerical series, %v is categorical", filterDefinition.Aggregate, key)
 		}
+	}
+	return nil
+}
 
-		if anyIncomplete || anyNameNotIncluded {
-			return s.diskStore.GetMeasurementsInTimeRange(start, end, filterDefinition)
-		}
+//seriesType of the series in memory or on disk, 0 if it doesn't exist
+func (s *Store) seriesType(key string) MeasurementType {
+	if series, ok := s.seriesMap.Load(key); ok && series != nil {
+		return series.(*Series).Type()
+	}
+	if s.diskStore != nil {
+		return s.diskStore.meta.currentType(key)
 	}
+	return 0
+}
 
-	return m
+//seriesKeyOf the name a series was read with, see DiskMeta.seriesKeyOf
+func (s *Store) seriesKeyOf(name string) string {
+	if s.diskStore == nil {
+		return name
+	}
+	return s.diskStore.meta.seriesKeyOf(name)
+}
+
+//rollupsFromDisk reads the rollups of the given names, if the granularity is coarse enough to be answered by them
+func (s *Store) rollupsFromDisk(start, end int64, names []string, filterDefinition FilterDefinition) map[string][]Measurement {
+	if s.diskStore == nil || len(names) == 0 || filterDefinition.Granularity < s.diskStore.RollupResolution() {
+		return nil
+	}
+	return s.diskStore.GetRollupsInTimeRange(start, end, FilterDefinition{Names: names, Granularity: filterDefinition.Granularity, Aggregate: filterDefinition.Aggregate})
+}
+
+func measurementsBefore(measurements []Measurement, ts int64) []Measurement {
+	index := sort.Search(len(measurements), func(i int) bool {
+		return measurements[i].Timestamp() >= ts
+	})
+	return measurements[:index]
+}
+
+func minTs(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 //GetStoredMetaInfo from Diskstore
@@ -0,0 +1,43 @@
+package mhist
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Store_mergesMemoryAndDisk(t *testing.T) {
+	Convey("merges memory and disk results per series", t, func() {
+		withTempDataPath(t)
+
+		store := NewStore(100 * 1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+
+		for ts := int64(1000); ts <= 1040; ts += 10 {
+			store.Add("temperature", &Numerical{Ts: ts, Value: float64(ts)}, false)
+			store.Add("pressure", &Numerical{Ts: ts, Value: float64(ts)}, false)
+		}
+		store.GetSeries("temperature", MeasurementNumerical).CutoffBelow(1015)
+		diskStore.Add("humidity", &Numerical{Ts: 1005, Value: 50})
+
+		result := store.GetMeasurementsInTimeRange(1000, 1040, FilterDefinition{})
+		timestamps := func(measurements []Measurement) (timestamps []int64) {
+			for _, m := range measurements {
+				timestamps = append(timestamps, m.Timestamp())
+			}
+			return
+		}
+		So(timestamps(result["temperature"]), ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040})
+		So(timestamps(result["pressure"]), ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040})
+		So(timestamps(result["humidity"]), ShouldResemble, []int64{1005})
+
+		filtered := store.GetMeasurementsInTimeRange(1000, 1040, FilterDefinition{Names: []string{"temperature"}})
+		So(len(filtered), ShouldEqual, 1)
+		So(timestamps(filtered["temperature"]), ShouldResemble, []int64{1000, 1010, 1020, 1030, 1040})
+
+		store.Shutdown()
+		diskStore.Shutdown()
+	})
+}
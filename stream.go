@@ -0,0 +1,476 @@
+package mhist
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+type execMessage struct {
+	f        func()
+	doneChan chan struct{}
+}
+
+//inListenRoutine runs f on the DiskStore goroutine and returns once it is done
+func (s *DiskStore) inListenRoutine(f func()) {
+	doneChan := make(chan struct{})
+	s.execChan <- execMessage{f: f, doneChan: doneChan}
+	<-doneChan
+}
+
+//diskSnapshot pins the data files of a timerange, so they are neither removed nor appended to until the snapshot is released and can be read concurrently.
+//The unflushed measurements of the timerange are copied when the snapshot is taken
+type diskSnapshot struct {
+	store      *DiskStore
+	start      int64
+	end        int64
+	files      FileInfoSlice
+	unflushed  map[int64][]Measurement
+	deleted    tombstones
+	chunks     []*snapshotChunk
+	isReleased bool
+}
+
+//snapshot of the timerange, it has to be released after it was read
+func (s *DiskStore) snapshot(start, end int64) (snapshot *diskSnapshot) {
+	s.inListenRoutine(func() {
+		snapshot = s.takeSnapshot(start, end)
+	})
+	return snapshot
+}
+
+//takeSnapshot has to be called on the DiskStore goroutine or after it was shut down
+func (s *DiskStore) takeSnapshot(start, end int64) *diskSnapshot {
+	snapshot := &diskSnapshot{store: s, start: start, end: end, unflushed: map[int64][]Measurement{}, deleted: s.meta.getTombstones()}
+	files, err := GetFilesInTimeRange(start, end)
+	if err != nil {
+		fmt.Println(err)
+	}
+	snapshot.files = files
+	s.pin(files)
+	var unflushedOldestTs, unflushedLatestTs int64
+	hasUnflushed := false
+	s.block.ForEach(func(id int64, m Measurement) {
+		ts := m.Timestamp()
+		if ts < start || ts > end {
+			return
+		}
+		snapshot.unflushed[id] = append(snapshot.unflushed[id], m)
+		if !hasUnflushed || ts < unflushedOldestTs {
+			unflushedOldestTs = ts
+		}
+		if !hasUnflushed || ts > unflushedLatestTs {
+			unflushedLatestTs = ts
+		}
+		hasUnflushed = true
+	})
+	snapshot.chunks = chunksOf(files, hasUnflushed, unflushedOldestTs, unflushedLatestTs)
+	return snapshot
+}
+
+//streamBufferSize is the maximum amount of measurements streaming buffers for the series that are read together with the one being passed on
+var streamBufferSize = 100000
+
+//streamSeries calls f with the measurements of the series in the timerange, one series after another in the order of names and the measurements of a series in chunks in time order.
+//done is called after the last chunk of every series, even if it had none. Series are read in batches, each chunk of data files is read once for all series of the batch:
+//the first series of a batch is passed on chunk by chunk, the measurements of the others are buffered. The series that don't fit into the streamBufferSize anymore are left to the next batch
+func (d *diskSnapshot) streamSeries(names []string, f func(index int, measurements []Measurement) error, done func(index int) error) error {
+	for first := 0; first < len(names); {
+		next, err := d.streamBatch(names, first, f, done)
+		if err != nil {
+			return err
+		}
+		first = next
+	}
+	return nil
+}
+
+//streamBatch of the series from first on, returns the index of the first series that was left to the next batch
+func (d *diskSnapshot) streamBatch(names []string, first int, f func(index int, measurements []Measurement) error, done func(index int) error) (next int, err error) {
+	s := d.store
+	indexes := map[string]int{}
+	for index := first; index < len(names); index++ {
+		indexes[names[index]] = index
+	}
+	next = len(names)
+	indexesPerID := map[int64]int{}
+	indexOf := func(id int64) int {
+		index, ok := indexesPerID[id]
+		if !ok {
+			index = -1
+			if nameIndex, ok := indexes[s.meta.readNameForID(id)]; ok {
+				index = nameIndex
+			}
+			indexesPerID[id] = index
+		}
+		if index >= next {
+			return -1
+		}
+		return index
+	}
+	isSeries := func(id int64) bool {
+		return indexOf(id) >= 0
+	}
+	buffered := map[int][][]Measurement{}
+	bufferedCount := map[int]int{}
+	totalBuffered := 0
+
+	for _, chunk := range d.chunks {
+		if chunk.oldestTs > d.end || chunk.latestTs < d.start {
+			continue
+		}
+		measurements := map[int][]Measurement{}
+		collect := func(id int64, m Measurement) {
+			if m.Timestamp() < d.start || m.Timestamp() > d.end || d.deleted.covers(id, m.Timestamp()) {
+				return
+			}
+			if index := indexOf(id); index >= 0 {
+				measurements[index] = append(measurements[index], m)
+			}
+		}
+		for _, file := range chunk.files {
+			//pinned files don't change, they are read without blocking the DiskStore goroutine
+			var err error
+			if file.isCsv() {
+				err = s.readCsvFile(file, collect)
+			} else {
+				err = s.readBlockFile(file, d.start, d.end, isSeries, collect)
+			}
+			if err != nil {
+				fmt.Println(file.name, err)
+			}
+		}
+		if chunk.hasUnflushed {
+			for id, unflushed := range d.unflushed {
+				for _, m := range unflushed {
+					collect(id, m)
+				}
+			}
+		}
+
+		for index, seriesMeasurements := range measurements {
+			if index >= next {
+				continue
+			}
+			//late measurements and merged series can be out of order
+			sortByTimestampIfNeeded(seriesMeasurements)
+			if index == first {
+				err = f(first, seriesMeasurements)
+				if err != nil {
+					return next, err
+				}
+				continue
+			}
+			buffered[index] = append(buffered[index], seriesMeasurements)
+			bufferedCount[index] += len(seriesMeasurements)
+			totalBuffered += len(seriesMeasurements)
+		}
+		for totalBuffered > streamBufferSize && next > first+1 {
+			next--
+			totalBuffered -= bufferedCount[next]
+			delete(buffered, next)
+		}
+	}
+
+	err = done(first)
+	for index := first + 1; index < next && err == nil; index++ {
+		for _, seriesMeasurements := range buffered[index] {
+			err = f(index, seriesMeasurements)
+			if err != nil {
+				return next, err
+			}
+		}
+		err = done(index)
+	}
+	return next, err
+}
+
+//snapshotChunk holds data files with overlapping timeranges, possibly together with the unflushed measurements.
+//The chunks of a snapshot don't overlap, so reading them one after another yields the measurements in time order
+type snapshotChunk struct {
+	files        FileInfoSlice
+	hasUnflushed bool
+	oldestTs     int64
+	latestTs     int64
+}
+
+//chunksOf the files and the unflushed measurements in the timerange from oldestTs to latestTs, sorted by time
+func chunksOf(files FileInfoSlice, hasUnflushed bool, unflushedOldestTs, unflushedLatestTs int64) []*snapshotChunk {
+	parts := make([]*snapshotChunk, 0, len(files)+1)
+	for _, file := range files {
+		parts = append(parts, &snapshotChunk{files: FileInfoSlice{file}, oldestTs: file.oldestTs, latestTs: file.latestTs})
+	}
+	if hasUnflushed {
+		parts = append(parts, &snapshotChunk{hasUnflushed: true, oldestTs: unflushedOldestTs, latestTs: unflushedLatestTs})
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].oldestTs < parts[j].oldestTs
+	})
+
+	chunks := []*snapshotChunk{}
+	for _, part := range parts {
+		if len(chunks) == 0 || part.oldestTs > chunks[len(chunks)-1].latestTs {
+			chunks = append(chunks, part)
+			continue
+		}
+		chunk := chunks[len(chunks)-1]
+		chunk.files = append(chunk.files, part.files...)
+		chunk.hasUnflushed = chunk.hasUnflushed || part.hasUnflushed
+		if part.latestTs > chunk.latestTs {
+			chunk.latestTs = part.latestTs
+		}
+	}
+	return chunks
+}
+
+//release the pinned files of the snapshot
+func (d *diskSnapshot) release() {
+	if d.isReleased {
+		return
+	}
+	d.isReleased = true
+	d.store.unpin(d.files)
+}
+
+func (s *DiskStore) pin(files FileInfoSlice) {
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	for _, file := range files {
+		s.pinnedFiles[file.name]++
+	}
+}
+
+func (s *DiskStore) unpin(files FileInfoSlice) {
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	for _, file := range files {
+		s.pinnedFiles[file.name]--
+		if s.pinnedFiles[file.name] <= 0 {
+			delete(s.pinnedFiles, file.name)
+		}
+	}
+}
+
+//isPinned is true while the data file is part of a snapshot that is being read
+func (s *DiskStore) isPinned(name string) bool {
+	s.pinMutex.Lock()
+	defer s.pinMutex.Unlock()
+	return s.pinnedFiles[name] > 0
+}
+
+//StreamMeasurementsInTimeRange calls f with the measurements of every series that matches the filterDefinition, one series after another in the order of their names.
+//The measurements of a series are passed in chunks in time order, so only a single chunk has to be kept in memory. Streaming stops at the first error f returns.
+//Earlier versions of a series with another type are passed as series of their own, named by versionName
+func (s *DiskStore) StreamMeasurementsInTimeRange(start, end int64, filterDefinition FilterDefinition, f func(name string, measurements []Measurement) error) error {
+	filter := NewFilterCollection(filterDefinition)
+	names := []string{}
+	for _, key := range s.GetAllSeriesKeys() {
+		if filter.Matches(key) {
+			names = append(names, key)
+			for name := range s.meta.versionTypes(key) {
+				filter.alias(name, key)
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	snapshot := s.snapshot(start, end)
+	defer snapshot.release()
+	return snapshot.streamSeries(names, func(index int, measurements []Measurement) error {
+		passed := measurements[:0]
+		for _, m := range measurements {
+			if filter.Passes(names[index], m) {
+				passed = append(passed, m)
+			}
+		}
+		if len(passed) == 0 {
+			return nil
+		}
+		return f(names[index], passed)
+	}, func(index int) error {
+		return nil
+	})
+}
+
+//seriesApplier applies the granularity and aggregation of a FilterDefinition to the measurements of a single series chunk by chunk, like FilterDefinition.Apply does at once
+type seriesApplier struct {
+	granularity     int64
+	aggregator      *BucketAggregator
+	timestampFilter *TimestampFilter
+}
+
+func newSeriesApplier(filterDefinition FilterDefinition) *seriesApplier {
+	applier := &seriesApplier{granularity: filterDefinition.Granularity.Nanoseconds()}
+	aggregation, err := filterDefinition.aggregation()
+	if err != nil {
+		fmt.Println(err)
+	}
+	if aggregation != nil {
+		applier.aggregator = &BucketAggregator{Granularity: filterDefinition.Granularity, Aggregation: aggregation}
+	} else {
+		applier.timestampFilter = &TimestampFilter{Granularity: filterDefinition.Granularity}
+	}
+	return applier
+}
+
+func (a *seriesApplier) add(measurements []Measurement) []Measurement {
+	if a.granularity <= 0 {
+		return measurements
+	}
+	applied := make([]Measurement, 0, len(measurements))
+	for _, m := range measurements {
+		if a.aggregator != nil {
+			if aggregated, ok := a.aggregator.Add(m); ok {
+				applied = append(applied, aggregated)
+			}
+		} else if a.timestampFilter.Passes(m) {
+			applied = append(applied, m)
+		}
+	}
+	return applied
+}
+
+func (a *seriesApplier) flush() []Measurement {
+	if a.aggregator == nil {
+		return nil
+	}
+	if aggregated, ok := a.aggregator.Flush(); ok {
+		return []Measurement{aggregated}
+	}
+	return nil
+}
+
+//StreamMeasurementsInTimeRange calls f with the measurements of every series that matches the filterDefinition, one series after another in the order of their names.
+//Every series is served from memory as far as it covers the timerange and streamed from disk before that, its measurements are passed in chunks in time order.
+//Series that are in memory are passed at least once, even without measurements in the timerange. Streaming stops at the first error f returns.
+//Earlier versions of a series with another type are passed as series of their own, named by versionName
+func (s *Store) StreamMeasurementsInTimeRange(start, end int64, filterDefinition FilterDefinition, f func(name string, measurements []Measurement) error) error {
+	filter := NewFilterCollection(filterDefinition)
+	seriesPerName := map[string]*Series{}
+	s.forEachSeries(func(name string, series *Series) {
+		if filter.Matches(name) {
+			seriesPerName[name] = series
+		}
+	})
+	names := make([]string, 0, len(seriesPerName))
+	for name := range seriesPerName {
+		names = append(names, name)
+	}
+	var snapshot *diskSnapshot
+	if s.diskStore != nil {
+		aggregation, _ := filterDefinition.aggregation()
+		for _, key := range s.diskStore.GetAllSeriesKeys() {
+			if !filter.Matches(key) {
+				continue
+			}
+			if _, ok := seriesPerName[key]; !ok {
+				names = append(names, key)
+			}
+			for name, t := range s.diskStore.meta.versionTypes(key) {
+				//numerical-only aggregations leave out the categorical versions of a series
+				if t == MeasurementNumerical || aggregation == nil || !aggregation.numericalOnly() {
+					names = append(names, name)
+				}
+			}
+		}
+		snapshot = s.diskStore.snapshot(start, end)
+		defer snapshot.release()
+	}
+	sort.Strings(names)
+	rollups := s.rollupsFromDisk(start, end, names, filterDefinition)
+
+	var current *streamedSeries
+	seriesAt := func(index int) *streamedSeries {
+		if current == nil || current.name != names[index] {
+			name := names[index]
+			current = &streamedSeries{
+				name:        name,
+				coveredFrom: math.MaxInt64,
+				applier:     newSeriesApplier(filterDefinition),
+				rolledUp:    rollups[name],
+				granularity: filterDefinition.Granularity,
+				f:           f,
+			}
+			if series := seriesPerName[name]; series != nil {
+				current.inMemory = true
+				current.memoryMeasurements, current.coveredFrom = series.measurementsCoveredInTimeRange(start, end)
+			}
+		}
+		return current
+	}
+	addFromDisk := func(index int, measurements []Measurement) error {
+		return seriesAt(index).addFromDisk(measurements)
+	}
+	finish := func(index int) error {
+		return seriesAt(index).finish()
+	}
+	if snapshot == nil {
+		for index := range names {
+			err := finish(index)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return snapshot.streamSeries(names, addFromDisk, finish)
+}
+
+//streamedSeries passes on the measurements of a series for Store.StreamMeasurementsInTimeRange: the ones from disk before the series covers the timerange in memory,
+//followed by the ones in memory, with the rollups of the time that isn't covered by either of them in front
+type streamedSeries struct {
+	name               string
+	memoryMeasurements []Measurement
+	coveredFrom        int64
+	inMemory           bool
+	applier            *seriesApplier
+	rolledUp           []Measurement
+	granularity        time.Duration
+	passedAny          bool
+	f                  func(name string, measurements []Measurement) error
+}
+
+func (s *streamedSeries) pass(measurements []Measurement) error {
+	if len(measurements) == 0 {
+		return nil
+	}
+	s.passedAny = true
+	return s.f(s.name, measurements)
+}
+
+func (s *streamedSeries) add(measurements []Measurement) error {
+	if len(measurements) == 0 {
+		return nil
+	}
+	if s.rolledUp != nil {
+		err := s.pass(measurementsBefore(s.rolledUp, alignToBucket(measurements[0].Timestamp(), s.granularity)))
+		s.rolledUp = nil
+		if err != nil {
+			return err
+		}
+	}
+	return s.pass(s.applier.add(measurements))
+}
+
+//addFromDisk the measurements of a chunk that the series doesn't cover in memory
+func (s *streamedSeries) addFromDisk(measurements []Measurement) error {
+	return s.add(measurementsBefore(measurements, s.coveredFrom))
+}
+
+//finish the series with the measurements in memory, the remaining rollups and aggregations.
+//Series that are in memory are passed at least once
+func (s *streamedSeries) finish() error {
+	err := s.add(s.memoryMeasurements)
+	if err == nil {
+		err = s.pass(s.rolledUp)
+	}
+	if err == nil {
+		err = s.pass(s.applier.flush())
+	}
+	if err == nil && !s.passedAny && s.inMemory {
+		err = s.f(s.name, []Measurement{})
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package mhist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_seriesStreamEncoder(t *testing.T) {
+	Convey("seriesStreamEncoder writes the same json as marshalling the whole map", t, func() {
+		buffer := &bytes.Buffer{}
+		encoder := newSeriesStreamEncoder(buffer)
+		So(encoder.write("a", []Measurement{&Numerical{Ts: 1, Value: 1}}), ShouldBeNil)
+		So(encoder.write("a", []Measurement{}), ShouldBeNil)
+		So(encoder.write("a", []Measurement{&Numerical{Ts: 2, Value: 2}, &Numerical{Ts: 3, Value: 3}}), ShouldBeNil)
+		So(encoder.write("b", []Measurement{}), ShouldBeNil)
+		So(encoder.write("c\"", []Measurement{&Categorical{Ts: 4, Value: "on"}}), ShouldBeNil)
+		So(encoder.close(), ShouldBeNil)
+
+		expected, err := json.Marshal(map[string][]Measurement{
+			"a":   {&Numerical{Ts: 1, Value: 1}, &Numerical{Ts: 2, Value: 2}, &Numerical{Ts: 3, Value: 3}},
+			"b":   {},
+			"c\"": {&Categorical{Ts: 4, Value: "on"}},
+		})
+		So(err, ShouldBeNil)
+		So(buffer.String(), ShouldEqual, string(expected))
+
+		empty := &bytes.Buffer{}
+		So(newSeriesStreamEncoder(empty).close(), ShouldBeNil)
+		So(empty.String(), ShouldEqual, "{}")
+	})
+}
+
+func Test_Store_StreamMeasurementsInTimeRange(t *testing.T) {
+	Convey("StreamMeasurementsInTimeRange", t, func() {
+		withTempDataPath(t)
+
+		meta := NewDiskMeta()
+		temperatureID, _ := meta.GetOrCreateID("temperature", MeasurementNumerical)
+		pressureID, _ := meta.GetOrCreateID("pressure", MeasurementNumerical)
+		for _, timestamps := range [][]int64{{1000, 1010, 1020}, {1030, 1040, 1050}} {
+			block := NewBlock()
+			for _, ts := range timestamps {
+				block.Add(temperatureID, &Numerical{Ts: ts, Value: float64(ts)})
+				block.Add(pressureID, &Numerical{Ts: ts, Value: float64(ts)})
+			}
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+		}
+
+		store := NewStore(100 * 1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), DiskStoreConfig{MaxFileSize: 1024 * 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		defer store.Shutdown()
+		store.Add("temperature", &Numerical{Ts: 1060, Value: 1060}, false)
+		store.Add("humidity", &Numerical{Ts: 5000, Value: 50}, false)
+
+		type chunk struct {
+			name       string
+			timestamps []int64
+		}
+		stream := func(filterDefinition FilterDefinition) (chunks []chunk) {
+			err := store.StreamMeasurementsInTimeRange(1000, 2000, filterDefinition, func(name string, measurements []Measurement) error {
+				c := chunk{name: name, timestamps: []int64{}}
+				for _, m := range measurements {
+					c.timestamps = append(c.timestamps, m.Timestamp())
+				}
+				chunks = append(chunks, c)
+				return nil
+			})
+			So(err, ShouldBeNil)
+			return
+		}
+
+		Convey("passes the series one after another in chunks in time order", func() {
+			So(stream(FilterDefinition{}), ShouldResemble, []chunk{
+				{name: "humidity", timestamps: []int64{}},
+				{name: "pressure", timestamps: []int64{1000, 1010, 1020}},
+				{name: "pressure", timestamps: []int64{1030, 1040, 1050}},
+				{name: "temperature", timestamps: []int64{1000, 1010, 1020}},
+				{name: "temperature", timestamps: []int64{1030, 1040, 1050}},
+				{name: "temperature", timestamps: []int64{1060}},
+			})
+		})
+
+		Convey("passes the series in the same order if they don't fit into the stream buffer together", func() {
+			defaultStreamBufferSize := streamBufferSize
+			streamBufferSize = 1
+			defer func() { streamBufferSize = defaultStreamBufferSize }()
+
+			So(stream(FilterDefinition{}), ShouldResemble, []chunk{
+				{name: "humidity", timestamps: []int64{}},
+				{name: "pressure", timestamps: []int64{1000, 1010, 1020}},
+				{name: "pressure", timestamps: []int64{1030, 1040, 1050}},
+				{name: "temperature", timestamps: []int64{1000, 1010, 1020}},
+				{name: "temperature", timestamps: []int64{1030, 1040, 1050}},
+				{name: "temperature", timestamps: []int64{1060}},
+			})
+		})
+
+		Convey("reads every chunk once for all series that fit into the stream buffer", func() {
+			snapshot := diskStore.snapshot(1000, 2000)
+			defer snapshot.release()
+			names := []string{"pressure", "temperature"}
+			calls := []string{}
+			next, err := snapshot.streamBatch(names, 0, func(index int, measurements []Measurement) error {
+				calls = append(calls, fmt.Sprintf("%v:%v", names[index], len(measurements)))
+				return nil
+			}, func(index int) error {
+				calls = append(calls, "done "+names[index])
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(next, ShouldEqual, 2)
+			So(calls, ShouldResemble, []string{"pressure:3", "pressure:3", "done pressure", "temperature:3", "temperature:3", "temperature:1", "done temperature"})
+		})
+
+		Convey("applies granularity and aggregation across chunks", func() {
+			chunks := stream(FilterDefinition{Names: []string{"temperature"}, Granularity: 25, Aggregate: "count"})
+			counts := []int64{}
+			for _, c := range chunks {
+				counts = append(counts, c.timestamps...)
+			}
+			So(counts, ShouldResemble, []int64{1000, 1025, 1050})
+			So(store.GetMeasurementsInTimeRange(1000, 2000, FilterDefinition{Names: []string{"temperature"}, Granularity: 25, Aggregate: "count"})["temperature"][0].(*Numerical).Value, ShouldEqual, 3)
+		})
+
+		Convey("passes late measurements in time order, even if data files overlap", func() {
+			block := NewBlock()
+			block.Add(temperatureID, &Numerical{Ts: 1025, Value: 1025})
+			block.Add(temperatureID, &Numerical{Ts: 1005, Value: 1005})
+			So(WriteBlockToFile(block, nil, nil), ShouldBeNil)
+			store.Add("temperature", &Numerical{Ts: 1015, Value: 1015}, false)
+
+			chunks := stream(FilterDefinition{Names: []string{"temperature"}})
+			timestamps := []int64{}
+			for _, c := range chunks {
+				timestamps = append(timestamps, c.timestamps...)
+			}
+			So(timestamps, ShouldResemble, []int64{1000, 1005, 1010, 1015, 1020, 1025, 1030, 1040, 1050, 1060})
+		})
+
+		Convey("stops at the first error", func() {
+			calls := 0
+			stopped := errors.New("stopped")
+			err := store.StreamMeasurementsInTimeRange(1000, 2000, FilterDefinition{}, func(name string, measurements []Measurement) error {
+				calls++
+				return stopped
+			})
+			So(err, ShouldEqual, stopped)
+			So(calls, ShouldEqual, 1)
+			So(diskStore.isPinned(fileNameFromTs(1000, 1020)), ShouldBeFalse)
+		})
+
+		Convey("pins the streamed files", func() {
+			snapshot := diskStore.snapshot(1000, 2000)
+			So(diskStore.isPinned(fileNameFromTs(1000, 1020)), ShouldBeTrue)
+			diskStore.inListenRoutine(func() {
+				diskStore.compact()
+				diskStore.commit()
+			})
+			files, err := GetSortedFileList()
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 3)
+			So(files[1].name, ShouldEqual, fileNameFromTs(1030, 1050))
+
+			snapshot.release()
+			So(diskStore.isPinned(fileNameFromTs(1000, 1020)), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_HTTPHandler_streamsGet(t *testing.T) {
+	Convey("GET streams the same measurements GetMeasurementsInTimeRange returns", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		defer store.Shutdown()
+		for ts := int64(1); ts <= 3; ts++ {
+			store.Add("temperature", &Numerical{Ts: ts * int64(time.Second), Value: float64(ts)}, false)
+		}
+		buffer := &bytes.Buffer{}
+		encoder := newSeriesStreamEncoder(buffer)
+		So(store.StreamMeasurementsInTimeRange(0, int64(time.Minute), FilterDefinition{}, encoder.write), ShouldBeNil)
+		So(encoder.close(), ShouldBeNil)
+
+		expected, err := json.Marshal(store.GetMeasurementsInTimeRange(0, int64(time.Minute), FilterDefinition{}))
+		So(err, ShouldBeNil)
+		So(buffer.String(), ShouldEqual, string(expected))
+	})
+}
@@ -2,8 +2,17 @@ package mhist
 
 //SubscriptionMessage is the message the client sends to the server to make sure we can use the same logic for realtime update streams and replications
 //where any server in the cluster can be a listening point for realtime updates, without having endless replication messages bouncing between the servers
+//
+//If Start is set for a subscriber, even to 0, all stored measurements from that timestamp on are sent first, before switching over to realtime updates.
+//Starts overrides Start for the series keys it contains, i.e. to resume every series from its latest received measurement.
+//If Bootstrap is set, the DiskMeta of the server is sent as the very first line, so a new instance can take over names and types.
+//Replications identify their outbox with Origin, so messages that are sent again after a reconnect are only stored once
 type SubscriptionMessage struct {
 	Replication      bool             `json:"replication"`
 	Publisher        bool             `json:"publisher"`
 	FilterDefinition FilterDefinition `json:"filter"`
+	Start            *int64           `json:"start,omitempty"`
+	Starts           map[string]int64 `json:"starts,omitempty"`
+	Bootstrap        bool             `json:"bootstrap,omitempty"`
+	Origin           string           `json:"origin,omitempty"`
 }
@@ -0,0 +1,147 @@
+package mhist
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//SeriesKey identifies a series by its name and tags, i.e. `temperature{device=7,room=kitchen}` with sorted tag keys.
+//A series without tags is identified by its name only. Backslashes, commas, equal signs and braces in tags are escaped with a backslash
+func SeriesKey(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	builder := strings.Builder{}
+	builder.WriteString(name)
+	builder.WriteByte('{')
+	for index, key := range keys {
+		if index > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(escapeTag(key))
+		builder.WriteByte('=')
+		builder.WriteString(escapeTag(tags[key]))
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+//ParseSeriesKey into name and tags. Keys that don't contain a valid tag set are treated as plain names
+func ParseSeriesKey(key string) (name string, tags map[string]string) {
+	if !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key, nil
+	}
+
+	tags = map[string]string{}
+	current := strings.Builder{}
+	tagKey := ""
+	hasKey := false
+	escaped := false
+	for _, r := range key[start+1 : len(key)-1] {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '=' && !hasKey:
+			tagKey = current.String()
+			hasKey = true
+			current.Reset()
+		case r == ',' && hasKey:
+			tags[tagKey] = current.String()
+			hasKey = false
+			current.Reset()
+		case r == '=' || r == ',' || r == '{' || r == '}':
+			return key, nil
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if !hasKey || escaped {
+		return key, nil
+	}
+	tags[tagKey] = current.String()
+	return key[:start], tags
+}
+
+//NameOfSeriesKey without the tags
+func NameOfSeriesKey(key string) string {
+	name, _ := ParseSeriesKey(key)
+	return name
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, `{`, `\{`, `}`, `\}`)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+//TagMatcher matches the value of a tag. Supported operators are `=`, `!=`, `=~` and `!~` (the latter two with regular expressions).
+//A missing tag has the value ""
+type TagMatcher struct {
+	Key      string
+	Operator string
+	Value    string
+	regexp   *regexp.Regexp
+}
+
+var tagMatcherRegexp = regexp.MustCompile(`^([^=!~]+)(=~|!~|!=|=)(.*)$`)
+
+//ParseTagMatcher from its string representation, i.e. `device=7` or `room=~kitchen.*`
+func ParseTagMatcher(s string) (*TagMatcher, error) {
+	matches := tagMatcherRegexp.FindStringSubmatch(s)
+	if len(matches) != 4 {
+		return nil, fmt.Errorf("invalid tag matcher '%v'", s)
+	}
+	matcher := &TagMatcher{Key: matches[1], Operator: matches[2], Value: matches[3]}
+	if matcher.Operator == "=~" || matcher.Operator == "!~" {
+		r, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		matcher.regexp = r
+	}
+	return matcher, nil
+}
+
+//Matches the tags?
+func (m *TagMatcher) Matches(tags map[string]string) bool {
+	value := tags[m.Key]
+	switch m.Operator {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.regexp.MatchString(value)
+	case "!~":
+		return !m.regexp.MatchString(value)
+	}
+	return false
+}
+
+//ParseTagMatchers and fail on the first invalid one
+func ParseTagMatchers(matchers []string) ([]*TagMatcher, error) {
+	parsed := make([]*TagMatcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		tagMatcher, err := ParseTagMatcher(matcher)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, tagMatcher)
+	}
+	return parsed, nil
+}
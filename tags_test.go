@@ -0,0 +1,126 @@
+package mhist
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SeriesKey(t *testing.T) {
+	Convey("SeriesKey()", t, func() {
+		Convey("is the name for series without tags", func() {
+			So(SeriesKey("temperature", nil), ShouldEqual, "temperature")
+		})
+
+		Convey("sorts the tags", func() {
+			So(SeriesKey("temperature", map[string]string{"room": "kitchen", "device": "7"}), ShouldEqual, "temperature{device=7,room=kitchen}")
+		})
+
+		Convey("round trips escaped tags", func() {
+			tags := map[string]string{"a,b": "c=d", "e": `{f}\`}
+			name, parsedTags := ParseSeriesKey(SeriesKey("temperature", tags))
+			So(name, ShouldEqual, "temperature")
+			So(parsedTags, ShouldResemble, tags)
+		})
+
+		Convey("treats names with invalid tag sets as plain names", func() {
+			name, tags := ParseSeriesKey("status{running}")
+			So(name, ShouldEqual, "status{running}")
+			So(tags, ShouldBeNil)
+		})
+	})
+}
+
+func Test_TagMatcher(t *testing.T) {
+	Convey("TagMatcher", t, func() {
+		tags := map[string]string{"device": "7", "room": "kitchen"}
+		matches := func(s string) bool {
+			matcher, err := ParseTagMatcher(s)
+			So(err, ShouldBeNil)
+			return matcher.Matches(tags)
+		}
+		So(matches("device=7"), ShouldBeTrue)
+		So(matches("device!=7"), ShouldBeFalse)
+		So(matches("room=~kit.*"), ShouldBeTrue)
+		So(matches("room!~kit"), ShouldBeTrue)
+		So(matches("floor="), ShouldBeTrue)
+
+		_, err := ParseTagMatcher("device")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func Test_parseTagsParam(t *testing.T) {
+	Convey("takes every tags query param as one matcher, without splitting it on commas", t, func() {
+		params, err := url.ParseQuery("tags=" + url.QueryEscape("room=~a{1,2}") + "&tags=" + url.QueryEscape("label=a,b") + "&tags=")
+		So(err, ShouldBeNil)
+		tags, err := parseTagsParam(params)
+		So(err, ShouldBeNil)
+		So(tags, ShouldResemble, []string{"room=~a{1,2}", "label=a,b"})
+
+		filter := NewFilterCollection(FilterDefinition{Tags: tags})
+		So(filter.Matches(SeriesKey("temperature", map[string]string{"label": "a,b", "room": "aa"})), ShouldBeTrue)
+	})
+}
+
+func Test_FilterCollection_Matches(t *testing.T) {
+	Convey("matches names and tags of series keys", t, func() {
+		filter := NewFilterCollection(FilterDefinition{Names: []string{"temperature", "humidity{device=1}"}, Tags: []string{"device=~1|2"}})
+		So(filter.Matches("temperature{device=1}"), ShouldBeTrue)
+		So(filter.Matches("temperature{device=3}"), ShouldBeFalse)
+		So(filter.Matches("temperature"), ShouldBeFalse)
+		So(filter.Matches("humidity{device=1}"), ShouldBeTrue)
+		So(filter.Matches("humidity{device=2}"), ShouldBeFalse)
+	})
+
+	Convey("can be used concurrently", t, func() {
+		filter := NewFilterCollection(FilterDefinition{Granularity: 10})
+		waitGroup := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			waitGroup.Add(1)
+			go func(i int) {
+				defer waitGroup.Done()
+				for ts := int64(0); ts < 100; ts++ {
+					key := fmt.Sprintf("temperature{device=%v}", ts%10)
+					filter.Matches(key)
+					filter.Process(key, &Numerical{Ts: ts, Value: float64(i)})
+				}
+			}(i)
+		}
+		waitGroup.Wait()
+		So(filter.Matches("temperature{device=1}"), ShouldBeTrue)
+	})
+}
+
+func Test_Message_validate(t *testing.T) {
+	Convey("rejects names that could be mistaken for series keys", t, func() {
+		So((&Message{Name: "temperature"}).validate(), ShouldBeNil)
+		for _, name := range []string{"temperature{device=7}", "temperature{", "a}", "a=b", "a,b"} {
+			So((&Message{Name: name}).validate(), ShouldNotBeNil)
+		}
+		So((&Message{Name: "temperature", Tags: map[string]string{"device": "{7}"}}).validate(), ShouldBeNil)
+	})
+}
+
+func Test_DiskMeta_GetAllStoredInfos(t *testing.T) {
+	Convey("lists tag keys and values per name", t, func() {
+		meta := NewDiskMeta()
+		meta.NameToID = map[string]int64{
+			"temperature{device=2,room=kitchen}": 1,
+			"temperature{device=1}":              2,
+			"status":                             3,
+		}
+		meta.IDToType = map[int64]MeasurementType{1: MeasurementNumerical, 2: MeasurementNumerical, 3: MeasurementCategorical}
+
+		infos := map[string]MeasurementTypeInfo{}
+		for _, info := range meta.GetAllStoredInfos() {
+			infos[info.Name] = info
+		}
+		So(len(infos), ShouldEqual, 2)
+		So(infos["temperature"].Tags, ShouldResemble, map[string][]string{"device": {"1", "2"}, "room": {"kitchen"}})
+		So(infos["status"].Tags, ShouldBeNil)
+	})
+}
@@ -2,14 +2,22 @@ package tcp
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 )
 
+//MaxMessageSize is the maximum length of a message, i.e. a line, in bytes
+const MaxMessageSize = 4 * 1024 * 1024
+
+//ErrMessageTooLarge is returned for a message longer than MaxMessageSize
+var ErrMessageTooLarge = fmt.Errorf("message is longer than %v bytes", MaxMessageSize)
+
 //Connection handles reads and writes to the connection
 type Connection struct {
 	Socket            net.Conn
 	Reader            *bufio.Reader
 	onNewMessage      func(message []byte)
+	onMessageTooLarge func()
 	onConnectionClose func()
 }
 
@@ -23,15 +31,26 @@ func (c *Connection) OnNewMessage(f func([]byte)) {
 	c.onNewMessage = f
 }
 
+//OnMessageTooLarge call f when a message longer than MaxMessageSize was skipped
+func (c *Connection) OnMessageTooLarge(f func()) {
+	c.onMessageTooLarge = f
+}
+
 //Write bytes to connection
 func (c *Connection) Write(byteSlice []byte) {
 	c.Socket.Write(append(byteSlice, '\n'))
 }
 
-//Listen for new messages
+//Listen for new messages, messages longer than MaxMessageSize are skipped
 func (c *Connection) Listen() {
 	for {
-		byteSlice, err := c.Reader.ReadSlice('\n')
+		byteSlice, err := ReadMessage(c.Reader)
+		if err == ErrMessageTooLarge {
+			if c.onMessageTooLarge != nil {
+				c.onMessageTooLarge()
+			}
+			continue
+		}
 		if err != nil {
 			break
 		}
@@ -44,3 +63,30 @@ func (c *Connection) Listen() {
 	}
 	c.Socket.Close()
 }
+
+//ReadMessage reads the next line including the newline. A line longer than MaxMessageSize is skipped and ErrMessageTooLarge is returned,
+//the next read continues with the line after it
+func ReadMessage(reader *bufio.Reader) ([]byte, error) {
+	var message []byte
+	tooLarge := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLarge && len(message)+len(chunk) > MaxMessageSize {
+			tooLarge = true
+			message = nil
+		}
+		if !tooLarge {
+			message = append(message, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLarge {
+			return nil, ErrMessageTooLarge
+		}
+		return message, nil
+	}
+}
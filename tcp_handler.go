@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
 	"sync"
 
@@ -16,33 +17,122 @@ type TCPHandler struct {
 	outboundCollection          *tcp.ConnectionCollection
 	server                      *Server
 	filterPerOutboundConnection map[*tcp.Connection]*FilterCollection
+	replayPerOutboundConnection map[*tcp.Connection]*replayBuffer
 	filterMutex                 *sync.RWMutex
+	appliedSeqPerOrigin         map[string]uint64
+	appliedSeqMutex             sync.Mutex
+	maxReplayBufferSize         int
 	pools                       *Pools
 }
 
+//defaultMaxReplayBufferSize is the maximum amount of realtime updates buffered for a connection while its history is sent.
+//A subscriber that falls further behind is disconnected
+const defaultMaxReplayBufferSize = 100000
+
+//replayBuffer holds the realtime updates for a connection while its history is still being sent
+type replayBuffer struct {
+	pending []namedMeasurement
+	//pendingKeys counts the buffered updates that weren't matched with the history yet, until the history was sent
+	pendingKeys map[replayedKey]int
+	//replayed counts the buffered updates that were part of the history already
+	replayed   map[replayedKey]int
+	overflowed bool
+	sync.Mutex
+}
+
+func newReplayBuffer() *replayBuffer {
+	return &replayBuffer{
+		pendingKeys: map[replayedKey]int{},
+		replayed:    map[replayedKey]int{},
+	}
+}
+
+func (b *replayBuffer) add(name string, measurement Measurement, maxSize int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.pending) >= maxSize {
+		b.overflowed = true
+		return
+	}
+	b.pending = append(b.pending, namedMeasurement{name: name, measurement: measurement.Copy()})
+	if b.pendingKeys != nil {
+		b.pendingKeys[newReplayedKey(name, measurement)]++
+	}
+}
+
+//markReplayed a measurement of the history, so a buffered update that is the same measurement is skipped
+func (b *replayBuffer) markReplayed(name string, measurement Measurement) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.pendingKeys) == 0 {
+		return
+	}
+	key := newReplayedKey(name, measurement)
+	if b.pendingKeys[key] > 0 {
+		b.pendingKeys[key]--
+		b.replayed[key]++
+	}
+}
+
+//take the buffered updates that weren't part of the history
+func (b *replayBuffer) take() (pending []namedMeasurement, overflowed bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.pendingKeys = nil
+	for _, nm := range b.pending {
+		key := newReplayedKey(nm.name, nm.measurement)
+		if b.replayed[key] > 0 {
+			b.replayed[key]--
+			continue
+		}
+		pending = append(pending, nm)
+	}
+	b.pending = nil
+	return pending, b.overflowed
+}
+
+//replayedKey identifies a measurement that was sent as part of the history
+type replayedKey struct {
+	name  string
+	ts    int64
+	value string
+}
+
+func newReplayedKey(name string, measurement Measurement) replayedKey {
+	return replayedKey{name: name, ts: measurement.Timestamp(), value: measurement.ValueString()}
+}
+
+type namedMeasurement struct {
+	name        string
+	measurement Measurement
+}
+
 //NewTCPHandler sets the wrapped handlers callbacks correctly, Run() still has to be called
+//The sequence numbers of replicated messages that were stored already are loaded from the disk store
 func NewTCPHandler(server *Server, port int, pools *Pools) *TCPHandler {
+	appliedSeqPerOrigin := make(map[string]uint64)
+	if server.store != nil && server.store.diskStore != nil {
+		appliedSeqPerOrigin = server.store.diskStore.meta.appliedSeqs()
+	}
 	return &TCPHandler{
 		address:                     fmt.Sprintf("0.0.0.0:%v", port),
 		server:                      server,
 		outboundCollection:          &tcp.ConnectionCollection{},
 		filterMutex:                 &sync.RWMutex{},
 		filterPerOutboundConnection: make(map[*tcp.Connection]*FilterCollection),
+		replayPerOutboundConnection: make(map[*tcp.Connection]*replayBuffer),
+		appliedSeqPerOrigin:         appliedSeqPerOrigin,
+		maxReplayBufferSize:         defaultMaxReplayBufferSize,
 		pools:                       pools,
 	}
 }
 
 //Notify handler about new message
 func (h *TCPHandler) Notify(name string, measurement Measurement) {
-	m := h.pools.GetMessage()
-	defer h.pools.PutMessage(m)
-
-	m.Reset()
-	m.Name = name
-	m.Value = measurement.ValueInterface()
-	m.Timestamp = measurement.Timestamp()
-
-	byteSlice, err := json.Marshal(m)
+	byteSlice, err := h.marshalMeasurement(name, measurement)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -50,10 +140,20 @@ func (h *TCPHandler) Notify(name string, measurement Measurement) {
 	h.filterMutex.RLock()
 	defer h.filterMutex.RUnlock()
 	h.outboundCollection.ForEach(func(conn *tcp.Connection) {
+		if replay := h.replayPerOutboundConnection[conn]; replay != nil {
+			replay.add(name, measurement, h.maxReplayBufferSize)
+			return
+		}
 		filter := h.filterPerOutboundConnection[conn]
 		if filter != nil {
-			if filter.Passes(name, measurement) {
+			forwarded, ok := filter.Process(name, measurement)
+			if !ok {
+				return
+			}
+			if forwarded == measurement {
 				conn.Write(byteSlice)
+			} else {
+				h.writeMeasurement(conn, name, forwarded)
 			}
 		} else {
 			fmt.Println("Filter for outbound connection was nil, please investigate!")
@@ -79,17 +179,143 @@ func (h *TCPHandler) Run() {
 	}
 }
 
-func (h *TCPHandler) onNewMessage(byteSlice []byte, isReplication bool) {
-	h.server.handleNewMessage(byteSlice, isReplication, func(err error, _ int) {
+//onNewMessage stores the measurements of the message, or applies the replicated deletion, rename or import
+func (h *TCPHandler) onNewMessage(byteSlice []byte, isReplication bool) error {
+	if isReplication && isDeletionMessage(byteSlice) {
+		return h.server.handleDeletionMessage(byteSlice, true)
+	}
+	if isReplication && isRenameMessage(byteSlice) {
+		return h.server.handleRenameMessage(byteSlice, true)
+	}
+	if isReplication && isImportMessage(byteSlice) {
+		return h.server.handleImportMessage(byteSlice, true)
+	}
+	if isBatch(byteSlice) {
+		response, err := h.server.handleNewMessages(byteSlice, isReplication)
+		if err != nil {
+			return err
+		}
+		for _, itemErr := range response.Errors {
+			fmt.Printf("rejected message %v of batch: %v\n", itemErr.Index, itemErr.Error)
+		}
+		return nil
+	}
+	var err error
+	h.server.handleNewMessage(byteSlice, isReplication, func(handleErr error, _ int) {
+		err = handleErr
+	})
+	return err
+}
+
+//onPublishedMessage stores the measurements of a publisher. Rejected measurements are answered on the same connection,
+//with an error for a single measurement and with the response listing the rejected items for a batch
+func (h *TCPHandler) onPublishedMessage(conn *tcp.Connection, byteSlice []byte) {
+	if isBatch(byteSlice) {
+		response, err := h.server.handleNewMessages(byteSlice, false)
+		if err != nil {
+			h.writeError(conn, err)
+			return
+		}
+		if len(response.Errors) == 0 {
+			return
+		}
+		data, err := json.Marshal(response)
 		if err != nil {
 			fmt.Println(err)
+			return
 		}
+		conn.Write(data)
+		return
+	}
+	h.server.handleNewMessage(byteSlice, false, func(err error, _ int) {
+		h.writeError(conn, err)
 	})
 }
 
+func (h *TCPHandler) writeError(conn *tcp.Connection, err error) {
+	data, err := json.Marshal(&errorResponse{Error: err.Error()})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn.Write(data)
+}
+
+//onReplicatedMessage stores the message of a replication outbox and acknowledges it.
+//Messages without a sequence number are handled like any other message
+func (h *TCPHandler) onReplicatedMessage(conn *tcp.Connection, origin string, byteSlice []byte) {
+	envelope := &replicationEnvelope{}
+	err := json.Unmarshal(byteSlice, envelope)
+	if err != nil || envelope.Seq == 0 {
+		err = h.onNewMessage(byteSlice, true)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	ack := &replicationAck{Ack: envelope.Seq}
+	if h.markApplied(origin, envelope.Seq) {
+		err = h.onNewMessage(envelope.Message, true)
+		if _, ok := err.(*notStoredError); ok {
+			//without an ack the outbox sends the message again once it reconnected
+			fmt.Println(err)
+			h.unmarkApplied(origin, envelope.Seq)
+			conn.Socket.Close()
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			ack.Error = err.Error()
+		}
+	}
+
+	data, err := json.Marshal(ack)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn.Write(data)
+}
+
+//markApplied returns false if the message with seq of origin was already stored, i.e. it was sent again because the ack got lost
+func (h *TCPHandler) markApplied(origin string, seq uint64) bool {
+	if origin == "" {
+		return true
+	}
+	h.appliedSeqMutex.Lock()
+	defer h.appliedSeqMutex.Unlock()
+
+	if seq <= h.appliedSeqPerOrigin[origin] {
+		return false
+	}
+	h.setAppliedSeq(origin, seq)
+	return true
+}
+
+//unmarkApplied the message with seq of origin, so it is stored when it is sent again
+func (h *TCPHandler) unmarkApplied(origin string, seq uint64) {
+	if origin == "" {
+		return
+	}
+	h.appliedSeqMutex.Lock()
+	defer h.appliedSeqMutex.Unlock()
+
+	if h.appliedSeqPerOrigin[origin] == seq {
+		h.setAppliedSeq(origin, seq-1)
+	}
+}
+
+//setAppliedSeq of origin and persist it with the disk store, so messages aren't stored twice after a restart either
+func (h *TCPHandler) setAppliedSeq(origin string, seq uint64) {
+	h.appliedSeqPerOrigin[origin] = seq
+	if h.server.store != nil && h.server.store.diskStore != nil {
+		h.server.store.diskStore.meta.setAppliedSeq(origin, seq)
+	}
+}
+
 func (h *TCPHandler) handleNewConnection(conn net.Conn) {
 	reader := bufio.NewReader(conn)
-	byteSlice, err := reader.ReadSlice('\n')
+	byteSlice, err := tcp.ReadMessage(reader)
 	if err != nil {
 		fmt.Println(err)
 		conn.Close()
@@ -97,6 +323,9 @@ func (h *TCPHandler) handleNewConnection(conn net.Conn) {
 	}
 	m := &SubscriptionMessage{}
 	err = json.Unmarshal(byteSlice, m)
+	if err == nil {
+		err = m.FilterDefinition.Validate()
+	}
 	if err != nil {
 		fmt.Println(err)
 		conn.Close()
@@ -106,26 +335,153 @@ func (h *TCPHandler) handleNewConnection(conn net.Conn) {
 		Socket: conn,
 		Reader: reader,
 	}
-	if m.Publisher {
+	if m.Publisher && m.Replication {
+		connectionWrapper.OnNewMessage(func(byteSlice []byte) {
+			h.onReplicatedMessage(connectionWrapper, m.Origin, byteSlice)
+		})
+		connectionWrapper.OnMessageTooLarge(func() {
+			fmt.Printf("skipped replicated message of %v: %v\n", m.Origin, tcp.ErrMessageTooLarge)
+		})
+	} else if m.Publisher {
 		connectionWrapper.OnNewMessage(func(byteSlice []byte) {
-			h.onNewMessage(byteSlice, m.Replication)
+			h.onPublishedMessage(connectionWrapper, byteSlice)
+		})
+		connectionWrapper.OnMessageTooLarge(func() {
+			h.writeError(connectionWrapper, tcp.ErrMessageTooLarge)
 		})
 	} else {
+		if m.Bootstrap {
+			err = h.writeMeta(connectionWrapper)
+			if err != nil {
+				fmt.Println(err)
+				conn.Close()
+				return
+			}
+		}
 		h.addFilterForConnection(m.FilterDefinition, connectionWrapper)
+		if m.Start != nil {
+			h.addReplayForConnection(connectionWrapper)
+		}
 		h.outboundCollection.AddConnection(connectionWrapper)
 		connectionWrapper.OnConnectionClose(func() {
 			h.outboundCollection.RemoveConnection(connectionWrapper)
 			h.removeFilterForConnection(connectionWrapper)
 		})
+		if m.Start != nil {
+			go h.replayHistory(connectionWrapper, *m.Start, m.Starts, m.Bootstrap)
+		}
 	}
 	connectionWrapper.Listen()
 }
 
+//replayHistory sends all stored measurements from start on to the connection and then switches it over to realtime updates.
+//The history is streamed one series after another, every series in time order.
+//Realtime updates that arrived in the meantime are buffered and sent afterwards, without holding up other connections.
+//An update is only skipped if the same measurement was part of the history already.
+//For bootstrapping, the end of the history is marked with historySentMessage
+func (h *TCPHandler) replayHistory(conn *tcp.Connection, start int64, starts map[string]int64, bootstrap bool) {
+	h.filterMutex.RLock()
+	filter := h.filterPerOutboundConnection[conn]
+	replay := h.replayPerOutboundConnection[conn]
+	h.filterMutex.RUnlock()
+	if filter == nil || replay == nil {
+		return
+	}
+
+	err := h.server.store.StreamMeasurementsInTimeRange(start, math.MaxInt64, FilterDefinition{Names: filter.Definition.Names, Tags: filter.Definition.Tags}, func(name string, measurements []Measurement) error {
+		//earlier versions of a series are sent with its key, like they were received
+		name = h.server.store.seriesKeyOf(name)
+		seriesStart, hasStart := starts[name]
+		for _, m := range measurements {
+			if hasStart && m.Timestamp() < seriesStart {
+				continue
+			}
+			replay.markReplayed(name, m)
+			if forwarded, ok := filter.Process(name, m); ok {
+				h.writeMeasurement(conn, name, forwarded)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println("couldn't send the history to a subscriber, closing the connection:", err)
+		conn.Socket.Close()
+		return
+	}
+	if bootstrap {
+		conn.Write([]byte(historySentMessage))
+	}
+
+	for {
+		pending, overflowed := replay.take()
+		if overflowed {
+			fmt.Println("subscriber fell too far behind while its history was sent, closing the connection")
+			conn.Socket.Close()
+			return
+		}
+		if len(pending) == 0 {
+			h.filterMutex.Lock()
+			//updates that were buffered since the last take have to be sent first, before the connection gets realtime updates
+			done := len(replay.pending) == 0 && !replay.overflowed
+			if done {
+				delete(h.replayPerOutboundConnection, conn)
+			}
+			h.filterMutex.Unlock()
+			if done {
+				return
+			}
+			continue
+		}
+		for _, nm := range pending {
+			if forwarded, ok := filter.Process(nm.name, nm.measurement); ok {
+				h.writeMeasurement(conn, nm.name, forwarded)
+			}
+		}
+	}
+}
+
+
+
+func (h *TCPHandler) writeMeasurement(conn *tcp.Connection, name string, measurement Measurement) {
+	byteSlice, err := h.marshalMeasurement(name, measurement)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn.Write(byteSlice)
+}
+
+func (h *TCPHandler) writeMeta(conn *tcp.Connection) error {
+	meta := NewDiskMeta()
+	if h.server.store.diskStore != nil {
+		meta = h.server.store.diskStore.meta
+	}
+	byteSlice, err := meta.Marshal()
+	if err != nil {
+		return err
+	}
+	conn.Write(byteSlice)
+	return nil
+}
+
+func (h *TCPHandler) marshalMeasurement(name string, measurement Measurement) ([]byte, error) {
+	m := h.pools.GetMessage()
+	defer h.pools.PutMessage(m)
+
+	m.Reset()
+	m.SetSeriesKey(name)
+	m.Value = measurement.ValueInterface()
+	m.Timestamp = measurement.Timestamp()
+
+	return json.Marshal(m)
+}
+
 func (h *TCPHandler) removeFilterForConnection(conn *tcp.Connection) {
 	h.filterMutex.Lock()
 	defer h.filterMutex.Unlock()
 
 	delete(h.filterPerOutboundConnection, conn)
+	delete(h.replayPerOutboundConnection, conn)
 }
 
 func (h *TCPHandler) addFilterForConnection(filterDefinition FilterDefinition, conn *tcp.Connection) {
@@ -135,3 +491,11 @@ func (h *TCPHandler) addFilterForConnection(filterDefinition FilterDefinition, c
 	filter := NewFilterCollection(filterDefinition)
 	h.filterPerOutboundConnection[conn] = filter
 }
+
+func (h *TCPHandler) addReplayForConnection(conn *tcp.Connection) {
+	h.filterMutex.Lock()
+	defer h.filterMutex.Unlock()
+
+	h.replayPerOutboundConnection[conn] = newReplayBuffer()
+}
+
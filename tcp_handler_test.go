@@ -0,0 +1,242 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/codeuniversity/ppp-mhist/tcp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_replayHistory(t *testing.T) {
+	Convey("replays the history before realtime updates without gaps or duplicates", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		server := &Server{store: store, pools: pools}
+		handler := NewTCPHandler(server, 0, pools)
+		store.AddSubscriber(handler)
+		for i := int64(1); i <= 3; i++ {
+			store.Add("temperature", &Numerical{Ts: i * 1000, Value: float64(i)}, false)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		go handler.handleNewConnection(serverConn)
+		start := int64(2000)
+		subscription, err := json.Marshal(&SubscriptionMessage{Start: &start})
+		So(err, ShouldBeNil)
+		_, err = clientConn.Write(append(subscription, '\n'))
+		So(err, ShouldBeNil)
+
+		go store.Add("temperature", &Numerical{Ts: 4000, Value: 4}, false)
+
+		reader := bufio.NewReader(clientConn)
+		timestamps := []int64{}
+		for len(timestamps) < 3 {
+			line, err := reader.ReadBytes('\n')
+			So(err, ShouldBeNil)
+			message := &Message{}
+			So(json.Unmarshal(line, message), ShouldBeNil)
+			timestamps = append(timestamps, message.Timestamp)
+		}
+		So(timestamps, ShouldResemble, []int64{2000, 3000, 4000})
+
+		clientConn.Close()
+		store.Shutdown()
+	})
+}
+
+func Test_replayHistory_fromZero(t *testing.T) {
+	Convey("replays every series from timestamp 0 on, one after another", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		handler := NewTCPHandler(&Server{store: store, pools: pools}, 0, pools)
+		store.AddSubscriber(handler)
+		defer store.Shutdown()
+		for i := int64(1); i <= 2; i++ {
+			store.Add("temperature", &Numerical{Ts: i * 1000, Value: float64(i)}, false)
+			store.Add("pressure", &Numerical{Ts: i * 1000, Value: float64(i)}, false)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go handler.handleNewConnection(serverConn)
+		start := int64(0)
+		subscription, err := json.Marshal(&SubscriptionMessage{Start: &start})
+		So(err, ShouldBeNil)
+		_, err = clientConn.Write(append(subscription, '\n'))
+		So(err, ShouldBeNil)
+
+		reader := bufio.NewReader(clientConn)
+		received := []string{}
+		for len(received) < 4 {
+			line, err := reader.ReadBytes('\n')
+			So(err, ShouldBeNil)
+			message := &Message{}
+			So(json.Unmarshal(line, message), ShouldBeNil)
+			received = append(received, message.Name+"@"+strconv.FormatInt(message.Timestamp, 10))
+		}
+		So(received, ShouldResemble, []string{"pressure@1000", "pressure@2000", "temperature@1000", "temperature@2000"})
+	})
+}
+
+func Test_replayHistory_overlap(t *testing.T) {
+	Convey("replaying the history", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		server := &Server{store: store, pools: pools}
+		handler := NewTCPHandler(server, 0, pools)
+		store.AddSubscriber(handler)
+		defer store.Shutdown()
+		for i := int64(1); i <= 3; i++ {
+			store.Add("temperature", &Numerical{Ts: i * 1000, Value: float64(i)}, false)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go handler.handleNewConnection(serverConn)
+		start := int64(2000)
+		subscription, err := json.Marshal(&SubscriptionMessage{Start: &start})
+		So(err, ShouldBeNil)
+		_, err = clientConn.Write(append(subscription, '\n'))
+		So(err, ShouldBeNil)
+
+		reader := bufio.NewReader(clientConn)
+		read := func() (*Message, error) {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return nil, err
+			}
+			message := &Message{}
+			return message, json.Unmarshal(line, message)
+		}
+		//the history was read from the store before its first measurement is sent
+		first, err := read()
+		So(err, ShouldBeNil)
+		So(first.Timestamp, ShouldEqual, 2000)
+
+		Convey("doesn't drop late updates or updates with the timestamp of a replayed measurement", func() {
+			store.Add("temperature", &Numerical{Ts: 3000, Value: 5}, false)
+			store.Add("temperature", &Numerical{Ts: 2500, Value: 6}, false)
+
+			values := []float64{}
+			for len(values) < 3 {
+				message, err := read()
+				So(err, ShouldBeNil)
+				values = append(values, message.Value.(float64))
+			}
+			So(values, ShouldResemble, []float64{3, 5, 6})
+		})
+
+		Convey("disconnects a subscriber that falls too far behind", func() {
+			handler.maxReplayBufferSize = 1
+			store.Add("temperature", &Numerical{Ts: 4000, Value: 4}, false)
+			store.Add("temperature", &Numerical{Ts: 5000, Value: 5}, false)
+
+			message, err := read()
+			So(err, ShouldBeNil)
+			So(message.Timestamp, ShouldEqual, 3000)
+			_, err = read()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_onPublishedMessage(t *testing.T) {
+	Convey("answers rejected measurements of a publisher", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		handler := NewTCPHandler(&Server{store: store, pools: pools}, 0, pools)
+		defer store.Shutdown()
+
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		go handler.handleNewConnection(serverConn)
+		subscription, err := json.Marshal(&SubscriptionMessage{Publisher: true})
+		So(err, ShouldBeNil)
+		_, err = clientConn.Write(append(subscription, '\n'))
+		So(err, ShouldBeNil)
+		reader := bufio.NewReader(clientConn)
+
+		_, err = clientConn.Write([]byte("{\"name\":\"temperature\",\"value\":true}\n"))
+		So(err, ShouldBeNil)
+		line, err := reader.ReadBytes('\n')
+		So(err, ShouldBeNil)
+		errResponse := &errorResponse{}
+		So(json.Unmarshal(line, errResponse), ShouldBeNil)
+		So(errResponse.Error, ShouldEqual, "value is neither a float nor a string")
+
+		_, err = clientConn.Write([]byte("[{\"name\":\"temperature\",\"value\":1},{\"name\":\"\",\"value\":2}]\n"))
+		So(err, ShouldBeNil)
+		line, err = reader.ReadBytes('\n')
+		So(err, ShouldBeNil)
+		response := &batchResponse{}
+		So(json.Unmarshal(line, response), ShouldBeNil)
+		So(response.Accepted, ShouldEqual, 1)
+		So(response.Errors, ShouldResemble, []itemError{{Index: 1, Error: "name can't be empty"}})
+	})
+}
+
+func Test_onPublishedMessage_longLines(t *testing.T) {
+	Convey("over a tcp connection", t, func() {
+		store := NewStore(100 * 1024 * 1024)
+		pools := NewPools(store)
+		handler := NewTCPHandler(&Server{store: store, pools: pools}, 0, pools)
+		defer store.Shutdown()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				handler.handleNewConnection(conn)
+			}
+		}()
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer clientConn.Close()
+		subscription, err := json.Marshal(&SubscriptionMessage{Publisher: true})
+		So(err, ShouldBeNil)
+		_, err = clientConn.Write(append(subscription, '\n'))
+		So(err, ShouldBeNil)
+		reader := bufio.NewReader(clientConn)
+		readError := func() string {
+			line, err := reader.ReadBytes('\n')
+			So(err, ShouldBeNil)
+			errResponse := &errorResponse{}
+			So(json.Unmarshal(line, errResponse), ShouldBeNil)
+			return errResponse.Error
+		}
+
+		Convey("stores batches longer than the read buffer", func() {
+			batch := []*Message{}
+			for i := 1; i <= 200; i++ {
+				batch = append(batch, &Message{Name: "temperature", Value: float64(i), Timestamp: int64(i) * 1000})
+			}
+			data, err := json.Marshal(batch)
+			So(err, ShouldBeNil)
+			So(len(data), ShouldBeGreaterThan, 4096)
+			_, err = clientConn.Write(append(data, '\n'))
+			So(err, ShouldBeNil)
+			_, err = clientConn.Write([]byte("{\"name\":\"temperature\",\"value\":true}\n"))
+			So(err, ShouldBeNil)
+
+			So(readError(), ShouldEqual, "value is neither a float nor a string")
+			So(len(store.GetMeasurementsInTimeRange(0, 1000*1000, FilterDefinition{})["temperature"]), ShouldEqual, 200)
+		})
+
+		Convey("answers lines longer than the maximum message size with an error and keeps the connection", func() {
+			_, err = clientConn.Write(append(bytes.Repeat([]byte("a"), tcp.MaxMessageSize+1), '\n'))
+			So(err, ShouldBeNil)
+			So(readError(), ShouldEqual, tcp.ErrMessageTooLarge.Error())
+
+			_, err = clientConn.Write([]byte("{\"name\":\"temperature\",\"value\":true}\n"))
+			So(err, ShouldBeNil)
+			So(readError(), ShouldEqual, "value is neither a float nor a string")
+		})
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+
+	"github.com/codeuniversity/ppp-mhist/tcp"
 )
 
 //TCPSubscriber is a TCPClient that can receive messages
@@ -24,13 +26,24 @@ func NewTCPSubscriber(address string, filterDefinition FilterDefinition, channel
 	}
 }
 
+//NewHistoricalTCPSubscriber initializes a new client, that receives all stored measurements from start on, before receiving realtime updates
+func NewHistoricalTCPSubscriber(address string, filterDefinition FilterDefinition, start int64, channel chan []byte) *TCPSubscriber {
+	subscriber := NewTCPSubscriber(address, filterDefinition, channel)
+	subscriber.subscriptionMessage.Start = &start
+	return subscriber
+}
+
 //Read incoming messages
 func (s *TCPSubscriber) Read() error {
 	s.Lock()
 	defer s.Unlock()
 	reader := bufio.NewReader(s.conn)
 	for {
-		byteSlice, err := reader.ReadSlice('\n')
+		byteSlice, err := tcp.ReadMessage(reader)
+		if err == tcp.ErrMessageTooLarge {
+			fmt.Println(err)
+			continue
+		}
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -0,0 +1,328 @@
+package mhist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var walFilePath = "wal.log"
+
+const walSyncInterval = time.Second
+
+//WALSyncPolicy defines when the write-ahead log is synced to disk
+type WALSyncPolicy string
+
+const (
+	//WALSyncAlways syncs after every written measurement
+	WALSyncAlways WALSyncPolicy = "always"
+
+	//WALSyncInterval syncs once every walSyncInterval
+	WALSyncInterval WALSyncPolicy = "interval"
+
+	//WALSyncNever leaves syncing to the os
+	WALSyncNever WALSyncPolicy = "never"
+)
+
+//ParseWALSyncPolicy from its string representation
+func ParseWALSyncPolicy(policy string) (WALSyncPolicy, error) {
+	switch WALSyncPolicy(policy) {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return WALSyncPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown wal sync policy '%v'", policy)
+}
+
+//writeAheadLog is an append-only log of the measurements that are buffered in the block but not committed to a data file yet.
+//It starts with walFileMagic followed by the format version and its generation as uint64, which is random and changes every time the log is truncated.
+//Every record is framed like a block and contains <varint id><uvarint type><varint ts><value>.
+//Logs written before the header was added start with the first record and have generation 0
+type writeAheadLog struct {
+	file       *os.File
+	syncPolicy WALSyncPolicy
+	unsynced   bool
+	generation uint64
+	headerSize int64
+	size       int64
+}
+
+const walFileMagic = "MHWL"
+
+const walFormatVersion = 1
+
+const walFileHeaderSize = int64(len(walFileMagic) + 1 + 8)
+
+func openWriteAheadLog(syncPolicy WALSyncPolicy) (*writeAheadLog, error) {
+	file, err := os.OpenFile(filepath.Join(dataPath, walFilePath), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{file: file, syncPolicy: syncPolicy}
+	header := make([]byte, walFileHeaderSize)
+	n, err := io.ReadFull(file, header)
+	switch {
+	case err == nil && string(header[:len(walFileMagic)]) == walFileMagic:
+		w.generation = binary.BigEndian.Uint64(header[len(walFileMagic)+1:])
+		w.headerSize = walFileHeaderSize
+	case n == 0:
+		err = w.truncate()
+	default:
+		//a log of an earlier version, its records are replayed from the start
+		err = nil
+	}
+	if err == nil {
+		w.size, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *writeAheadLog) append(id int64, m Measurement) error {
+	payload := appendVarint(nil, id)
+	payload = appendUvarint(payload, uint64(m.Type()))
+	payload = appendVarint(payload, m.Timestamp())
+	switch value := m.(type) {
+	case *Numerical:
+		valueBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(valueBytes, math.Float64bits(value.Value))
+		payload = append(payload, valueBytes...)
+	case *Categorical:
+		payload = appendUvarint(payload, uint64(len(value.Value)))
+		payload = append(payload, value.Value...)
+	}
+
+	frame := appendFrame(nil, payload)
+	_, err := w.file.Write(frame)
+	if err == nil && w.syncPolicy == WALSyncAlways {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		//a partially written record would end the replay before the records that follow it
+		w.file.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(frame))
+	if w.syncPolicy != WALSyncAlways {
+		w.unsynced = true
+	}
+	return nil
+}
+
+//replay calls f for every record in the log. A torn record at the end, i.e. after a crash, ends the replay
+func (w *writeAheadLog) replay(f func(id int64, m Measurement)) error {
+	_, err := w.file.Seek(w.headerSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	for {
+		payload, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, m, err := decodeWALRecord(payload)
+		if err != nil {
+			return err
+		}
+		f(id, m)
+	}
+}
+
+func (w *writeAheadLog) sync() error {
+	if !w.unsynced || w.syncPolicy != WALSyncInterval {
+		return nil
+	}
+	w.unsynced = false
+	return w.file.Sync()
+}
+
+//truncate the log, i.e. after all contained measurements were committed. It starts over with a new generation
+func (w *writeAheadLog) truncate() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	generation := make([]byte, 8)
+	_, err = rand.Read(generation)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Write(append(append([]byte(walFileMagic), walFormatVersion), generation...))
+	if err != nil {
+		return err
+	}
+	w.generation = binary.BigEndian.Uint64(generation)
+	w.headerSize = walFileHeaderSize
+	w.size = walFileHeaderSize
+	w.unsynced = false
+	return w.file.Sync()
+}
+
+//commitFrame precedes the frames of a data file that hold the measurements of the current generation of the log.
+//Logs without a generation aren't marked
+func (w *writeAheadLog) commitFrame() []byte {
+	if w.generation == 0 {
+		return nil
+	}
+	return appendFrame(nil, appendUvarint([]byte{walCommitFrame}, w.generation))
+}
+
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
+
+func decodeWALRecord(payload []byte) (id int64, m Measurement, err error) {
+	reader := bytes.NewReader(payload)
+	id, err = binary.ReadVarint(reader)
+	if err != nil {
+		return 0, nil, errCorruptBlock
+	}
+	measurementType, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, nil, errCorruptBlock
+	}
+	ts, err := binary.ReadVarint(reader)
+	if err != nil {
+		return 0, nil, errCorruptBlock
+	}
+
+	switch MeasurementType(measurementType) {
+	case MeasurementNumerical:
+		valueBytes := make([]byte, 8)
+		_, err = io.ReadFull(reader, valueBytes)
+		if err != nil {
+			return 0, nil, errCorruptBlock
+		}
+		return id, &Numerical{Ts: ts, Value: math.Float64frombits(binary.BigEndian.Uint64(valueBytes))}, nil
+	case MeasurementCategorical:
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return 0, nil, errCorruptBlock
+		}
+		value := make([]byte, length)
+		_, err = io.ReadFull(reader, value)
+		if err != nil {
+			return 0, nil, errCorruptBlock
+		}
+		return id, &Categorical{Ts: ts, Value: string(value)}, nil
+	}
+	return 0, nil, fmt.Errorf("unknown measurement type %v", measurementType)
+}
+
+//recover the data files after a crash, before the replayed measurements of the log are committed.
+//A torn append at the end of the latest data file is cut off. If a data file holds the replayed measurements already,
+//because the process crashed after they were written but before the log was truncated, they are dropped instead of being written twice
+func (s *DiskStore) recover() {
+	fileList, err := GetSortedFileList()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	committed := false
+	for index, file := range fileList {
+		//the block was appended to the latest file or written to a file with its time range
+		isLatest := index == len(fileList)-1
+		overlaps := s.block.Len() > 0 && file.oldestTs <= s.block.LatestTs() && file.latestTs >= s.block.OldestTs()
+		if file.isCsv() || !(isLatest || overlaps) {
+			continue
+		}
+		holdsBlock, err := recoverDataFile(file.name, s.wal.generation)
+		if err != nil {
+			fmt.Println(file.name, err)
+			continue
+		}
+		if !holdsBlock || s.block.Len() == 0 {
+			continue
+		}
+		committed = true
+		//the crash could have happened before the file was renamed after its new time range
+		oldestTs, latestTs := minTs(file.oldestTs, s.block.OldestTs()), file.latestTs
+		if s.block.LatestTs() > latestTs {
+			latestTs = s.block.LatestTs()
+		}
+		if newName := fileNameFromTs(oldestTs, latestTs); newName != file.name {
+			err = renameDataFile(file.name, newName)
+			if err != nil {
+				fmt.Println(file.name, err)
+			}
+		}
+	}
+	if !committed {
+		return
+	}
+	s.block.Reset()
+	err = s.wal.truncate()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+//recoverDataFile cuts a torn append off the end of the binary data file and moves it into the quarantine directory.
+//Returns true if the file holds the complete measurements of the log generation
+func recoverDataFile(name string, generation uint64) (bool, error) {
+	path := filepath.Join(dataPath, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if len(data) < len(blockFileHeader) && bytes.HasPrefix(blockFileHeader, data) {
+		//the file was created but its header was never written completely
+		quarantined, err := quarantineFile(name)
+		if err == nil {
+			fmt.Println(name, "was torn, it was", quarantined)
+		}
+		return false, err
+	}
+	if !bytes.HasPrefix(data, blockFileHeader) {
+		return false, nil
+	}
+
+	commitStart := -1
+	position := len(blockFileHeader)
+	validEnd, err := scanBlockData(data, func(kind byte, payload []byte) error {
+		start := position
+		position += len(appendUvarint(nil, uint64(len(payload)+1))) + len(payload) + 1 + 4
+		if kind == walCommitFrame && generation != 0 {
+			if frameGeneration, n := binary.Uvarint(payload); n > 0 && frameGeneration == generation {
+				commitStart = start
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return commitStart >= 0, nil
+	}
+	if validEnd == 0 {
+		return false, err
+	}
+	//an incomplete append of the generation is cut off completely, it is written again from the log
+	cut := validEnd
+	if commitStart >= 0 {
+		cut = commitStart
+	}
+	quarantined, err := quarantine(name, data[cut:])
+	if err != nil {
+		return false, err
+	}
+	os.Remove(indexPath(name))
+	fmt.Printf("%v ends with a torn frame, %v bytes were moved to %v\n", name, len(data)-cut, quarantined)
+	return false, writeFileAtomically(path, data[:cut])
+}
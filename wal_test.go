@@ -0,0 +1,115 @@
+package mhist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_writeAheadLog(t *testing.T) {
+	Convey("write-ahead log", t, func() {
+		dir := withTempDataPath(t)
+
+		wal, err := openWriteAheadLog(WALSyncAlways)
+		So(err, ShouldBeNil)
+		So(wal.append(1, &Numerical{Ts: 1000, Value: 1.5}), ShouldBeNil)
+		So(wal.append(2, &Categorical{Ts: 1001, Value: "on"}), ShouldBeNil)
+
+		Convey("replays the appended measurements", func() {
+			block := NewBlock()
+			So(wal.replay(block.Add), ShouldBeNil)
+			So(block.series[1].numericals, ShouldResemble, []float64{1.5})
+			So(block.series[2].categoricals, ShouldResemble, []string{"on"})
+		})
+
+		Convey("is empty after truncating", func() {
+			So(wal.truncate(), ShouldBeNil)
+			So(wal.append(1, &Numerical{Ts: 2000, Value: 2.5}), ShouldBeNil)
+			block := NewBlock()
+			So(wal.replay(block.Add), ShouldBeNil)
+			So(block.series[1].timestamps, ShouldResemble, []int64{2000})
+		})
+
+		Convey("is committed by a new DiskStore after a crash", func() {
+			meta := InitMetaFromDisk()
+			meta.GetOrCreateID("temperature", MeasurementNumerical)
+			meta.GetOrCreateID("status", MeasurementCategorical)
+			So(wal.close(), ShouldBeNil)
+
+			store, err := NewDiskStore(NewPools(NewStore(100*1024*1024)), DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024})
+			So(err, ShouldBeNil)
+			So(store.block.Len(), ShouldEqual, 0)
+			result := store.GetMeasurementsInTimeRange(0, 3000, FilterDefinition{})
+			store.Shutdown()
+			So(result["temperature"], ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1.5}})
+			So(result["status"], ShouldResemble, []Measurement{&Categorical{Ts: 1001, Value: "on"}})
+
+			info, err := os.Stat(filepath.Join(dir, walFilePath))
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, walFileHeaderSize)
+		})
+		wal.close()
+	})
+}
+
+func Test_DiskStore_recover(t *testing.T) {
+	Convey("after a crash the DiskStore", t, func() {
+		dir := withTempDataPath(t)
+
+		config := DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024, WALSyncPolicy: WALSyncAlways}
+		diskStore, err := NewDiskStore(NewPools(nil), config)
+		So(err, ShouldBeNil)
+		So(diskStore.Add("temperature", &Numerical{Ts: 1000, Value: 1}), ShouldBeNil)
+		So(diskStore.Add("temperature", &Numerical{Ts: 1010, Value: 2}), ShouldBeNil)
+		//crash after the block was written, but before the log was truncated
+		diskStore.inListenRoutine(func() {
+			err = diskStore.writeBlock()
+			diskStore.block.Reset()
+		})
+		So(err, ShouldBeNil)
+		diskStore.Shutdown()
+		name := fileNameFromTs(1000, 1010)
+		read := func() []Measurement {
+			diskStore, err := NewDiskStore(NewPools(nil), config)
+			So(err, ShouldBeNil)
+			defer diskStore.Shutdown()
+			return diskStore.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"]
+		}
+
+		Convey("doesn't write the measurements of the log twice", func() {
+			So(read(), ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1}, &Numerical{Ts: 1010, Value: 2}})
+			So(read(), ShouldHaveLength, 2)
+		})
+
+		Convey("cuts a torn write off the end of the latest data file and writes it again", func() {
+			path := filepath.Join(dir, name)
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(os.Truncate(path, info.Size()-3), ShouldBeNil)
+
+			So(read(), ShouldResemble, []Measurement{&Numerical{Ts: 1000, Value: 1}, &Numerical{Ts: 1010, Value: 2}})
+			quarantined, err := ioutil.ReadDir(filepath.Join(dir, quarantineDirectory))
+			So(err, ShouldBeNil)
+			So(quarantined, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("rejects measurements that can't be written to the log", t, func() {
+		withTempDataPath(t)
+
+		store := NewStore(1024 * 1024)
+		diskStore, err := NewDiskStore(NewPools(store), DiskStoreConfig{MaxFileSize: 1024, MaxDiskSize: 1024 * 1024})
+		So(err, ShouldBeNil)
+		store.SetDiskStore(diskStore)
+		defer diskStore.Shutdown()
+		diskStore.inListenRoutine(func() {
+			diskStore.wal.file.Close()
+		})
+
+		So(store.Add("temperature", &Numerical{Ts: 1000, Value: 1}, false), ShouldNotBeNil)
+		So(store.GetMeasurementsInTimeRange(0, 2000, FilterDefinition{})["temperature"], ShouldBeEmpty)
+	})
+}